@@ -0,0 +1,252 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.WithField("package", "pkg/archive")
+
+const (
+	snapshotExt        = ".tar.gz"
+	snapshotTimeLayout = "20060102T150405Z"
+	metaFileName       = "meta.json"
+	filesDir           = "files/"
+)
+
+// Storage stores the snapshots, keys are slash-separated paths (e.g. pl170/20210101T120000Z.tar.gz).
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// List returns the keys starting with the given prefix
+	List(ctx context.Context, prefix string) ([]string, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// Object describes a snapshot stored in the archive.
+type Object struct {
+	Key       string
+	ServerKey string
+	TakenAt   time.Time
+}
+
+// Archive stores one snapshot per server per run and deletes the snapshots older than the retention period.
+type Archive struct {
+	storage   Storage
+	retention time.Duration
+}
+
+func New(cfg *Config) (*Archive, error) {
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	return &Archive{
+		storage:   cfg.Storage,
+		retention: cfg.Retention,
+	}, nil
+}
+
+// Save writes the snapshot to the storage and deletes the expired snapshots of the same server.
+// Empty snapshots (e.g. the first request has failed) aren't saved.
+func (a *Archive) Save(ctx context.Context, s *Snapshot) error {
+	if len(s.Files()) == 0 {
+		return nil
+	}
+	b, err := s.encode()
+	if err != nil {
+		return errors.Wrap(err, "couldn't encode the snapshot")
+	}
+	key := snapshotKey(s.ServerKey, s.TakenAt)
+	if err := a.storage.Put(ctx, key, bytes.NewReader(b), int64(len(b))); err != nil {
+		return errors.Wrapf(err, "couldn't save the snapshot '%s'", key)
+	}
+	if err := a.deleteExpired(ctx, s.ServerKey, s.TakenAt); err != nil {
+		log.
+			WithField("key", s.ServerKey).
+			Warn(errors.Wrapf(err, "Archive.Save: %s: Couldn't delete the expired snapshots", s.ServerKey))
+	}
+	return nil
+}
+
+// Snapshots returns the snapshots of the given server sorted from the oldest to the newest.
+func (a *Archive) Snapshots(ctx context.Context, serverKey string) ([]Object, error) {
+	keys, err := a.storage.List(ctx, serverKey+"/")
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't list the snapshots of the server '%s'", serverKey)
+	}
+	objects := make([]Object, 0, len(keys))
+	for _, key := range keys {
+		obj, ok := parseSnapshotKey(key)
+		if !ok || obj.ServerKey != serverKey {
+			continue
+		}
+		objects = append(objects, obj)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].TakenAt.Before(objects[j].TakenAt)
+	})
+	return objects, nil
+}
+
+// Load reads the snapshot stored under the given key.
+func (a *Archive) Load(ctx context.Context, key string) (*Snapshot, error) {
+	r, err := a.storage.Get(ctx, key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't read the snapshot '%s'", key)
+	}
+	defer r.Close()
+	s, err := decodeSnapshot(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't decode the snapshot '%s'", key)
+	}
+	return s, nil
+}
+
+func (a *Archive) deleteExpired(ctx context.Context, serverKey string, now time.Time) error {
+	if a.retention <= 0 {
+		return nil
+	}
+	objects, err := a.Snapshots(ctx, serverKey)
+	if err != nil {
+		return err
+	}
+	deadline := now.Add(-a.retention)
+	for _, obj := range objects {
+		if !obj.TakenAt.Before(deadline) {
+			break
+		}
+		if err := a.storage.Delete(ctx, obj.Key); err != nil {
+			return errors.Wrapf(err, "couldn't delete the snapshot '%s'", obj.Key)
+		}
+	}
+	return nil
+}
+
+func snapshotKey(serverKey string, takenAt time.Time) string {
+	return path.Join(serverKey, takenAt.UTC().Format(snapshotTimeLayout)+snapshotExt)
+}
+
+func parseSnapshotKey(key string) (Object, bool) {
+	dir, file := path.Split(key)
+	if !strings.HasSuffix(file, snapshotExt) {
+		return Object{}, false
+	}
+	takenAt, err := time.Parse(snapshotTimeLayout, strings.TrimSuffix(file, snapshotExt))
+	if err != nil {
+		return Object{}, false
+	}
+	return Object{
+		Key:       key,
+		ServerKey: strings.TrimSuffix(dir, "/"),
+		TakenAt:   takenAt,
+	}, true
+}
+
+type snapshotMeta struct {
+	ServerKey   string    `json:"serverKey"`
+	VersionCode string    `json:"versionCode"`
+	URL         string    `json:"url"`
+	TakenAt     time.Time `json:"takenAt"`
+}
+
+// encode writes the snapshot as a gzipped tar with meta.json and the downloaded files in the files directory.
+func (s *Snapshot) encode() ([]byte, error) {
+	meta, err := json.Marshal(snapshotMeta{
+		ServerKey:   s.ServerKey,
+		VersionCode: s.VersionCode,
+		URL:         s.URL,
+		TakenAt:     s.TakenAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	write := func(name string, data []byte) error {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: s.TakenAt,
+		}); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	if err := write(metaFileName, meta); err != nil {
+		return nil, err
+	}
+	for _, name := range s.Files() {
+		data, _ := s.File(name)
+		if err := write(filesDir+name, data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeSnapshot(r io.Reader) (*Snapshot, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+
+	s := &Snapshot{
+		files: make(map[string][]byte),
+	}
+	hasMeta := false
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case hdr.Name == metaFileName:
+			var meta snapshotMeta
+			if err := json.Unmarshal(data, &meta); err != nil {
+				return nil, errors.Wrap(err, "invalid meta.json")
+			}
+			s.ServerKey = meta.ServerKey
+			s.VersionCode = meta.VersionCode
+			s.URL = meta.URL
+			s.TakenAt = meta.TakenAt
+			hasMeta = true
+		case strings.HasPrefix(hdr.Name, filesDir):
+			s.files[strings.TrimPrefix(hdr.Name, filesDir)] = data
+		}
+	}
+	if !hasMeta {
+		return nil, errors.New("meta.json is missing")
+	}
+	return s, nil
+}
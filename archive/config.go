@@ -0,0 +1,23 @@
+package archive
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type Config struct {
+	Storage Storage
+	// Retention is how long the snapshots are kept, 0 means forever
+	Retention time.Duration
+}
+
+func validateConfig(cfg *Config) error {
+	if cfg == nil || cfg.Storage == nil {
+		return errors.New("cfg.Storage is required")
+	}
+	if cfg.Retention < 0 {
+		return errors.New("cfg.Retention must not be negative")
+	}
+	return nil
+}
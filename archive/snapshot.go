@@ -0,0 +1,136 @@
+package archive
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Snapshot holds the raw files downloaded from a server during a single run.
+type Snapshot struct {
+	ServerKey   string
+	VersionCode string
+	// URL of the server the files have been downloaded from
+	URL     string
+	TakenAt time.Time
+
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func NewSnapshot(serverKey, versionCode, url string, takenAt time.Time) *Snapshot {
+	return &Snapshot{
+		ServerKey:   serverKey,
+		VersionCode: versionCode,
+		URL:         url,
+		TakenAt:     takenAt,
+		files:       make(map[string][]byte),
+	}
+}
+
+// Add stores the file under the given name, FileName returns the name for the given url.
+func (s *Snapshot) Add(name string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[name] = data
+}
+
+func (s *Snapshot) File(name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.files[name]
+	return data, ok
+}
+
+// Files returns the sorted names of the stored files.
+func (s *Snapshot) Files() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FileName returns the name under which the response for the given url is stored,
+// e.g. https://pl170.plemiona.pl/map/player.txt.gz => map/player.txt.gz,
+// https://pl170.plemiona.pl/interface.php?func=get_config => interface.php?func=get_config.
+func FileName(u *url.URL) string {
+	name := strings.TrimPrefix(u.EscapedPath(), "/")
+	if u.RawQuery != "" {
+		name += "?" + u.RawQuery
+	}
+	return name
+}
+
+// Transport returns a RoundTripper that stores the body of every successful response in the snapshot.
+func (s *Snapshot) Transport(next http.RoundTripper) http.RoundTripper {
+	return &snapshotTransport{
+		next:     next,
+		snapshot: s,
+	}
+}
+
+type snapshotTransport struct {
+	next     http.RoundTripper
+	snapshot *Snapshot
+}
+
+func (t *snapshotTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	t.snapshot.Add(FileName(req.URL), data)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return resp, nil
+}
+
+// RoundTripper returns a RoundTripper that responds with the files stored in the snapshot instead of sending the requests.
+// The requests for the files that aren't in the snapshot fail, twdataloader doesn't check the status code,
+// so a 404 would be treated as an empty file.
+func (s *Snapshot) RoundTripper() http.RoundTripper {
+	return &snapshotRoundTripper{
+		snapshot: s,
+	}
+}
+
+type snapshotRoundTripper struct {
+	snapshot *Snapshot
+}
+
+func (t *snapshotRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
+	name := FileName(req.URL)
+	data, ok := t.snapshot.File(name)
+	if !ok {
+		return nil, errors.Errorf("the file '%s' isn't in the snapshot", name)
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		ContentLength: int64(len(data)),
+		Body:          ioutil.NopCloser(bytes.NewReader(data)),
+		Request:       req,
+	}, nil
+}
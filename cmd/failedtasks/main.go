@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/go-pg/pg/v10"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tribalwarshelp/dataupdater/cmd/internal"
+	"github.com/tribalwarshelp/dataupdater/postgres"
+	"github.com/tribalwarshelp/dataupdater/queue"
+)
+
+const usage = `Usage:
+  failedtasks list [-task name] [-server key] [-limit n] [-offset n]
+  failedtasks replay id [id...]
+  failedtasks discard id [id...]
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	dbConn, err := postgres.Connect(&postgres.Config{SkipDBInitialization: true})
+	if err != nil {
+		logrus.Fatal(errors.Wrap(err, "couldn't connect to the db"))
+	}
+	defer func() {
+		if err := dbConn.Close(); err != nil {
+			logrus.Warn(errors.Wrap(err, "couldn't close the db connection"))
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	switch os.Args[1] {
+	case "list":
+		err = list(ctx, dbConn, os.Args[2:])
+	case "replay":
+		err = replay(ctx, dbConn, os.Args[2:])
+	case "discard":
+		err = forEachID(os.Args[2:], func(id int) error {
+			return queue.DiscardFailedTask(ctx, dbConn, id)
+		})
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+func list(ctx context.Context, db *pg.DB, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	f := &queue.FailedTasksFilter{}
+	fs.StringVar(&f.TaskName, "task", "", "task name")
+	fs.StringVar(&f.ServerKey, "server", "", "server key")
+	fs.IntVar(&f.Limit, "limit", 20, "")
+	fs.IntVar(&f.Offset, "offset", 0, "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	failedTasks, total, err := queue.FailedTasks(ctx, db, f)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTASK\tSERVER\tVERSION\tTIMEZONE\tATTEMPTS\tFAILED AT\tERROR")
+	for _, failedTask := range failedTasks {
+		fmt.Fprintf(
+			w,
+			"%d\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			failedTask.ID,
+			failedTask.TaskName,
+			failedTask.ServerKey,
+			failedTask.VersionCode,
+			failedTask.Timezone,
+			failedTask.Attempts,
+			failedTask.FailedAt.Format(time.RFC3339),
+			failedTask.Error,
+		)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("%d of %d failed tasks\n", len(failedTasks), total)
+	return nil
+}
+
+// replay is the only command that adds the tasks to the queue, so the others don't need Redis.
+func replay(ctx context.Context, db *pg.DB, args []string) error {
+	redisClient, err := internal.NewRedisClient()
+	if err != nil {
+		return errors.Wrap(err, "couldn't connect to Redis")
+	}
+	defer func() {
+		if err := redisClient.Close(); err != nil {
+			logrus.Warn(errors.Wrap(err, "couldn't close the Redis connection"))
+		}
+	}()
+
+	q, err := queue.New(&queue.Config{
+		DB:    db,
+		Redis: redisClient,
+	})
+	if err != nil {
+		return errors.Wrap(err, "couldn't initialize a queue")
+	}
+	return forEachID(args, func(id int) error {
+		return q.ReplayFailedTask(ctx, id)
+	})
+}
+
+func forEachID(args []string, fn func(id int) error) error {
+	if len(args) == 0 {
+		return errors.New("at least one id is required")
+	}
+	for _, arg := range args {
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			return errors.Wrapf(err, "'%s' is not a valid id", arg)
+		}
+		if err := fn(id); err != nil {
+			return err
+		}
+		fmt.Printf("%d: ok\n", id)
+	}
+	return nil
+}
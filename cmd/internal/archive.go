@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"github.com/Kichiyaki/goutil/envutil"
+	"github.com/pkg/errors"
+
+	"github.com/tribalwarshelp/dataupdater/archive"
+)
+
+// NewArchive returns nil if ARCHIVE_STORAGE is empty.
+func NewArchive() (*archive.Archive, error) {
+	var storage archive.Storage
+	var err error
+	switch kind := envutil.GetenvString("ARCHIVE_STORAGE"); kind {
+	case "":
+		return nil, nil
+	case "local":
+		storage, err = archive.NewLocalStorage(envutil.GetenvString("ARCHIVE_DIR"))
+	case "s3":
+		storage, err = archive.NewS3Storage(&archive.S3Config{
+			Endpoint:        envutil.GetenvString("ARCHIVE_S3_ENDPOINT"),
+			AccessKeyID:     envutil.GetenvString("ARCHIVE_S3_ACCESS_KEY_ID"),
+			SecretAccessKey: envutil.GetenvString("ARCHIVE_S3_SECRET_ACCESS_KEY"),
+			Region:          envutil.GetenvString("ARCHIVE_S3_REGION"),
+			Bucket:          envutil.GetenvString("ARCHIVE_S3_BUCKET"),
+			Prefix:          envutil.GetenvString("ARCHIVE_S3_PREFIX"),
+			UseSSL:          envutil.GetenvBool("ARCHIVE_S3_USE_SSL"),
+		})
+	default:
+		return nil, errors.Errorf("ARCHIVE_STORAGE: unknown storage '%s', expected local or s3", kind)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "NewArchive")
+	}
+	retention, err := GetenvDuration("ARCHIVE_RETENTION")
+	if err != nil {
+		return nil, err
+	}
+	return archive.New(&archive.Config{
+		Storage:   storage,
+		Retention: retention,
+	})
+}
@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"github.com/Kichiyaki/goutil/envutil"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GetenvDuration returns 0 if the variable is empty.
+func GetenvDuration(key string) (time.Duration, error) {
+	str := envutil.GetenvString(key)
+	if str == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		return 0, errors.Wrapf(err, "%s is not a valid duration", key)
+	}
+	return d, nil
+}
+
+// GetenvDurationMap parses a variable in the format "key1=1h,key2=30m".
+func GetenvDurationMap(key string) (map[string]time.Duration, error) {
+	str := envutil.GetenvString(key)
+	if str == "" {
+		return nil, nil
+	}
+	m := make(map[string]time.Duration)
+	for _, pair := range strings.Split(str, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("%s: '%s' should be in the format key=duration", key, pair)
+		}
+		d, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: '%s' is not a valid duration", key, parts[1])
+		}
+		m[parts[0]] = d
+	}
+	return m, nil
+}
+
+// GetenvIntMap parses a variable in the format "key1=60,key2=10".
+func GetenvIntMap(key string) (map[string]int, error) {
+	str := envutil.GetenvString(key)
+	if str == "" {
+		return nil, nil
+	}
+	m := make(map[string]int)
+	for _, pair := range strings.Split(str, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("%s: '%s' should be in the format key=number", key, pair)
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: '%s' is not a valid number", key, parts[1])
+		}
+		m[parts[0]] = n
+	}
+	return m, nil
+}
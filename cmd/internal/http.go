@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"context"
+	"github.com/Kichiyaki/goutil/envutil"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"time"
+
+	twhelpcron "github.com/tribalwarshelp/dataupdater/cron"
+)
+
+const (
+	httpShutdownTimeout = 10 * time.Second
+)
+
+// startHTTPServers serves the admin API of the cron (CRON_HTTP_ADDR, if c isn't nil) and the metrics (METRICS_ADDR),
+// on a single server if the addresses are the same.
+// The admin API requires CRON_HTTP_TOKEN unless CRON_HTTP_INSECURE is set.
+func startHTTPServers(c *twhelpcron.Cron) ([]*http.Server, error) {
+	muxes := make(map[string]*http.ServeMux)
+	var addrs []string
+	mux := func(addr string) *http.ServeMux {
+		if m, ok := muxes[addr]; ok {
+			return m
+		}
+		m := http.NewServeMux()
+		muxes[addr] = m
+		addrs = append(addrs, addr)
+		return m
+	}
+	if addr := envutil.GetenvString("CRON_HTTP_ADDR"); c != nil && addr != "" {
+		token := envutil.GetenvString("CRON_HTTP_TOKEN")
+		if token == "" {
+			if !envutil.GetenvBool("CRON_HTTP_INSECURE") {
+				return nil, errors.New("CRON_HTTP_TOKEN is required by the admin API, set CRON_HTTP_INSECURE=true to serve it without a token")
+			}
+			logrus.
+				WithField("addr", addr).
+				Warn("The admin API is served without a token, anyone who can reach it can pause and trigger the jobs")
+		}
+		mux(addr).Handle("/", twhelpcron.NewAdminHandler(c, token))
+	}
+	if addr := envutil.GetenvString("METRICS_ADDR"); addr != "" {
+		mux(addr).Handle("/metrics", promhttp.Handler())
+	}
+
+	var servers []*http.Server
+	for _, addr := range addrs {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			shutdownHTTPServers(servers)
+			return nil, errors.Wrapf(err, "couldn't listen on %s", addr)
+		}
+		srv := &http.Server{
+			Handler:           muxes[addr],
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+				logrus.Error(errors.Wrapf(err, "the HTTP server listening on %s has stopped", listener.Addr()))
+			}
+		}()
+		logrus.WithField("addr", listener.Addr().String()).Info("The HTTP server is listening")
+		servers = append(servers, srv)
+	}
+	return servers, nil
+}
+
+func shutdownHTTPServers(servers []*http.Server) {
+	for _, srv := range servers {
+		ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		if err := srv.Shutdown(ctx); err != nil {
+			logrus.Warn(errors.Wrap(err, "couldn't stop the HTTP server"))
+		}
+		cancel()
+	}
+}
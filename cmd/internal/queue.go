@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"encoding/json"
+	"github.com/Kichiyaki/goutil/envutil"
+	"github.com/go-pg/pg/v10"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"time"
+
+	"github.com/tribalwarshelp/dataupdater/queue"
+)
+
+type retryPolicy struct {
+	MaxAttempts int     `json:"maxAttempts"`
+	MinBackoff  string  `json:"minBackoff"`
+	MaxBackoff  string  `json:"maxBackoff"`
+	Jitter      float64 `json:"jitter"`
+}
+
+// GetenvRetryPolicies parses a variable in the format {"updateServerData": {"maxAttempts": 5, "minBackoff": "1m", "maxBackoff": "1h", "jitter": 0.2}}.
+func GetenvRetryPolicies(key string) (map[string]queue.RetryPolicy, error) {
+	str := envutil.GetenvString(key)
+	if str == "" {
+		return nil, nil
+	}
+	var decoded map[string]retryPolicy
+	if err := json.Unmarshal([]byte(str), &decoded); err != nil {
+		return nil, errors.Wrapf(err, "%s is not a valid JSON object", key)
+	}
+	policies := make(map[string]queue.RetryPolicy, len(decoded))
+	for taskName, p := range decoded {
+		policy := queue.RetryPolicy{
+			MaxAttempts: p.MaxAttempts,
+			Jitter:      p.Jitter,
+		}
+		var err error
+		if policy.MinBackoff, err = parseOptionalDuration(p.MinBackoff); err != nil {
+			return nil, errors.Wrapf(err, "%s: %s: minBackoff", key, taskName)
+		}
+		if policy.MaxBackoff, err = parseOptionalDuration(p.MaxBackoff); err != nil {
+			return nil, errors.Wrapf(err, "%s: %s: maxBackoff", key, taskName)
+		}
+		policies[taskName] = policy
+	}
+	return policies, nil
+}
+
+func parseOptionalDuration(str string) (time.Duration, error) {
+	if str == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(str)
+}
+
+func GetenvHTTPConfig() (*queue.HTTPConfig, error) {
+	timeout, err := GetenvDuration("QUEUE_HTTP_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+	return &queue.HTTPConfig{
+		Timeout:               timeout,
+		ProxyURL:              envutil.GetenvString("QUEUE_HTTP_PROXY_URL"),
+		UserAgent:             envutil.GetenvString("QUEUE_HTTP_USER_AGENT"),
+		MaxIdleConnsPerHost:   envutil.GetenvInt("QUEUE_HTTP_MAX_IDLE_CONNS_PER_HOST"),
+		TLSCAFile:             envutil.GetenvString("QUEUE_HTTP_TLS_CA_FILE"),
+		TLSInsecureSkipVerify: envutil.GetenvBool("QUEUE_HTTP_TLS_INSECURE_SKIP_VERIFY"),
+		DisableCompression:    envutil.GetenvBool("QUEUE_HTTP_DISABLE_COMPRESSION"),
+	}, nil
+}
+
+// GetenvQueueBackend returns queue.BackendRedis if QUEUE_BACKEND is empty.
+func GetenvQueueBackend() (queue.Backend, error) {
+	switch backend := queue.Backend(envutil.GetenvString("QUEUE_BACKEND")); backend {
+	case "":
+		return queue.BackendRedis, nil
+	case queue.BackendRedis, queue.BackendMemory:
+		return backend, nil
+	default:
+		return "", errors.Errorf("QUEUE_BACKEND: unknown backend '%s', expected redis or memory", backend)
+	}
+}
+
+// NewQueueConfig reads the queue configuration from the environment,
+// redisClient may be nil if QUEUE_BACKEND is memory.
+func NewQueueConfig(db *pg.DB, redisClient redis.UniversalClient) (*queue.Config, error) {
+	backend, err := GetenvQueueBackend()
+	if err != nil {
+		return nil, err
+	}
+	uniqueFor, err := GetenvDurationMap("QUEUE_UNIQUE_FOR")
+	if err != nil {
+		return nil, err
+	}
+	serverLockWait, err := GetenvDuration("QUEUE_SERVER_LOCK_WAIT")
+	if err != nil {
+		return nil, err
+	}
+	serverLockTTL, err := GetenvDuration("QUEUE_SERVER_LOCK_TTL")
+	if err != nil {
+		return nil, err
+	}
+	retryPolicies, err := GetenvRetryPolicies("QUEUE_RETRY_POLICIES")
+	if err != nil {
+		return nil, err
+	}
+	httpCfg, err := GetenvHTTPConfig()
+	if err != nil {
+		return nil, err
+	}
+	taskRunsRetention, err := GetenvDuration("QUEUE_TASK_RUNS_RETENTION")
+	if err != nil {
+		return nil, err
+	}
+	taskRunsSampling, err := GetenvIntMap("QUEUE_TASK_RUNS_SAMPLING")
+	if err != nil {
+		return nil, err
+	}
+	txTimeout, err := GetenvDuration("QUEUE_TX_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+	txTimeoutPerThousandRows, err := GetenvDuration("QUEUE_TX_TIMEOUT_PER_1000_ROWS")
+	if err != nil {
+		return nil, err
+	}
+	snapshotArchive, err := NewArchive()
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't initialize the snapshot archive")
+	}
+	return &queue.Config{
+		Backend:     backend,
+		DB:          db,
+		Redis:       redisClient,
+		WorkerLimit: envutil.GetenvInt("WORKER_LIMIT"),
+		UniqueFor:   uniqueFor,
+
+		ServerLockWait: serverLockWait,
+		ServerLockTTL:  serverLockTTL,
+		RetryPolicies:  retryPolicies,
+
+		RequestsPerSecondPerHost:    envutil.GetenvInt("QUEUE_REQUESTS_PER_SECOND_PER_HOST"),
+		HTTP:                        httpCfg,
+		Archive:                     snapshotArchive,
+		TaskRunsRetention:           taskRunsRetention,
+		TaskRunsSampling:            taskRunsSampling,
+		BulkThreshold:               envutil.GetenvInt("QUEUE_BULK_THRESHOLD"),
+		TxTimeout:                   txTimeout,
+		TxTimeoutPerThousandRows:    txTimeoutPerThousandRows,
+		ChunkedCommits:              envutil.GetenvBool("QUEUE_CHUNKED_COMMITS"),
+		MaxCountDropPercent:         envutil.GetenvInt("QUEUE_MAX_COUNT_DROP_PERCENT"),
+		AcceptCountDropAfter:        envutil.GetenvInt("QUEUE_ACCEPT_COUNT_DROP_AFTER"),
+		MaxUnknownReferencesPercent: envutil.GetenvInt("QUEUE_MAX_UNKNOWN_REFERENCES_PERCENT"),
+		DownloadConcurrency:         envutil.GetenvInt("QUEUE_DOWNLOAD_CONCURRENCY"),
+	}, nil
+}
@@ -0,0 +1,224 @@
+package internal
+
+import (
+	"context"
+	"github.com/Kichiyaki/goutil/envutil"
+	"github.com/go-pg/pg/v10"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"os"
+	"os/signal"
+	"syscall"
+
+	twhelpcron "github.com/tribalwarshelp/dataupdater/cron"
+	"github.com/tribalwarshelp/dataupdater/postgres"
+	"github.com/tribalwarshelp/dataupdater/queue"
+)
+
+// Components determines what the process runs.
+type Components struct {
+	// Cron schedules the tasks
+	Cron bool
+	// Worker processes the tasks
+	Worker bool
+}
+
+func (c Components) String() string {
+	switch {
+	case c.Cron && c.Worker:
+		return "cron and worker"
+	case c.Cron:
+		return "cron"
+	default:
+		return "worker"
+	}
+}
+
+// App holds the connections and the queue shared by the components.
+type App struct {
+	DB    *pg.DB
+	Redis redis.UniversalClient
+	Queue *queue.Queue
+	// TracerProvider is nil if tracing is disabled
+	TracerProvider *sdktrace.TracerProvider
+}
+
+// NewApp connects to the db and, unless QUEUE_BACKEND is memory, to Redis and creates the queue.
+// initDB creates the tables, functions etc. (see postgres.Connect), it's done by the cron.
+func NewApp(initDB bool) (*App, error) {
+	backend, err := GetenvQueueBackend()
+	if err != nil {
+		return nil, err
+	}
+
+	app := &App{}
+	app.TracerProvider, err = NewTracerProvider()
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't set up tracing")
+	}
+	if backend == queue.BackendRedis {
+		app.Redis, err = NewRedisClient()
+		if err != nil {
+			app.Close()
+			return nil, errors.Wrap(err, "couldn't connect to Redis")
+		}
+	}
+
+	app.DB, err = postgres.Connect(&postgres.Config{SkipDBInitialization: !initDB})
+	if err != nil {
+		app.Close()
+		return nil, errors.Wrap(err, "couldn't connect to the db")
+	}
+
+	queueCfg, err := NewQueueConfig(app.DB, app.Redis)
+	if err != nil {
+		app.Close()
+		return nil, err
+	}
+	app.Queue, err = queue.New(queueCfg)
+	if err != nil {
+		app.Close()
+		return nil, errors.Wrap(err, "couldn't initialize a queue")
+	}
+
+	return app, nil
+}
+
+// Close closes the queue (waiting for the tasks in progress), the connections and finally exports the remaining spans.
+func (app *App) Close() {
+	if app.Queue != nil {
+		if err := app.Queue.Close(); err != nil {
+			logrus.Warn(errors.Wrap(err, "couldn't close the queue"))
+		}
+	}
+	if app.DB != nil {
+		if err := app.DB.Close(); err != nil {
+			logrus.Warn(errors.Wrap(err, "couldn't close the db connection"))
+		}
+	}
+	if app.Redis != nil {
+		if err := app.Redis.Close(); err != nil {
+			logrus.Warn(errors.Wrap(err, "couldn't close the Redis connection"))
+		}
+	}
+	if app.TracerProvider != nil {
+		if err := shutdownTracerProvider(app.TracerProvider); err != nil {
+			logrus.Warn(errors.Wrap(err, "couldn't export the remaining spans"))
+		}
+	}
+}
+
+// NewCron creates a cron instance configured via the CRON_* variables.
+func NewCron(app *App) (*twhelpcron.Cron, error) {
+	var schedule twhelpcron.Schedule
+	if path := envutil.GetenvString("CRON_SCHEDULE_FILE"); path != "" {
+		var err error
+		schedule, err = twhelpcron.LoadSchedule(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't load the schedule")
+		}
+	}
+
+	versionsSyncInterval, err := GetenvDuration("CRON_VERSIONS_SYNC_INTERVAL")
+	if err != nil {
+		return nil, err
+	}
+	leaderLeaseTTL, err := GetenvDuration("CRON_LEADER_LEASE_TTL")
+	if err != nil {
+		return nil, err
+	}
+	missedRunsWindow, err := GetenvDuration("CRON_MISSED_RUNS_WINDOW")
+	if err != nil {
+		return nil, err
+	}
+	if envutil.GetenvString("RUN_ON_INIT") != "" {
+		logrus.Warn("RUN_ON_INIT is no longer supported and is ignored, set CRON_MISSED_RUNS_WINDOW to run the jobs missed during a downtime")
+	}
+
+	c, err := twhelpcron.New(&twhelpcron.Config{
+		DB:       app.DB,
+		Queue:    app.Queue,
+		Schedule: schedule,
+
+		VersionsSyncInterval: versionsSyncInterval,
+		Redis:                app.Redis,
+		InstanceID:           envutil.GetenvString("INSTANCE_ID"),
+		LeaderLeaseTTL:       leaderLeaseTTL,
+		MissedRunsWindow:     missedRunsWindow,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't initialize a cron instance")
+	}
+	return c, nil
+}
+
+// Run starts the given components and blocks until the process receives SIGINT or SIGTERM.
+// The components are stopped in order: the HTTP servers (admin API and metrics), the cron stops scheduling new tasks,
+// then the workers finish the tasks in progress and finally the connections are closed.
+//
+// With QUEUE_BACKEND=memory the tasks are processed by the process that schedules them,
+// so the cron always runs the workers too and the worker can't run on its own.
+func Run(components Components) error {
+	backend, err := GetenvQueueBackend()
+	if err != nil {
+		return err
+	}
+	if backend == queue.BackendMemory {
+		if !components.Cron {
+			return errors.New("QUEUE_BACKEND=memory: the tasks are processed by the process that schedules them, run the cron instead")
+		}
+		components.Worker = true
+	}
+
+	app, err := NewApp(components.Cron)
+	if err != nil {
+		return err
+	}
+	defer app.Close()
+
+	if components.Worker {
+		if err := app.Queue.Start(context.Background()); err != nil {
+			return errors.Wrap(err, "couldn't start the queue")
+		}
+	}
+
+	var c *twhelpcron.Cron
+	if components.Cron {
+		c, err = NewCron(app)
+		if err != nil {
+			return err
+		}
+		if err := c.Start(); err != nil {
+			return errors.Wrap(err, "couldn't start the cron")
+		}
+	}
+
+	httpServers, err := startHTTPServers(c)
+	if err != nil {
+		if c != nil {
+			_ = c.Stop()
+		}
+		return err
+	}
+
+	entry := logrus.WithField("components", components.String())
+	if c != nil {
+		entry = entry.WithField("instance", c.InstanceID())
+	}
+	entry.Info("twhelp is up and running!")
+
+	channel := make(chan os.Signal, 1)
+	signal.Notify(channel, os.Interrupt, syscall.SIGTERM)
+	<-channel
+
+	entry.Info("shutting down")
+	shutdownHTTPServers(httpServers)
+	if c != nil {
+		if err := c.Stop(); err != nil {
+			logrus.Warn(errors.Wrap(err, "couldn't stop the cron"))
+		}
+	}
+	return nil
+}
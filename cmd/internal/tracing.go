@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"context"
+	"github.com/Kichiyaki/goutil/envutil"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"time"
+)
+
+const (
+	defaultServiceName     = "twhelp"
+	tracingShutdownTimeout = 10 * time.Second
+)
+
+// NewTracerProvider sets up the export of the spans via OTLP/HTTP if OTEL_EXPORTER_OTLP_ENDPOINT
+// or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set, it returns nil otherwise and the spans aren't recorded.
+// The exporter, the sampler (OTEL_TRACES_SAMPLER) and the resource (OTEL_SERVICE_NAME, OTEL_RESOURCE_ATTRIBUTES)
+// are configured via the standard OTEL_* variables.
+func NewTracerProvider() (*sdktrace.TracerProvider, error) {
+	if envutil.GetenvString("OTEL_EXPORTER_OTLP_ENDPOINT") == "" &&
+		envutil.GetenvString("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return nil, nil
+	}
+
+	ctx := context.Background()
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't create the OTLP exporter")
+	}
+	res, err := resource.New(
+		ctx,
+		resource.WithAttributes(semconv.ServiceNameKey.String(defaultServiceName)),
+		resource.WithFromEnv(),
+		resource.WithHost(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't create the resource")
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return tp, nil
+}
+
+// shutdownTracerProvider exports the remaining spans.
+func shutdownTracerProvider(tp *sdktrace.TracerProvider) error {
+	ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	defer cancel()
+	return tp.Shutdown(ctx)
+}
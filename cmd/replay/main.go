@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tribalwarshelp/dataupdater/cmd/internal"
+	"github.com/tribalwarshelp/dataupdater/postgres"
+	"github.com/tribalwarshelp/dataupdater/queue"
+)
+
+func main() {
+	var from, to string
+	cfg := &queue.ReplayConfig{}
+	listOnly := false
+	flag.StringVar(&cfg.ServerKey, "server", "", "key of the server to rebuild, e.g. pl170 (required)")
+	flag.StringVar(&from, "from", "", "replay the snapshots taken at or after the given time (RFC3339)")
+	flag.StringVar(&to, "to", "", "replay the snapshots taken at or before the given time (RFC3339)")
+	flag.DurationVar(&cfg.HistoryAt, "history-at", 0, "time of day at which the history is updated (default 1h30m)")
+	flag.DurationVar(&cfg.StatsAt, "stats-at", 0, "time of day at which the stats are updated (default 1h45m)")
+	flag.BoolVar(&cfg.Reset, "reset", false, "truncate the players, tribes, villages, history and stats of the server first")
+	flag.BoolVar(&listOnly, "list", false, "list the snapshots of the server and exit")
+	flag.Parse()
+	if cfg.ServerKey == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var err error
+	if cfg.From, err = parseOptionalTime(from); err != nil {
+		logrus.Fatal(errors.Wrap(err, "-from"))
+	}
+	if cfg.To, err = parseOptionalTime(to); err != nil {
+		logrus.Fatal(errors.Wrap(err, "-to"))
+	}
+
+	cfg.Archive, err = internal.NewArchive()
+	if err != nil {
+		logrus.Fatal(errors.Wrap(err, "couldn't initialize the snapshot archive"))
+	}
+	if cfg.Archive == nil {
+		logrus.Fatal("ARCHIVE_STORAGE is required")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		channel := make(chan os.Signal, 1)
+		signal.Notify(channel, os.Interrupt, syscall.SIGTERM)
+		<-channel
+		logrus.Info("stopping after the current step")
+		cancel()
+	}()
+
+	if listOnly {
+		if err := list(ctx, cfg); err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	}
+
+	// the db is initialized to make sure the triggers use the simulated clock
+	dbConn, err := postgres.Connect(&postgres.Config{})
+	if err != nil {
+		logrus.Fatal(errors.Wrap(err, "couldn't connect to the db"))
+	}
+	defer func() {
+		if err := dbConn.Close(); err != nil {
+			logrus.Warn(errors.Wrap(err, "couldn't close the db connection"))
+		}
+	}()
+	cfg.DB = dbConn
+
+	start := time.Now()
+	result, err := queue.Replay(ctx, cfg)
+	if result != nil {
+		fmt.Printf(
+			"snapshots: %d (failed: %d), history updates: %d, stats updates: %d, took %s\n",
+			result.Snapshots,
+			result.FailedSnapshots,
+			result.HistoryUpdates,
+			result.StatsUpdates,
+			time.Since(start),
+		)
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+func list(ctx context.Context, cfg *queue.ReplayConfig) error {
+	objects, err := cfg.Archive.Snapshots(ctx, cfg.ServerKey)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TAKEN AT\tKEY")
+	for _, obj := range objects {
+		fmt.Fprintf(w, "%s\t%s\n", obj.TakenAt.Format(time.RFC3339), obj.Key)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("%d snapshots\n", len(objects))
+	return nil
+}
+
+func parseOptionalTime(str string) (time.Time, error) {
+	if str == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, str)
+}
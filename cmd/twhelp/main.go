@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+
+	"github.com/tribalwarshelp/dataupdater/cmd/internal"
+)
+
+const usage = `Usage:
+  twhelp cron    schedules the tasks (like cmd/cron)
+  twhelp worker  processes the tasks (like cmd/dataupdater)
+  twhelp all     schedules and processes the tasks in a single process
+  twhelp task    manages the tasks manually, see twhelp task -h
+`
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "task" {
+		if err := runTask(os.Args[2:]); err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) != 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var components internal.Components
+	switch os.Args[1] {
+	case "cron":
+		components.Cron = true
+	case "worker":
+		components.Worker = true
+	case "all":
+		components.Cron = true
+		components.Worker = true
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err := internal.Run(components); err != nil {
+		logrus.Fatal(err)
+	}
+}
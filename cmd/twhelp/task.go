@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tribalwarshelp/dataupdater/cmd/internal"
+	"github.com/tribalwarshelp/dataupdater/queue"
+)
+
+const taskUsage = `Usage:
+  twhelp task run <task> [--server key | --version code | --all] [--sync]
+
+Flags:
+  --server key    the given server (any status)
+  --version code  the open servers of the given version, the version itself (loadServersAndUpdateData)
+                  or its timezone (updateHistory, updateStats)
+  --all           all open servers, all versions or all timezones
+  --sync          run the task in this process and print the result instead of adding it to the queue,
+                  the tasks added by it still go to the queue, with QUEUE_BACKEND=memory
+                  they go to the queue of this process and are dropped when it exits
+
+Tasks:
+  %s
+`
+
+func runTask(args []string) error {
+	if len(args) < 2 || args[0] != "run" || strings.HasPrefix(args[1], "-") {
+		fmt.Fprintf(os.Stderr, taskUsage, strings.Join(queue.TaskNames(), "\n  "))
+		os.Exit(2)
+	}
+	taskName := args[1]
+
+	fs := flag.NewFlagSet("task run", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, taskUsage, strings.Join(queue.TaskNames(), "\n  "))
+	}
+	var target queue.TriggerTarget
+	fs.StringVar(&target.ServerKey, "server", "", "")
+	fs.StringVar(&target.VersionCode, "version", "", "")
+	fs.BoolVar(&target.All, "all", false, "")
+	sync := fs.Bool("sync", false, "")
+	_ = fs.Parse(args[2:])
+
+	backend, err := internal.GetenvQueueBackend()
+	if err != nil {
+		return err
+	}
+	if backend == queue.BackendMemory && !*sync {
+		return errors.New("QUEUE_BACKEND=memory: the queue isn't shared with other processes, use --sync")
+	}
+	if backend == queue.BackendMemory {
+		fmt.Fprintln(os.Stderr, "QUEUE_BACKEND=memory: the tasks added by the task are dropped when the command exits")
+	}
+
+	app, err := internal.NewApp(false)
+	if err != nil {
+		return err
+	}
+	defer app.Close()
+
+	ctx := context.Background()
+	msgs, err := app.Queue.NewMessages(ctx, taskName, target)
+	if err != nil {
+		return err
+	}
+	if len(msgs) == 0 {
+		fmt.Println("Nothing to do, no servers match the given flags.")
+		return nil
+	}
+
+	failed := 0
+	for _, msg := range msgs {
+		subject := queue.MessageSubject(msg)
+		if subject == "" {
+			subject = "-"
+		}
+		if !*sync {
+			added, err := app.Queue.TryAdd(msg)
+			switch {
+			case err != nil:
+				failed++
+				fmt.Printf("%s\t%s\terror: %s\n", taskName, subject, err)
+			case added:
+				fmt.Printf("%s\t%s\tadded\n", taskName, subject)
+			default:
+				fmt.Printf("%s\t%s\tskipped, already pending or running\n", taskName, subject)
+			}
+			continue
+		}
+
+		start := time.Now()
+		err := app.Queue.Run(msg)
+		took := time.Since(start).Round(time.Millisecond)
+		if err != nil {
+			failed++
+			fmt.Printf("%s\t%s\tfailed after %s: %s\n", taskName, subject, took, err)
+			continue
+		}
+		fmt.Printf("%s\t%s\tdone in %s\n", taskName, subject, took)
+	}
+	if failed > 0 {
+		return errors.Errorf("%d of %d tasks have failed", failed, len(msgs))
+	}
+	return nil
+}
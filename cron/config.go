@@ -2,17 +2,35 @@ package cron
 
 import (
 	"github.com/go-pg/pg/v10"
+	"github.com/go-redis/redis/v8"
 	"github.com/pkg/errors"
+	"time"
 
 	"github.com/tribalwarshelp/dataupdater/queue"
 )
 
 type Config struct {
-	DB        *pg.DB
-	Queue     *queue.Queue
-	RunOnInit bool
+	DB    *pg.DB
+	Queue *queue.Queue
+	// Schedule defaults to DefaultSchedule()
+	Schedule Schedule
+	// VersionsSyncInterval is how often the per-timezone jobs are reconciled with the versions table (default 5m)
+	VersionsSyncInterval time.Duration
+	// Redis enables the leader election, only the leader fires the jobs.
+	// Without it, this instance must be the only one running.
+	Redis          redis.UniversalClient
+	InstanceID     string
+	LeaderLeaseTTL time.Duration
+	// MissedRunsWindow enables running the jobs that were missed during a downtime (requires Redis).
+	// Only the runs that should have happened within this window are taken into account,
+	// the jobs that have never run or run more often than once a day aren't caught up.
+	MissedRunsWindow time.Duration
 }
 
+const (
+	defaultVersionsSyncInterval = 5 * time.Minute
+)
+
 func validateConfig(cfg *Config) error {
 	if cfg == nil || cfg.DB == nil {
 		return errors.New("cfg.DB is required")
@@ -20,5 +38,16 @@ func validateConfig(cfg *Config) error {
 	if cfg.Queue == nil {
 		return errors.New("cfg.Queue is required")
 	}
+	if cfg.MissedRunsWindow < 0 {
+		return errors.New("cfg.MissedRunsWindow must not be negative")
+	}
+	if cfg.MissedRunsWindow > 0 && cfg.Redis == nil {
+		return errors.New("cfg.MissedRunsWindow requires cfg.Redis, the last runs are stored in Redis")
+	}
+	if cfg.Schedule != nil {
+		if err := cfg.Schedule.Validate(); err != nil {
+			return errors.Wrap(err, "cfg.Schedule is invalid")
+		}
+	}
 	return nil
 }
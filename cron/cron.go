@@ -4,9 +4,11 @@ import (
 	"context"
 	"fmt"
 	"github.com/go-pg/pg/v10"
+	"github.com/go-redis/redis/v8"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"github.com/tribalwarshelp/shared/tw/twmodel"
+	"sync"
+	"time"
 
 	"github.com/robfig/cron/v3"
 
@@ -15,10 +17,25 @@ import (
 
 type Cron struct {
 	*cron.Cron
-	queue     *queue.Queue
-	db        *pg.DB
-	runOnInit bool
-	log       logrus.FieldLogger
+	queue    *queue.Queue
+	db       *pg.DB
+	schedule Schedule
+	log      logrus.FieldLogger
+
+	versionsSyncInterval time.Duration
+	timezoneEntriesMu    sync.Mutex
+	timezoneEntries      map[string]map[string]timezoneEntry
+
+	elector          *leaderElector
+	redis            redis.UniversalClient
+	missedRunsWindow time.Duration
+	// catchUp requests running the missed jobs, see catchUpLoop
+	catchUp     chan struct{}
+	catchUpDone chan struct{}
+
+	// paused holds the paused jobs when Redis isn't configured
+	pausedMu sync.Mutex
+	paused   map[string]bool
 }
 
 func New(cfg *Config) (*Cron, error) {
@@ -32,10 +49,31 @@ func New(cfg *Config) (*Cron, error) {
 				cron.PrintfLogger(log),
 			),
 		)),
-		queue:     cfg.Queue,
-		db:        cfg.DB,
-		runOnInit: cfg.RunOnInit,
-		log:       log,
+		queue:    cfg.Queue,
+		db:       cfg.DB,
+		schedule: cfg.Schedule,
+		log:      log,
+
+		versionsSyncInterval: cfg.VersionsSyncInterval,
+		timezoneEntries:      make(map[string]map[string]timezoneEntry),
+		paused:               make(map[string]bool),
+	}
+	if c.schedule == nil {
+		c.schedule = DefaultSchedule()
+	}
+	if c.versionsSyncInterval <= 0 {
+		c.versionsSyncInterval = defaultVersionsSyncInterval
+	}
+	if cfg.Redis != nil {
+		c.redis = cfg.Redis
+		c.missedRunsWindow = cfg.MissedRunsWindow
+		c.elector = newLeaderElector(cfg.Redis, cfg.InstanceID, cfg.LeaderLeaseTTL, log)
+		if c.missedRunsWindow > 0 {
+			c.catchUp = make(chan struct{}, 1)
+			c.catchUpDone = make(chan struct{})
+			c.elector.onElected = c.requestCatchUp
+			go c.catchUpLoop()
+		}
 	}
 	if err := c.init(); err != nil {
 		return nil, err
@@ -44,64 +82,90 @@ func New(cfg *Config) (*Cron, error) {
 }
 
 func (c *Cron) init() error {
-	var versions []*twmodel.Version
-	if err := c.db.Model(&versions).DistinctOn("timezone").Select(); err != nil {
-		return errors.Wrap(err, "couldn't load versions")
+	versions, err := c.loadVersions()
+	if err != nil {
+		return err
 	}
-
-	var updateHistoryFuncs []func()
-	var updateStatsFuncs []func()
-	for _, version := range versions {
-		updateHistory := createFnWithTimezone(version.Timezone, c.updateHistory)
-		updateHistoryFuncs = append(updateHistoryFuncs, updateHistory)
-
-		updateStats := createFnWithTimezone(version.Timezone, c.updateStats)
-		updateStatsFuncs = append(updateStatsFuncs, updateStats)
-
-		if _, err := c.AddFunc(fmt.Sprintf("CRON_TZ=%s 30 1 * * *", version.Timezone), updateHistory); err != nil {
-			return err
-		}
-		if _, err := c.AddFunc(fmt.Sprintf("CRON_TZ=%s 45 1 * * *", version.Timezone), updateStats); err != nil {
-			return err
+	for _, taskName := range []string{queue.UpdateHistory, queue.UpdateStats} {
+		if !c.schedule[taskName].IsEnabled() {
+			c.log.WithField("task", taskName).Infof("Cron.init: The job '%s' is disabled", taskName)
 		}
 	}
-	if _, err := c.AddFunc("0 * * * *", c.updateServerData); err != nil {
+	if err := c.syncTimezoneJobs(versions); err != nil {
 		return err
 	}
-	if _, err := c.AddFunc("20 1 * * *", c.vacuumDatabase); err != nil {
+	if err := c.addJob(queue.LoadVersionsAndUpdateServerData, c.updateServerData); err != nil {
 		return err
 	}
-	if _, err := c.AddFunc("10 1 * * *", c.deleteNonExistentVillages); err != nil {
+	if err := c.addJob(queue.Vacuum, c.vacuumDatabase); err != nil {
 		return err
 	}
-	if _, err := c.AddFunc("@every 1m", c.updateEnnoblements); err != nil {
+	if err := c.addJob(queue.DeleteNonExistentVillages, c.deleteNonExistentVillages); err != nil {
 		return err
 	}
-	if c.runOnInit {
-		go func() {
-			c.updateServerData()
-			c.vacuumDatabase()
-			for _, fn := range updateHistoryFuncs {
-				fn()
-			}
-			for _, fn := range updateStatsFuncs {
-				fn()
-			}
-		}()
+	if err := c.addJob(queue.UpdateEnnoblements, c.updateEnnoblements); err != nil {
+		return err
+	}
+	if _, err := c.AddFunc(fmt.Sprintf("@every %s", c.versionsSyncInterval), c.reconcileTimezoneJobs); err != nil {
+		return errors.Wrap(err, "couldn't schedule the reconciliation of the timezone jobs")
+	}
+	return nil
+}
+
+func (c *Cron) addJob(taskName string, fn func()) error {
+	job := c.schedule[taskName]
+	if !job.IsEnabled() {
+		c.log.WithField("task", taskName).Infof("Cron.addJob: The job '%s' is disabled", taskName)
+		return nil
+	}
+	if _, err := c.AddJob(job.Spec, c.newTrackedJob(taskName, "", job.Spec, fn)); err != nil {
+		return errors.Wrapf(err, "couldn't schedule the job '%s'", taskName)
 	}
 	return nil
 }
 
 func (c *Cron) Start() error {
+	if c.elector != nil {
+		c.elector.start()
+	}
 	c.Cron.Start()
 	return nil
 }
 
 func (c *Cron) Stop() error {
-	c.Cron.Stop()
+	<-c.Cron.Stop().Done()
+	if c.elector != nil {
+		c.elector.stop()
+	}
+	if c.catchUp != nil {
+		close(c.catchUp)
+		<-c.catchUpDone
+	}
 	return nil
 }
 
+// IsLeader reports whether this instance fires the jobs.
+// An instance without Redis configured is always the leader.
+func (c *Cron) IsLeader() bool {
+	return c.elector == nil || c.elector.IsLeader()
+}
+
+// InstanceID returns the id used in the leader election or an empty string if it's disabled.
+func (c *Cron) InstanceID() string {
+	if c.elector == nil {
+		return ""
+	}
+	return c.elector.id
+}
+
+// Leader returns the id of the current leader.
+func (c *Cron) Leader(ctx context.Context) (string, error) {
+	if c.elector == nil {
+		return "", nil
+	}
+	return c.elector.leader(ctx)
+}
+
 func (c *Cron) updateServerData() {
 	err := c.queue.Add(queue.GetTask(queue.LoadVersionsAndUpdateServerData).WithArgs(context.Background()))
 	if err != nil {
@@ -0,0 +1,220 @@
+package cron
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tribalwarshelp/dataupdater/queue"
+)
+
+const (
+	adminRequestTimeout = 10 * time.Second
+	defaultRunsLimit    = 50
+	maxRunsLimit        = 500
+)
+
+// NewAdminHandler returns the handler of the admin API:
+//
+//	GET  /jobs                  the scheduled jobs with their next and previous runs
+//	POST /jobs/pause?job=key    pauses the job
+//	POST /jobs/resume?job=key   resumes the job
+//	POST /jobs/trigger?job=key  adds the task of the job to the queue now
+//	GET  /runs                  the task runs, the most recent first (?task=, ?server=, ?outcome=, ?limit=, ?offset=)
+//	GET  /leader                the current leader
+//	GET  /health                the status of the db and Redis connections
+//
+// All responses are JSON. If the token isn't empty, the requests must send it in the header Authorization: Bearer <token>.
+func NewAdminHandler(c *Cron, token string) http.Handler {
+	h := &adminHandler{
+		c:     c,
+		token: token,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", h.method(http.MethodGet, h.jobs))
+	mux.HandleFunc("/jobs/pause", h.method(http.MethodPost, h.jobAction(c.PauseJob)))
+	mux.HandleFunc("/jobs/resume", h.method(http.MethodPost, h.jobAction(c.ResumeJob)))
+	mux.HandleFunc("/jobs/trigger", h.method(http.MethodPost, h.jobAction(func(_ context.Context, key string) error {
+		return c.TriggerJob(key)
+	})))
+	mux.HandleFunc("/runs", h.method(http.MethodGet, h.runs))
+	mux.HandleFunc("/leader", h.method(http.MethodGet, h.leader))
+	mux.HandleFunc("/health", h.method(http.MethodGet, h.health))
+	return mux
+}
+
+type adminHandler struct {
+	c     *Cron
+	token string
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+// method rejects the requests with another method and the unauthorized requests.
+func (h *adminHandler) method(method string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.token != "" &&
+			subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+h.token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, adminError{"unauthorized"})
+			return
+		}
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeJSON(w, http.StatusMethodNotAllowed, adminError{"method not allowed"})
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), adminRequestTimeout)
+		defer cancel()
+		fn(w, r.WithContext(ctx))
+	}
+}
+
+func (h *adminHandler) jobs(w http.ResponseWriter, r *http.Request) {
+	jobs, err := h.c.Jobs(r.Context())
+	if err != nil {
+		h.c.log.Error(errors.Wrap(err, "adminHandler.jobs"))
+		writeJSON(w, http.StatusInternalServerError, adminError{err.Error()})
+		return
+	}
+	if jobs == nil {
+		jobs = []JobInfo{}
+	}
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+func (h *adminHandler) jobAction(fn func(ctx context.Context, key string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("job")
+		if key == "" {
+			writeJSON(w, http.StatusBadRequest, adminError{"the query parameter 'job' is required"})
+			return
+		}
+		if err := fn(r.Context(), key); err != nil {
+			if err == ErrJobNotFound {
+				writeJSON(w, http.StatusNotFound, adminError{"job '" + key + "' not found"})
+				return
+			}
+			h.c.log.WithField("job", key).Error(errors.Wrapf(err, "adminHandler.jobAction: %s", key))
+			writeJSON(w, http.StatusInternalServerError, adminError{err.Error()})
+			return
+		}
+		// the action has succeeded, so the job is described on a best-effort basis
+		jobs, _ := h.c.Jobs(r.Context())
+		for _, job := range jobs {
+			if job.Key == key {
+				writeJSON(w, http.StatusOK, job)
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, struct{}{})
+	}
+}
+
+type runsResponse struct {
+	Runs  []*queue.TaskRun `json:"runs"`
+	Total int              `json:"total"`
+}
+
+func (h *adminHandler) runs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := &queue.TaskRunsFilter{
+		TaskName:  query.Get("task"),
+		ServerKey: query.Get("server"),
+		Outcome:   query.Get("outcome"),
+		Limit:     defaultRunsLimit,
+	}
+	for param, dest := range map[string]*int{"limit": &filter.Limit, "offset": &filter.Offset} {
+		str := query.Get(param)
+		if str == "" {
+			continue
+		}
+		n, err := strconv.Atoi(str)
+		if err != nil || n < 0 {
+			writeJSON(w, http.StatusBadRequest, adminError{"the query parameter '" + param + "' must be a non-negative integer"})
+			return
+		}
+		*dest = n
+	}
+	switch {
+	case filter.Limit == 0:
+		filter.Limit = defaultRunsLimit
+	case filter.Limit > maxRunsLimit:
+		filter.Limit = maxRunsLimit
+	}
+	runs, total, err := h.c.queue.TaskRuns(r.Context(), filter)
+	if err != nil {
+		h.c.log.Error(errors.Wrap(err, "adminHandler.runs"))
+		writeJSON(w, http.StatusInternalServerError, adminError{err.Error()})
+		return
+	}
+	if runs == nil {
+		runs = []*queue.TaskRun{}
+	}
+	writeJSON(w, http.StatusOK, runsResponse{
+		Runs:  runs,
+		Total: total,
+	})
+}
+
+type leaderResponse struct {
+	// InstanceID is empty if the leader election is disabled
+	InstanceID string `json:"instanceID"`
+	Leader     string `json:"leader"`
+	IsLeader   bool   `json:"isLeader"`
+}
+
+func (h *adminHandler) leader(w http.ResponseWriter, r *http.Request) {
+	leader, err := h.c.Leader(r.Context())
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, adminError{err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, leaderResponse{
+		InstanceID: h.c.InstanceID(),
+		Leader:     leader,
+		IsLeader:   h.c.IsLeader(),
+	})
+}
+
+type healthResponse struct {
+	Status   string `json:"status"`
+	DB       string `json:"db"`
+	Redis    string `json:"redis,omitempty"`
+	IsLeader bool   `json:"isLeader"`
+}
+
+func (h *adminHandler) health(w http.ResponseWriter, r *http.Request) {
+	resp := healthResponse{
+		Status:   "ok",
+		DB:       "ok",
+		IsLeader: h.c.IsLeader(),
+	}
+	if err := h.c.db.Ping(r.Context()); err != nil {
+		resp.Status = "unavailable"
+		resp.DB = err.Error()
+	}
+	if h.c.redis != nil {
+		resp.Redis = "ok"
+		if err := h.c.redis.Ping(r.Context()).Err(); err != nil {
+			resp.Status = "unavailable"
+			resp.Redis = err.Error()
+		}
+	}
+	status := http.StatusOK
+	if resp.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, resp)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
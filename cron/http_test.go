@@ -0,0 +1,95 @@
+package cron
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tribalwarshelp/dataupdater/queue"
+)
+
+func TestAdminHandler(t *testing.T) {
+	c := newTestCron(nil)
+	runs := 0
+	if _, err := c.AddJob("@every 1m", c.newTrackedJob(queue.UpdateEnnoblements, "", "@every 1m", func() {
+		runs++
+	})); err != nil {
+		t.Fatal(err)
+	}
+	h := NewAdminHandler(c, "secret")
+	do := func(method, target, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		token    string
+		expected int
+	}{
+		{"no token", http.MethodGet, "/jobs", "", http.StatusUnauthorized},
+		{"invalid token", http.MethodPost, "/jobs/pause?job=" + queue.UpdateEnnoblements, "invalid", http.StatusUnauthorized},
+		{"invalid method", http.MethodGet, "/jobs/pause?job=" + queue.UpdateEnnoblements, "secret", http.StatusMethodNotAllowed},
+		{"no job", http.MethodPost, "/jobs/pause", "secret", http.StatusBadRequest},
+		{"unknown job", http.MethodPost, "/jobs/pause?job=unknown", "secret", http.StatusNotFound},
+		{"jobs", http.MethodGet, "/jobs", "secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := do(tt.method, tt.target, tt.token); rec.Code != tt.expected {
+				t.Errorf("expected %d, got %d: %s", tt.expected, rec.Code, rec.Body.String())
+			}
+		})
+	}
+
+	t.Run("pause and resume", func(t *testing.T) {
+		job := c.findJob(queue.UpdateEnnoblements)
+		for _, action := range []struct {
+			path   string
+			paused bool
+			runs   int
+		}{
+			{"/jobs/pause", true, 0},
+			{"/jobs/resume", false, 1},
+		} {
+			rec := do(http.MethodPost, action.path+"?job="+queue.UpdateEnnoblements, "secret")
+			if rec.Code != http.StatusOK {
+				t.Fatalf("%s: expected 200, got %d: %s", action.path, rec.Code, rec.Body.String())
+			}
+			var info JobInfo
+			if err := json.NewDecoder(rec.Body).Decode(&info); err != nil {
+				t.Fatal(err)
+			}
+			if info.Key != queue.UpdateEnnoblements || info.Paused != action.paused {
+				t.Errorf("%s: expected the job to be paused: %v, got %+v", action.path, action.paused, info)
+			}
+			runs = 0
+			job.Run()
+			if runs != action.runs {
+				t.Errorf("%s: expected %d runs, got %d", action.path, action.runs, runs)
+			}
+		}
+	})
+
+	t.Run("trigger", func(t *testing.T) {
+		if err := c.PauseJob(context.Background(), queue.UpdateEnnoblements); err != nil {
+			t.Fatal(err)
+		}
+		runs = 0
+		if rec := do(http.MethodPost, "/jobs/trigger?job="+queue.UpdateEnnoblements, "secret"); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if runs != 1 {
+			t.Errorf("expected the paused job to be triggered, got %d runs", runs)
+		}
+	})
+}
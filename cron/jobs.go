@@ -0,0 +1,167 @@
+package cron
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"sort"
+	"time"
+)
+
+const (
+	pausedJobsKey = "twhelp:cron:paused"
+)
+
+var ErrJobNotFound = errors.New("job not found")
+
+// JobInfo describes a scheduled job.
+type JobInfo struct {
+	// Key identifies the job, e.g. updateEnnoblements or updateHistory:Europe/Warsaw
+	Key      string `json:"key"`
+	Task     string `json:"task"`
+	Timezone string `json:"timezone,omitempty"`
+	Spec     string `json:"spec"`
+	// Next is zero if the cron hasn't been started
+	Next time.Time `json:"next"`
+	// Prev is the last run fired by any instance (or by this instance without Redis), nil if it hasn't run yet
+	Prev   *time.Time `json:"prev"`
+	Paused bool       `json:"paused"`
+}
+
+// Jobs returns the scheduled jobs sorted by key.
+func (c *Cron) Jobs(ctx context.Context) ([]JobInfo, error) {
+	var lastRuns map[string]time.Time
+	var paused map[string]bool
+	if c.redis != nil {
+		var err error
+		lastRuns, err = c.loadLastRuns(ctx)
+		if err != nil {
+			return nil, err
+		}
+		paused, err = c.loadPausedJobs(ctx)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		paused = c.pausedJobsInMemory()
+	}
+
+	var jobs []JobInfo
+	for _, entry := range c.Entries() {
+		job, ok := entry.Job.(*trackedJob)
+		if !ok {
+			continue
+		}
+		info := JobInfo{
+			Key:      job.key,
+			Task:     job.taskName,
+			Timezone: job.timezone,
+			Spec:     job.spec,
+			Next:     entry.Next,
+			Paused:   paused[job.key],
+		}
+		prev := entry.Prev
+		if lastRun, ok := lastRuns[job.key]; ok {
+			prev = lastRun
+		}
+		if !prev.IsZero() {
+			info.Prev = &prev
+		}
+		jobs = append(jobs, info)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Key < jobs[j].Key
+	})
+	return jobs, nil
+}
+
+// PauseJob stops the job from adding its task until it's resumed.
+// With Redis, the job is paused on all instances and stays paused after a restart.
+func (c *Cron) PauseJob(ctx context.Context, key string) error {
+	if c.findJob(key) == nil {
+		return ErrJobNotFound
+	}
+	if c.redis == nil {
+		c.pausedMu.Lock()
+		c.paused[key] = true
+		c.pausedMu.Unlock()
+	} else if err := c.redis.SAdd(ctx, pausedJobsKey, key).Err(); err != nil {
+		return errors.Wrapf(err, "couldn't pause the job '%s'", key)
+	}
+	c.log.WithField("job", key).Infof("Cron.PauseJob: The job '%s' has been paused", key)
+	return nil
+}
+
+func (c *Cron) ResumeJob(ctx context.Context, key string) error {
+	if c.findJob(key) == nil {
+		return ErrJobNotFound
+	}
+	if c.redis == nil {
+		c.pausedMu.Lock()
+		delete(c.paused, key)
+		c.pausedMu.Unlock()
+	} else if err := c.redis.SRem(ctx, pausedJobsKey, key).Err(); err != nil {
+		return errors.Wrapf(err, "couldn't resume the job '%s'", key)
+	}
+	c.log.WithField("job", key).Infof("Cron.ResumeJob: The job '%s' has been resumed", key)
+	return nil
+}
+
+// TriggerJob adds the task of the job to the queue now, even if the job is paused or this instance isn't the leader.
+// It doesn't affect the schedule.
+func (c *Cron) TriggerJob(key string) error {
+	job := c.findJob(key)
+	if job == nil {
+		return ErrJobNotFound
+	}
+	c.log.WithField("job", key).Infof("Cron.TriggerJob: The job '%s' has been triggered manually", key)
+	job.fn()
+	return nil
+}
+
+func (c *Cron) findJob(key string) *trackedJob {
+	for _, entry := range c.Entries() {
+		if job, ok := entry.Job.(*trackedJob); ok && job.key == key {
+			return job
+		}
+	}
+	return nil
+}
+
+func (c *Cron) isPaused(key string) bool {
+	if c.redis == nil {
+		c.pausedMu.Lock()
+		defer c.pausedMu.Unlock()
+		return c.paused[key]
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	paused, err := c.redis.SIsMember(ctx, pausedJobsKey, key).Result()
+	if err != nil {
+		// Redis is unavailable, don't skip the job because of that
+		c.log.WithField("job", key).Warn(errors.Wrapf(err, "Cron.isPaused: Couldn't check whether the job '%s' is paused", key))
+		return false
+	}
+	return paused
+}
+
+func (c *Cron) loadPausedJobs(ctx context.Context) (map[string]bool, error) {
+	keys, err := c.redis.SMembers(ctx, pausedJobsKey).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't load the paused jobs")
+	}
+	paused := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		paused[key] = true
+	}
+	return paused, nil
+}
+
+func (c *Cron) pausedJobsInMemory() map[string]bool {
+	c.pausedMu.Lock()
+	defer c.pausedMu.Unlock()
+	paused := make(map[string]bool, len(c.paused))
+	for key := range c.paused {
+		paused[key] = true
+	}
+	return paused
+}
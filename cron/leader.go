@@ -0,0 +1,208 @@
+package cron
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultLeaderKey      = "twhelp:cron:leader"
+	defaultLeaderLeaseTTL = 15 * time.Second
+	// leaseSafetyMarginDivisor defines the part of the ttl by which the leader steps down before its lease expires,
+	// it covers the clock drift between the instances and Redis
+	leaseSafetyMarginDivisor = 5
+)
+
+var (
+	renewLeaseScript = redis.NewScript(`
+		if redis.call("get", KEYS[1]) == ARGV[1] then
+			return redis.call("pexpire", KEYS[1], ARGV[2])
+		end
+		return 0
+	`)
+	releaseLeaseScript = redis.NewScript(`
+		if redis.call("get", KEYS[1]) == ARGV[1] then
+			return redis.call("del", KEYS[1])
+		end
+		return 0
+	`)
+)
+
+// leaderElector holds a lease in Redis. Only the instance that holds the lease fires the jobs,
+// the others try to acquire it every ttl/3, so they take over at most ttl after the leader dies.
+//
+// The leader considers its lease valid until ttl - ttl/leaseSafetyMarginDivisor after it sent the last successful
+// acquire/renew request. Redis starts counting the ttl later, when it receives the request,
+// so the leader stops firing the jobs before any other instance can acquire the lease, even if the renewals fail.
+type leaderElector struct {
+	redis    redis.UniversalClient
+	key      string
+	id       string
+	ttl      time.Duration
+	isLeader int32
+	// validUntil is the end of the lease in Unix nanoseconds as seen by this instance
+	validUntil int64
+	log        logrus.FieldLogger
+	now        func() time.Time
+
+	// onElected is called every time this instance becomes the leader
+	onElected func()
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newLeaderElector(client redis.UniversalClient, id string, ttl time.Duration, log logrus.FieldLogger) *leaderElector {
+	if id == "" {
+		id = defaultInstanceID()
+	}
+	if ttl <= 0 {
+		ttl = defaultLeaderLeaseTTL
+	}
+	return &leaderElector{
+		redis: client,
+		key:   defaultLeaderKey,
+		id:    id,
+		ttl:   ttl,
+		log:   log.WithField("instance", id),
+		now:   time.Now,
+	}
+}
+
+func defaultInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), rand.New(rand.NewSource(time.Now().UnixNano())).Int63())
+}
+
+// start makes the first attempt to acquire the lease synchronously and then keeps it in the background.
+func (e *leaderElector) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	e.cancel = cancel
+	e.tick(ctx)
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		ticker := time.NewTicker(e.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				e.tick(ctx)
+			}
+		}
+	}()
+}
+
+func (e *leaderElector) stop() {
+	if e.cancel == nil {
+		return
+	}
+	e.cancel()
+	e.wg.Wait()
+	if !e.holdsLease() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := releaseLeaseScript.Run(ctx, e.redis, []string{e.key}, e.id).Err(); err != nil {
+		e.log.Warn(errors.Wrap(err, "leaderElector.stop: Couldn't release the lease"))
+	}
+	e.setLeader(false)
+}
+
+func (e *leaderElector) tick(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, e.ttl/3)
+	defer cancel()
+
+	// the timestamp is taken before the request, Redis starts counting the ttl after receiving it
+	sentAt := e.now()
+	if e.holdsLease() {
+		renewed, err := renewLeaseScript.Run(ctx, e.redis, []string{e.key}, e.id, e.ttl.Milliseconds()).Int()
+		if err != nil {
+			e.log.Warn(errors.Wrap(err, "leaderElector.tick: Couldn't renew the lease"))
+			// the lease may still be valid, give up leadership only when it may have expired
+			if !e.leaseValid() {
+				e.setLeader(false)
+			}
+			return
+		}
+		if renewed == 0 {
+			e.setLeader(false)
+			return
+		}
+		e.extendLease(sentAt)
+		return
+	}
+
+	acquired, err := e.redis.SetNX(ctx, e.key, e.id, e.ttl).Result()
+	if err != nil {
+		e.log.Warn(errors.Wrap(err, "leaderElector.tick: Couldn't acquire the lease"))
+		return
+	}
+	if acquired {
+		e.extendLease(sentAt)
+		e.setLeader(true)
+	}
+}
+
+func (e *leaderElector) extendLease(sentAt time.Time) {
+	validUntil := sentAt.Add(e.ttl - e.ttl/leaseSafetyMarginDivisor)
+	atomic.StoreInt64(&e.validUntil, validUntil.UnixNano())
+}
+
+// leaseValid reports whether the lease acquired or renewed by this instance certainly hasn't expired yet.
+func (e *leaderElector) leaseValid() bool {
+	return e.now().UnixNano() < atomic.LoadInt64(&e.validUntil)
+}
+
+func (e *leaderElector) setLeader(isLeader bool) {
+	var v int32
+	if isLeader {
+		v = 1
+	}
+	if atomic.SwapInt32(&e.isLeader, v) == v {
+		return
+	}
+	if isLeader {
+		e.log.Infof("leaderElector: %s has become the leader", e.id)
+		if e.onElected != nil {
+			e.onElected()
+		}
+	} else {
+		e.log.Infof("leaderElector: %s is no longer the leader", e.id)
+	}
+}
+
+// holdsLease reports whether this instance has acquired the lease and hasn't stepped down yet,
+// the lease may have expired in the meantime.
+func (e *leaderElector) holdsLease() bool {
+	return atomic.LoadInt32(&e.isLeader) == 1
+}
+
+// IsLeader reports whether this instance holds the lease. It returns false as soon as the lease may have expired,
+// even if the next tick, which steps down, hasn't happened yet.
+func (e *leaderElector) IsLeader() bool {
+	return e.holdsLease() && e.leaseValid()
+}
+
+// leader returns the id of the instance that currently holds the lease or an empty string if nobody holds it.
+func (e *leaderElector) leader(ctx context.Context) (string, error) {
+	id, err := e.redis.Get(ctx, e.key).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return id, err
+}
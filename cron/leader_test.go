@@ -0,0 +1,132 @@
+package cron
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+const testLeaseTTL = 15 * time.Second
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, redis.UniversalClient) {
+	t.Helper()
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := redis.NewClient(&redis.Options{
+		Addr:       mr.Addr(),
+		MaxRetries: -1,
+	})
+	t.Cleanup(func() {
+		_ = client.Close()
+		mr.Close()
+	})
+	return mr, client
+}
+
+func newTestLeaderElector(client redis.UniversalClient, id string, clock *fakeClock) *leaderElector {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	e := newLeaderElector(client, id, testLeaseTTL, log)
+	e.now = clock.now
+	return e
+}
+
+func TestLeaderElector(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("renew failure", func(t *testing.T) {
+		mr, client := newTestRedis(t)
+		clock := &fakeClock{time.Now()}
+		a := newTestLeaderElector(client, "a", clock)
+		b := newTestLeaderElector(client, "b", clock)
+
+		a.tick(ctx)
+		if !a.IsLeader() {
+			t.Fatal("expected a to be the leader")
+		}
+
+		mr.SetError("ERR connection lost")
+		clock.advance(testLeaseTTL / 3)
+		a.tick(ctx)
+		if !a.IsLeader() {
+			t.Fatal("expected a to stay the leader, its lease is still valid")
+		}
+
+		// the lease ends ttl - ttl/5 after the last successful renewal, a steps down even before its next tick
+		clock.advance(testLeaseTTL - testLeaseTTL/leaseSafetyMarginDivisor - testLeaseTTL/3)
+		if a.IsLeader() {
+			t.Fatal("expected a to step down when its lease may have expired")
+		}
+		a.tick(ctx)
+		if a.holdsLease() {
+			t.Fatal("expected a to give up the lease after the failed renewal")
+		}
+
+		// nobody can take over before the lease expires in Redis
+		mr.SetError("")
+		mr.FastForward(testLeaseTTL - testLeaseTTL/leaseSafetyMarginDivisor)
+		b.tick(ctx)
+		if b.IsLeader() {
+			t.Fatal("expected b not to acquire the lease before it expires")
+		}
+		mr.FastForward(testLeaseTTL / leaseSafetyMarginDivisor)
+		b.tick(ctx)
+		if !b.IsLeader() {
+			t.Fatal("expected b to take over after the lease expired")
+		}
+	})
+
+	t.Run("takeover", func(t *testing.T) {
+		mr, client := newTestRedis(t)
+		clock := &fakeClock{time.Now()}
+		a := newTestLeaderElector(client, "a", clock)
+		b := newTestLeaderElector(client, "b", clock)
+
+		a.tick(ctx)
+		b.tick(ctx)
+		if !a.IsLeader() || b.IsLeader() {
+			t.Fatal("expected only a to be the leader")
+		}
+		if leader, err := b.leader(ctx); err != nil || leader != "a" {
+			t.Fatalf("expected the leader a, got %s (%v)", leader, err)
+		}
+
+		// a hasn't renewed its lease in time (e.g. it has been paused)
+		clock.advance(testLeaseTTL)
+		mr.FastForward(testLeaseTTL)
+		b.tick(ctx)
+		if !b.IsLeader() {
+			t.Fatal("expected b to take over")
+		}
+		if a.IsLeader() {
+			t.Fatal("expected a not to be the leader, its lease has expired")
+		}
+
+		a.tick(ctx)
+		if a.holdsLease() {
+			t.Fatal("expected a to step down after the renewal has been refused")
+		}
+		if leader, err := a.leader(ctx); err != nil || leader != "b" {
+			t.Fatalf("expected the leader b, got %s (%v)", leader, err)
+		}
+	})
+}
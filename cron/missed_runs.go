@@ -0,0 +1,147 @@
+package cron
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"strconv"
+	"time"
+)
+
+const (
+	lastRunsKey = "twhelp:cron:last_runs"
+	// minCatchUpInterval is the min interval of a job that is run after being missed
+	minCatchUpInterval = 24 * time.Hour
+)
+
+// trackedJob stores the time of its last run in Redis, so the runs missed during a downtime can be detected.
+// A paused job doesn't add the task, but its run is still saved, so it isn't treated as missed after resuming.
+type trackedJob struct {
+	c *Cron
+	// key is the task name, followed by the timezone for the timezone jobs, e.g. updateHistory:Europe/Warsaw
+	key      string
+	taskName string
+	timezone string
+	spec     string
+	fn       func()
+}
+
+func (c *Cron) newTrackedJob(taskName, timezone, spec string, fn func()) *trackedJob {
+	key := taskName
+	if timezone != "" {
+		key += ":" + timezone
+	}
+	return &trackedJob{
+		c:        c,
+		key:      key,
+		taskName: taskName,
+		timezone: timezone,
+		spec:     spec,
+		fn:       fn,
+	}
+}
+
+func (j *trackedJob) Run() {
+	if !j.c.IsLeader() {
+		return
+	}
+	if j.c.isPaused(j.key) {
+		j.c.log.WithField("job", j.key).Debugf("trackedJob.Run: The job '%s' is paused, skipping", j.key)
+	} else {
+		// checked again, the lease may have expired while loading the paused jobs
+		if !j.c.IsLeader() {
+			return
+		}
+		j.fn()
+	}
+	if j.c.redis == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := j.c.redis.HSet(ctx, lastRunsKey, j.key, time.Now().Unix()).Err(); err != nil {
+		j.c.log.
+			WithField("job", j.key).
+			Warn(errors.Wrapf(err, "trackedJob.Run: Couldn't save the time of the last run of the job '%s'", j.key))
+	}
+}
+
+func (c *Cron) loadLastRuns(ctx context.Context) (map[string]time.Time, error) {
+	result, err := c.redis.HGetAll(ctx, lastRunsKey).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrap(err, "couldn't load the last runs")
+	}
+	lastRuns := make(map[string]time.Time, len(result))
+	for key, val := range result {
+		unix, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			continue
+		}
+		lastRuns[key] = time.Unix(unix, 0)
+	}
+	return lastRuns, nil
+}
+
+// runMissedJobs runs once every job that should have run within the last c.missedRunsWindow, but didn't.
+// The jobs that have never run (e.g. on the first deploy) aren't treated as missed,
+// neither are the jobs that run more often than once per minCatchUpInterval, their next run is close anyway.
+func (c *Cron) runMissedJobs() {
+	if c.missedRunsWindow <= 0 || c.redis == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	lastRuns, err := c.loadLastRuns(ctx)
+	if err != nil {
+		c.log.Error(errors.Wrap(err, "Cron.runMissedJobs"))
+		return
+	}
+
+	now := time.Now()
+	windowStart := now.Add(-c.missedRunsWindow)
+	for _, entry := range c.Entries() {
+		job, ok := entry.Job.(*trackedJob)
+		if !ok {
+			continue
+		}
+		entryLog := c.log.WithField("job", job.key)
+		lastRun, ok := lastRuns[job.key]
+		if !ok {
+			entryLog.Debugf("Cron.runMissedJobs: The job '%s' has never run, skipping", job.key)
+			continue
+		}
+		next := entry.Schedule.Next(now)
+		if interval := entry.Schedule.Next(next).Sub(next); interval < minCatchUpInterval {
+			entryLog.Debugf("Cron.runMissedJobs: The job '%s' runs every %s, skipping", job.key, interval)
+			continue
+		}
+		from := windowStart
+		if lastRun.After(from) {
+			from = lastRun
+		}
+		missedRun := entry.Schedule.Next(from)
+		if missedRun.After(now) {
+			continue
+		}
+		entryLog.Infof("Cron.runMissedJobs: The job '%s' missed its run at %s, running it now", job.key, missedRun.Format(time.RFC3339))
+		entry.WrappedJob.Run()
+	}
+}
+
+// catchUpLoop runs the missed jobs every time this instance becomes the leader,
+// outside of the leader election, so a slow catch-up doesn't delay the renewal of the lease.
+func (c *Cron) catchUpLoop() {
+	defer close(c.catchUpDone)
+	for range c.catchUp {
+		c.runMissedJobs()
+	}
+}
+
+// requestCatchUp schedules runMissedJobs, it doesn't block.
+// A request made while the previous one is pending is dropped, the pending one covers it.
+func (c *Cron) requestCatchUp() {
+	select {
+	case c.catchUp <- struct{}{}:
+	default:
+	}
+}
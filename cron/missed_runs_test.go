@@ -0,0 +1,90 @@
+package cron
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-redis/redis/v8"
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+
+	"github.com/tribalwarshelp/dataupdater/queue"
+)
+
+// newTestCron returns a cron without the database and the queue, the jobs are added by the tests.
+func newTestCron(client redis.UniversalClient) *Cron {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	return &Cron{
+		Cron:   cron.New(),
+		redis:  client,
+		log:    log,
+		paused: make(map[string]bool),
+	}
+}
+
+func TestRunMissedJobs(t *testing.T) {
+	_, client := newTestRedis(t)
+	c := newTestCron(client)
+	c.missedRunsWindow = 48 * time.Hour
+
+	runs := make(map[string]int)
+	addJob := func(key, spec string, lastRun time.Time) {
+		if _, err := c.AddJob(spec, c.newTrackedJob(key, "", spec, func() {
+			runs[key]++
+		})); err != nil {
+			t.Fatal(err)
+		}
+		if lastRun.IsZero() {
+			return
+		}
+		if err := client.HSet(context.Background(), lastRunsKey, key, lastRun.Unix()).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	addJob("missed", "30 1 * * *", now.Add(-47*time.Hour))
+	addJob("notMissed", "30 1 * * *", now.Add(-time.Minute))
+	// yearly, 6 months from now
+	addJob("missedBeforeWindow", fmt.Sprintf("0 0 1 %d *", (int(now.Month())+5)%12+1), now.Add(-400*24*time.Hour))
+	addJob("neverRun", "30 1 * * *", time.Time{})
+	addJob("subDaily", "@every 1m", now.Add(-time.Hour))
+
+	c.runMissedJobs()
+
+	expected := map[string]int{
+		"missed": 1,
+	}
+	for _, key := range []string{"missed", "notMissed", "missedBeforeWindow", "neverRun", "subDaily"} {
+		if runs[key] != expected[key] {
+			t.Errorf("%s: expected %d runs, got %d", key, expected[key], runs[key])
+		}
+	}
+
+	lastRun, err := client.HGet(context.Background(), lastRunsKey, "missed").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unix, _ := strconv.ParseInt(lastRun, 10, 64); now.Unix()-unix > 60 {
+		t.Errorf("expected the last run of the missed job to be saved, got %s", lastRun)
+	}
+}
+
+func TestValidateConfigMissedRunsWindowWithoutRedis(t *testing.T) {
+	db := pg.Connect(&pg.Options{})
+	defer db.Close()
+	err := validateConfig(&Config{
+		DB:               db,
+		Queue:            &queue.Queue{},
+		MissedRunsWindow: time.Hour,
+	})
+	if err == nil || !strings.Contains(err.Error(), "cfg.Redis") {
+		t.Fatalf("expected the missing Redis to be reported, got %v", err)
+	}
+}
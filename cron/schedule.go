@@ -0,0 +1,135 @@
+package cron
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+
+	"github.com/tribalwarshelp/dataupdater/queue"
+)
+
+// Job describes when the given task should be added to the queue.
+type Job struct {
+	Spec    string `json:"spec"`
+	Enabled *bool  `json:"enabled,omitempty"`
+	// Versions overrides Spec for the given version codes.
+	// Only supported by the jobs scheduled per timezone (updateHistory, updateStats).
+	Versions map[twmodel.VersionCode]string `json:"versions,omitempty"`
+}
+
+func (j *Job) IsEnabled() bool {
+	return j != nil && (j.Enabled == nil || *j.Enabled)
+}
+
+// Schedule maps a task name from the queue package to its Job.
+type Schedule map[string]*Job
+
+func DefaultSchedule() Schedule {
+	return Schedule{
+		queue.LoadVersionsAndUpdateServerData: {Spec: "0 * * * *"},
+		queue.Vacuum:                          {Spec: "20 1 * * *"},
+		queue.DeleteNonExistentVillages:       {Spec: "10 1 * * *"},
+		queue.UpdateEnnoblements:              {Spec: "@every 1m"},
+		queue.UpdateHistory:                   {Spec: "30 1 * * *"},
+		queue.UpdateStats:                     {Spec: "45 1 * * *"},
+	}
+}
+
+var timezoneJobs = map[string]bool{
+	queue.UpdateHistory: true,
+	queue.UpdateStats:   true,
+}
+
+// LoadSchedule reads the JSON file located at the given path and merges it with DefaultSchedule.
+// An empty spec in the file keeps the default one, so {"vacuum": {"enabled": false}} is enough to disable a job.
+func LoadSchedule(path string) (Schedule, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't read the schedule file")
+	}
+	var fromFile Schedule
+	if err := json.Unmarshal(b, &fromFile); err != nil {
+		return nil, errors.Wrapf(err, "couldn't decode the schedule file '%s'", path)
+	}
+	schedule := DefaultSchedule()
+	for taskName, job := range fromFile {
+		if job == nil {
+			continue
+		}
+		if defaultJob, ok := schedule[taskName]; ok && job.Spec == "" {
+			job.Spec = defaultJob.Spec
+		}
+		schedule[taskName] = job
+	}
+	if err := schedule.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "schedule file '%s' is invalid", path)
+	}
+	return schedule, nil
+}
+
+// Validate checks that every job refers to a schedulable task and has a parsable spec.
+func (s Schedule) Validate() error {
+	defaultSchedule := DefaultSchedule()
+	for _, taskName := range s.taskNames() {
+		job := s[taskName]
+		if _, ok := defaultSchedule[taskName]; !ok {
+			return errors.Errorf("job '%s': unknown task, expected one of %v", taskName, defaultSchedule.taskNames())
+		}
+		if job == nil {
+			return errors.Errorf("job '%s': job is nil", taskName)
+		}
+		if _, err := cron.ParseStandard(job.Spec); err != nil {
+			return errors.Wrapf(err, "job '%s': invalid spec '%s'", taskName, job.Spec)
+		}
+		if len(job.Versions) > 0 && !timezoneJobs[taskName] {
+			return errors.Errorf("job '%s': per-version overrides are only supported by the jobs scheduled per timezone", taskName)
+		}
+		for code, spec := range job.Versions {
+			if _, err := cron.ParseStandard(spec); err != nil {
+				return errors.Wrapf(err, "job '%s': version '%s': invalid spec '%s'", taskName, code, spec)
+			}
+		}
+	}
+	return nil
+}
+
+// specsByTimezone returns the spec for each timezone used by the given versions.
+// Versions sharing a timezone must resolve to the same spec.
+func (s Schedule) specsByTimezone(taskName string, versions []*twmodel.Version) (map[string]string, error) {
+	job := s[taskName]
+	specs := make(map[string]string)
+	owners := make(map[string]twmodel.VersionCode)
+	for _, version := range versions {
+		spec := job.Spec
+		if override, ok := job.Versions[version.Code]; ok {
+			spec = override
+		}
+		if current, ok := specs[version.Timezone]; ok && current != spec {
+			return nil, errors.Errorf(
+				"job '%s': versions '%s' and '%s' share the timezone '%s' but have different specs ('%s' and '%s')",
+				taskName,
+				owners[version.Timezone],
+				version.Code,
+				version.Timezone,
+				current,
+				spec,
+			)
+		}
+		specs[version.Timezone] = spec
+		owners[version.Timezone] = version.Code
+	}
+	return specs, nil
+}
+
+func (s Schedule) taskNames() []string {
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,135 @@
+package cron
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+
+	"github.com/tribalwarshelp/dataupdater/queue"
+)
+
+func TestLoadSchedule(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schedule.json")
+	if err := ioutil.WriteFile(path, []byte(`{
+		"vacuum": {"enabled": false},
+		"updateEnnoblements": {"spec": "@every 5m"},
+		"updateHistory": {"versions": {"pl": "0 2 * * *"}}
+	}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	schedule, err := LoadSchedule(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schedule[queue.Vacuum].IsEnabled() {
+		t.Error("expected vacuum to be disabled")
+	}
+	if spec := schedule[queue.Vacuum].Spec; spec != DefaultSchedule()[queue.Vacuum].Spec {
+		t.Errorf("expected the default spec of vacuum to be kept, got '%s'", spec)
+	}
+	if spec := schedule[queue.UpdateEnnoblements].Spec; spec != "@every 5m" {
+		t.Errorf("expected the spec of updateEnnoblements to be overridden, got '%s'", spec)
+	}
+	if spec := schedule[queue.UpdateHistory].Versions["pl"]; spec != "0 2 * * *" {
+		t.Errorf("expected the spec of updateHistory to be overridden for pl, got '%s'", spec)
+	}
+	if !schedule[queue.UpdateStats].IsEnabled() {
+		t.Error("expected updateStats to be kept")
+	}
+}
+
+func TestScheduleValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule Schedule
+		err      string
+	}{
+		{
+			name:     "default",
+			schedule: DefaultSchedule(),
+		},
+		{
+			name:     "unknown task",
+			schedule: Schedule{"unknown": {Spec: "@every 1m"}},
+			err:      "unknown task",
+		},
+		{
+			name:     "nil job",
+			schedule: Schedule{queue.Vacuum: nil},
+			err:      "job is nil",
+		},
+		{
+			name:     "invalid spec",
+			schedule: Schedule{queue.Vacuum: {Spec: "invalid"}},
+			err:      "invalid spec",
+		},
+		{
+			name: "versions of a job that isn't scheduled per timezone",
+			schedule: Schedule{queue.Vacuum: {
+				Spec:     "20 1 * * *",
+				Versions: map[twmodel.VersionCode]string{"pl": "0 2 * * *"},
+			}},
+			err: "per-version overrides",
+		},
+		{
+			name: "invalid spec of a version",
+			schedule: Schedule{queue.UpdateHistory: {
+				Spec:     "30 1 * * *",
+				Versions: map[twmodel.VersionCode]string{"pl": "invalid"},
+			}},
+			err: "version 'pl'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.schedule.Validate()
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("expected no error, got %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected an error containing '%s', got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestSpecsByTimezone(t *testing.T) {
+	schedule := Schedule{
+		queue.UpdateHistory: {
+			Spec:     "30 1 * * *",
+			Versions: map[twmodel.VersionCode]string{"pl": "0 2 * * *"},
+		},
+	}
+
+	specs, err := schedule.specsByTimezone(queue.UpdateHistory, []*twmodel.Version{
+		{Code: "pl", Timezone: "Europe/Warsaw"},
+		{Code: "uk", Timezone: "Europe/London"},
+		{Code: "en", Timezone: "Europe/London"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"Europe/Warsaw": "0 2 * * *",
+		"Europe/London": "30 1 * * *",
+	}
+	if !reflect.DeepEqual(specs, expected) {
+		t.Errorf("expected %v, got %v", expected, specs)
+	}
+
+	_, err = schedule.specsByTimezone(queue.UpdateHistory, []*twmodel.Version{
+		{Code: "pl", Timezone: "Europe/Warsaw"},
+		{Code: "cs", Timezone: "Europe/Warsaw"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "share the timezone 'Europe/Warsaw'") {
+		t.Errorf("expected the versions sharing a timezone with different specs to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package cron
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+
+	"github.com/tribalwarshelp/dataupdater/queue"
+)
+
+type timezoneEntry struct {
+	id   cron.EntryID
+	spec string
+}
+
+func (c *Cron) loadVersions() ([]*twmodel.Version, error) {
+	var versions []*twmodel.Version
+	if err := c.db.Model(&versions).Order("code ASC").Select(); err != nil {
+		return nil, errors.Wrap(err, "couldn't load versions")
+	}
+	return versions, nil
+}
+
+func (c *Cron) timezoneJobs() map[string]func(timezone string) {
+	return map[string]func(timezone string){
+		queue.UpdateHistory: c.updateHistory,
+		queue.UpdateStats:   c.updateStats,
+	}
+}
+
+// syncTimezoneJobs adds the entries for the timezones that aren't scheduled yet
+// and removes the entries for the timezones that are no longer used (or whose spec has changed),
+// so each timezone has at most one entry per job.
+func (c *Cron) syncTimezoneJobs(versions []*twmodel.Version) error {
+	c.timezoneEntriesMu.Lock()
+	defer c.timezoneEntriesMu.Unlock()
+
+	for taskName, fn := range c.timezoneJobs() {
+		if !c.schedule[taskName].IsEnabled() {
+			continue
+		}
+		specs, err := c.schedule.specsByTimezone(taskName, versions)
+		if err != nil {
+			return err
+		}
+		entries, ok := c.timezoneEntries[taskName]
+		if !ok {
+			entries = make(map[string]timezoneEntry)
+			c.timezoneEntries[taskName] = entries
+		}
+
+		for timezone, entry := range entries {
+			if spec, ok := specs[timezone]; ok && spec == entry.spec {
+				continue
+			}
+			c.Remove(entry.id)
+			delete(entries, timezone)
+			c.log.
+				WithField("task", taskName).
+				WithField("timezone", timezone).
+				Infof("Cron.syncTimezoneJobs: The job '%s' has been unscheduled for the timezone '%s'", taskName, timezone)
+		}
+
+		for timezone, spec := range specs {
+			if _, ok := entries[timezone]; ok {
+				continue
+			}
+			fullSpec := fmt.Sprintf("CRON_TZ=%s %s", timezone, spec)
+			id, err := c.AddJob(
+				fullSpec,
+				c.newTrackedJob(taskName, timezone, fullSpec, createFnWithTimezone(timezone, fn)),
+			)
+			if err != nil {
+				return errors.Wrapf(err, "couldn't schedule the job '%s' for the timezone '%s'", taskName, timezone)
+			}
+			entries[timezone] = timezoneEntry{
+				id:   id,
+				spec: spec,
+			}
+			c.log.
+				WithField("task", taskName).
+				WithField("timezone", timezone).
+				Infof("Cron.syncTimezoneJobs: The job '%s' has been scheduled for the timezone '%s' (%s)", taskName, timezone, spec)
+		}
+	}
+
+	return nil
+}
+
+func (c *Cron) reconcileTimezoneJobs() {
+	versions, err := c.loadVersions()
+	if err == nil {
+		err = c.syncTimezoneJobs(versions)
+	}
+	if err != nil {
+		c.log.Error(errors.Wrap(err, "Cron.reconcileTimezoneJobs: Couldn't reconcile the timezone jobs"))
+	}
+}
+
+func (c *Cron) scheduledTimezones(taskName string) []string {
+	c.timezoneEntriesMu.Lock()
+	defer c.timezoneEntriesMu.Unlock()
+
+	var timezones []string
+	for timezone := range c.timezoneEntries[taskName] {
+		timezones = append(timezones, timezone)
+	}
+	sort.Strings(timezones)
+	return timezones
+}
@@ -0,0 +1,68 @@
+package cron
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+
+	"github.com/tribalwarshelp/dataupdater/queue"
+)
+
+func TestSyncTimezoneJobs(t *testing.T) {
+	c := newTestCron(nil)
+	c.schedule = DefaultSchedule()
+	c.timezoneEntries = make(map[string]map[string]timezoneEntry)
+
+	sync := func(versions ...*twmodel.Version) {
+		t.Helper()
+		if err := c.syncTimezoneJobs(versions); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectTimezones := func(expected ...string) {
+		t.Helper()
+		for _, taskName := range []string{queue.UpdateHistory, queue.UpdateStats} {
+			if timezones := c.scheduledTimezones(taskName); !reflect.DeepEqual(timezones, expected) {
+				t.Errorf("%s: expected %v, got %v", taskName, expected, timezones)
+			}
+		}
+		if n := len(c.Entries()); n != 2*len(expected) {
+			t.Errorf("expected %d entries, got %d", 2*len(expected), n)
+		}
+	}
+
+	sync(
+		&twmodel.Version{Code: "pl", Timezone: "Europe/Warsaw"},
+		&twmodel.Version{Code: "uk", Timezone: "Europe/London"},
+		&twmodel.Version{Code: "en", Timezone: "Europe/London"},
+	)
+	expectTimezones("Europe/London", "Europe/Warsaw")
+
+	// no changes
+	sync(
+		&twmodel.Version{Code: "pl", Timezone: "Europe/Warsaw"},
+		&twmodel.Version{Code: "uk", Timezone: "Europe/London"},
+	)
+	expectTimezones("Europe/London", "Europe/Warsaw")
+
+	sync(
+		&twmodel.Version{Code: "pl", Timezone: "Europe/Warsaw"},
+		&twmodel.Version{Code: "us", Timezone: "America/New_York"},
+	)
+	expectTimezones("America/New_York", "Europe/Warsaw")
+
+	// a changed spec replaces the entry
+	c.schedule[queue.UpdateHistory] = &Job{Spec: "0 3 * * *"}
+	sync(
+		&twmodel.Version{Code: "pl", Timezone: "Europe/Warsaw"},
+		&twmodel.Version{Code: "us", Timezone: "America/New_York"},
+	)
+	expectTimezones("America/New_York", "Europe/Warsaw")
+	for _, entry := range c.Entries() {
+		job := entry.Job.(*trackedJob)
+		if job.taskName == queue.UpdateHistory && job.spec != "CRON_TZ="+job.timezone+" 0 3 * * *" {
+			t.Errorf("expected the spec of %s to be updated, got '%s'", job.key, job.spec)
+		}
+	}
+}
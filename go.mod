@@ -6,13 +6,23 @@ require (
 	github.com/Kichiyaki/appmode v0.0.0-20210502105643-0a26207c548d
 	github.com/Kichiyaki/go-pg-logrus-query-logger/v10 v10.0.0-20210502060056-ad595ba7b858
 	github.com/Kichiyaki/goutil v0.0.0-20210504132659-3d843a787db7
+	github.com/alicebob/miniredis/v2 v2.14.5
+	github.com/bsm/redislock v0.7.0
 	github.com/go-pg/pg/v10 v10.10.2
 	github.com/go-redis/redis/v8 v8.11.0
-	github.com/go-redis/redis_rate/v9 v9.1.1 // indirect
+	github.com/go-redis/redis_rate/v9 v9.1.1
 	github.com/joho/godotenv v1.3.0
+	github.com/minio/minio-go/v7 v7.0.12
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.11.0
 	github.com/robfig/cron/v3 v3.0.1
 	github.com/sirupsen/logrus v1.8.1
 	github.com/tribalwarshelp/shared v0.0.0-20210717094429-6efa1a4f614c
+	github.com/vmihailenco/msgpack/v5 v5.3.1
 	github.com/vmihailenco/taskq/v3 v3.2.4
+	go.opentelemetry.io/otel v1.7.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.7.0
+	go.opentelemetry.io/otel/sdk v1.7.0
+	go.opentelemetry.io/otel/trace v1.7.0
+	golang.org/x/sync v0.2.0
 )
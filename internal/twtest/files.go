@@ -0,0 +1,233 @@
+package twtest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/url"
+	"sort"
+)
+
+const (
+	serverConfig = `<?xml version="1.0" encoding="UTF-8" ?>
+<config>
+	<speed>1</speed>
+	<unit_speed>1</unit_speed>
+	<moral>1</moral>
+	<game>
+		<barbarian_rise>0.003</barbarian_rise>
+		<barbarian_max_points>2000</barbarian_max_points>
+	</game>
+	<ally>
+		<limit>15</limit>
+	</ally>
+</config>`
+	buildingConfig = `<?xml version="1.0" encoding="UTF-8" ?>
+<config>
+	<main>
+		<max_level>30</max_level>
+		<min_level>1</min_level>
+	</main>
+</config>`
+	unitConfig = `<?xml version="1.0" encoding="UTF-8" ?>
+<config>
+	<spear>
+		<build_time>1020</build_time>
+		<pop>1</pop>
+		<speed>18</speed>
+		<attack>10</attack>
+		<defense>15</defense>
+	</spear>
+</config>`
+)
+
+// files holds the content of the world published by the last tick.
+type files struct {
+	static   map[string][]byte
+	conquers []Conquer
+}
+
+type odEntry struct {
+	id    int
+	score int
+}
+
+// render builds the files served by the game: /map/*.txt, /map/*.txt.gz and the configs.
+func (w *World) render() *files {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	playerPoints := make(map[int]int)
+	playerVillages := make(map[int]int)
+	villageIDs := make([]int, 0, len(w.villages))
+	for id, v := range w.villages {
+		villageIDs = append(villageIDs, id)
+		if v.PlayerID == 0 {
+			continue
+		}
+		playerPoints[v.PlayerID] += v.Points
+		playerVillages[v.PlayerID]++
+	}
+	sort.Ints(villageIDs)
+
+	playerIDs := make([]int, 0, len(w.players))
+	tribeMembers := make(map[int]int)
+	tribePoints := make(map[int]int)
+	tribeVillages := make(map[int]int)
+	for id, p := range w.players {
+		playerIDs = append(playerIDs, id)
+		if _, ok := w.tribes[p.TribeID]; ok {
+			tribeMembers[p.TribeID]++
+			tribePoints[p.TribeID] += playerPoints[id]
+			tribeVillages[p.TribeID] += playerVillages[id]
+		}
+	}
+	sortByScore(playerIDs, playerPoints)
+
+	tribeIDs := make([]int, 0, len(w.tribes))
+	for id := range w.tribes {
+		tribeIDs = append(tribeIDs, id)
+	}
+	sortByScore(tribeIDs, tribePoints)
+
+	static := make(map[string][]byte)
+
+	buf := &bytes.Buffer{}
+	for i, id := range playerIDs {
+		p := w.players[id]
+		tribeID := p.TribeID
+		if _, ok := w.tribes[tribeID]; !ok {
+			tribeID = 0
+		}
+		fmt.Fprintf(buf, "%d,%s,%d,%d,%d,%d\n", id, url.QueryEscape(p.Name), tribeID, playerVillages[id], playerPoints[id], i+1)
+	}
+	static["/map/player.txt"] = buf.Bytes()
+
+	buf = &bytes.Buffer{}
+	for i, id := range tribeIDs {
+		t := w.tribes[id]
+		fmt.Fprintf(
+			buf,
+			"%d,%s,%s,%d,%d,%d,%d,%d\n",
+			id,
+			url.QueryEscape(t.Name),
+			url.QueryEscape(t.Tag),
+			tribeMembers[id],
+			tribeVillages[id],
+			tribePoints[id],
+			tribePoints[id],
+			i+1,
+		)
+	}
+	static["/map/ally.txt"] = buf.Bytes()
+
+	buf = &bytes.Buffer{}
+	for _, id := range villageIDs {
+		v := w.villages[id]
+		fmt.Fprintf(buf, "%d,%s,%d,%d,%d,%d,%d\n", id, url.QueryEscape(v.Name), v.X, v.Y, v.PlayerID, v.Points, v.Bonus)
+	}
+	static["/map/village.txt"] = buf.Bytes()
+
+	playerOD := func(score func(od OD) int) []byte {
+		entries := make([]odEntry, 0, len(w.players))
+		for id, p := range w.players {
+			entries = append(entries, odEntry{id, score(p.OD)})
+		}
+		return renderOD(entries)
+	}
+	static["/map/kill_att.txt"] = playerOD(func(od OD) int { return od.Att })
+	static["/map/kill_def.txt"] = playerOD(func(od OD) int { return od.Def })
+	static["/map/kill_sup.txt"] = playerOD(func(od OD) int { return od.Sup })
+	static["/map/kill_all.txt"] = playerOD(OD.total)
+
+	tribeOD := func(score func(od OD) int) []byte {
+		entries := make([]odEntry, 0, len(w.tribes))
+		for id, t := range w.tribes {
+			entries = append(entries, odEntry{id, score(t.OD)})
+		}
+		return renderOD(entries)
+	}
+	static["/map/kill_att_tribe.txt"] = tribeOD(func(od OD) int { return od.Att })
+	static["/map/kill_def_tribe.txt"] = tribeOD(func(od OD) int { return od.Def })
+	static["/map/kill_all_tribe.txt"] = tribeOD(OD.total)
+
+	conquers := make([]Conquer, len(w.conquers))
+	copy(conquers, w.conquers)
+	static["/map/conquer.txt"] = renderConquers(conquers, 0, false)
+
+	for name, data := range static {
+		static[name+".gz"] = gzipBytes(data)
+	}
+	static["/interface.php?func=get_config"] = []byte(serverConfig)
+	static["/interface.php?func=get_building_info"] = []byte(buildingConfig)
+	static["/interface.php?func=get_unit_info"] = []byte(unitConfig)
+
+	return &files{
+		static:   static,
+		conquers: conquers,
+	}
+}
+
+// sortByScore sorts the ids by score (descending) and id (ascending), the position in the slice is the rank.
+func sortByScore(ids []int, scores map[int]int) {
+	sort.Slice(ids, func(i, j int) bool {
+		if scores[ids[i]] != scores[ids[j]] {
+			return scores[ids[i]] > scores[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+}
+
+// renderOD returns the lines in the format rank,id,score, only those who have defeated someone are ranked.
+func renderOD(entries []odEntry) []byte {
+	scores := make(map[int]int, len(entries))
+	ids := make([]int, 0, len(entries))
+	for _, e := range entries {
+		if e.score <= 0 {
+			continue
+		}
+		scores[e.id] = e.score
+		ids = append(ids, e.id)
+	}
+	sortByScore(ids, scores)
+	buf := &bytes.Buffer{}
+	for i, id := range ids {
+		fmt.Fprintf(buf, "%d,%d,%d\n", i+1, id, scores[id])
+	}
+	return buf.Bytes()
+}
+
+// renderConquers returns the conquers after the given unix timestamp in the format village_id,timestamp,new_owner,old_owner
+// or, if extended, village_id,timestamp,new_owner,old_owner,old_tribe,new_tribe,points.
+func renderConquers(conquers []Conquer, since int64, extended bool) []byte {
+	buf := &bytes.Buffer{}
+	for _, c := range conquers {
+		if c.At.Unix() <= since {
+			continue
+		}
+		if extended {
+			fmt.Fprintf(
+				buf,
+				"%d,%d,%d,%d,%d,%d,%d\n",
+				c.VillageID,
+				c.At.Unix(),
+				c.NewOwnerID,
+				c.OldOwnerID,
+				c.OldTribeID,
+				c.NewTribeID,
+				c.Points,
+			)
+		} else {
+			fmt.Fprintf(buf, "%d,%d,%d,%d\n", c.VillageID, c.At.Unix(), c.NewOwnerID, c.OldOwnerID)
+		}
+	}
+	return buf.Bytes()
+}
+
+func gzipBytes(data []byte) []byte {
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	_, _ = gw.Write(data)
+	_ = gw.Close()
+	return buf.Bytes()
+}
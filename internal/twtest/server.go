@@ -0,0 +1,206 @@
+// Package twtest provides a fake Tribal Wars server for the tests.
+//
+// The fake serves a single version host (DefaultHost by default) and its worlds on the subdomains
+// (e.g. https://pl1.tw.test), so the code that builds the world urls from the version host works unchanged.
+// All requests must be sent through Server.Transport, which connects to the fake regardless of the host.
+//
+// The worlds are scriptable: change them with the World methods and call Server.Tick to publish the changes,
+// like the game regenerates the files once in a while.
+package twtest
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const DefaultHost = "tw.test"
+
+type Server struct {
+	*httptest.Server
+	// Host is the version host, e.g. tw.test
+	Host string
+
+	mu        sync.RWMutex
+	worlds    map[string]*World
+	published []*World
+	ticks     int
+}
+
+func NewServer() *Server {
+	return NewServerWithHost(DefaultHost)
+}
+
+func NewServerWithHost(host string) *Server {
+	s := &Server{
+		Host:   host,
+		worlds: make(map[string]*World),
+	}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// AddWorld adds a world, it's listed in get_servers.php after the next tick.
+func (s *Server) AddWorld(key string) *World {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := newWorld(key)
+	s.worlds[key] = w
+	return w
+}
+
+// CloseWorld removes the world, it disappears from get_servers.php after the next tick.
+func (s *Server) CloseWorld(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.worlds, key)
+}
+
+func (s *Server) World(key string) *World {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.worlds[key]
+}
+
+// WorldURL returns the url of the given world, e.g. https://pl1.tw.test.
+func (s *Server) WorldURL(key string) string {
+	return "https://" + key + "." + s.Host
+}
+
+// Tick publishes the current state of all worlds.
+func (s *Server) Tick() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.published = s.published[:0]
+	for _, w := range s.worlds {
+		f := w.render()
+		w.mu.Lock()
+		w.published = f
+		w.mu.Unlock()
+		s.published = append(s.published, w)
+	}
+	sort.Slice(s.published, func(i, j int) bool {
+		return s.published[i].Key < s.published[j].Key
+	})
+	s.ticks++
+}
+
+// Ticks returns the number of ticks so far.
+func (s *Server) Ticks() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ticks
+}
+
+// Transport returns a transport that sends all requests to the fake, whatever the host is.
+// The requests to the hosts other than Host and its subdomains get an empty server list or 404.
+func (s *Server) Transport() *http.Transport {
+	addr := s.Listener.Addr().String()
+	dialer := &net.Dialer{}
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+		TLSClientConfig: &tls.Config{
+			// the certificate of httptest is issued for example.com
+			InsecureSkipVerify: true,
+		},
+	}
+}
+
+// Client returns a client that uses Transport.
+func (s *Server) Client() *http.Client {
+	return &http.Client{
+		Transport: s.Transport(),
+	}
+}
+
+func (s *Server) serveHTTP(rw http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	if r.URL.Path == "/backend/get_servers.php" {
+		if host != s.Host {
+			writeBody(rw, []byte(serializeServers(nil)))
+			return
+		}
+		s.mu.RLock()
+		servers := make(map[string]string, len(s.published))
+		for _, w := range s.published {
+			servers[w.Key] = s.WorldURL(w.Key)
+		}
+		s.mu.RUnlock()
+		writeBody(rw, []byte(serializeServers(servers)))
+		return
+	}
+
+	if !strings.HasSuffix(host, "."+s.Host) {
+		http.NotFound(rw, r)
+		return
+	}
+	key := strings.TrimSuffix(host, "."+s.Host)
+	s.mu.RLock()
+	var w *World
+	for _, published := range s.published {
+		if published.Key == key {
+			w = published
+		}
+	}
+	s.mu.RUnlock()
+	if w == nil {
+		http.NotFound(rw, r)
+		return
+	}
+	w.mu.Lock()
+	f := w.published
+	w.mu.Unlock()
+
+	if r.URL.Path == "/interface.php" {
+		switch fn := r.URL.Query().Get("func"); fn {
+		case "get_conquer", "get_conquer_extended":
+			since, _ := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+			writeBody(rw, renderConquers(f.conquers, since, fn == "get_conquer_extended"))
+			return
+		}
+	}
+	name := r.URL.Path
+	if r.URL.RawQuery != "" {
+		name += "?" + r.URL.RawQuery
+	}
+	data, ok := f.static[name]
+	if !ok {
+		http.NotFound(rw, r)
+		return
+	}
+	writeBody(rw, data)
+}
+
+func writeBody(rw http.ResponseWriter, data []byte) {
+	rw.WriteHeader(http.StatusOK)
+	_, _ = rw.Write(data)
+}
+
+// serializeServers encodes the servers like PHP's serialize does, e.g. a:1:{s:3:"pl1";s:19:"https://pl1.tw.test";}.
+func serializeServers(servers map[string]string) string {
+	keys := make([]string, 0, len(servers))
+	for key := range servers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "a:%d:{", len(keys))
+	for _, key := range keys {
+		fmt.Fprintf(b, "s:%d:\"%s\";s:%d:\"%s\";", len(key), key, len(servers[key]), servers[key])
+	}
+	b.WriteString("}")
+	return b.String()
+}
@@ -0,0 +1,108 @@
+package twtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tribalwarshelp/shared/tw/twdataloader"
+)
+
+func TestServer(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	w := srv.AddWorld("zz1")
+	w.Generate(GenerateConfig{
+		Tribes:   3,
+		Players:  20,
+		Villages: 50,
+		Seed:     1,
+	})
+	srv.Tick()
+
+	servers, err := twdataloader.NewVersionDataLoader(&twdataloader.VersionDataLoaderConfig{
+		Host:   srv.Host,
+		Client: srv.Client(),
+	}).LoadServers()
+	if err != nil {
+		t.Fatalf("LoadServers: %s", err)
+	}
+	if len(servers) != 1 || servers[0].Key != "zz1" || servers[0].URL != srv.WorldURL("zz1") {
+		t.Fatalf("LoadServers: unexpected servers %+v", servers)
+	}
+
+	dl := twdataloader.NewServerDataLoader(&twdataloader.ServerDataLoaderConfig{
+		BaseURL: srv.WorldURL("zz1"),
+		Client:  srv.Client(),
+	})
+	players, err := dl.LoadPlayers()
+	if err != nil {
+		t.Fatalf("LoadPlayers: %s", err)
+	}
+	if len(players) != 20 {
+		t.Errorf("LoadPlayers: expected 20 players, got %d", len(players))
+	}
+	tribes, err := dl.LoadTribes()
+	if err != nil {
+		t.Fatalf("LoadTribes: %s", err)
+	}
+	if len(tribes) != 3 {
+		t.Errorf("LoadTribes: expected 3 tribes, got %d", len(tribes))
+	}
+	villages, err := dl.LoadVillages()
+	if err != nil {
+		t.Fatalf("LoadVillages: %s", err)
+	}
+	if len(villages) != 50 {
+		t.Errorf("LoadVillages: expected 50 villages, got %d", len(villages))
+	}
+	for _, tribe := range []bool{false, true} {
+		od, err := dl.LoadOD(tribe)
+		if err != nil {
+			t.Fatalf("LoadOD(%t): %s", tribe, err)
+		}
+		if len(od) == 0 {
+			t.Errorf("LoadOD(%t): expected OD, got nothing", tribe)
+		}
+	}
+	if _, err := dl.GetConfig(); err != nil {
+		t.Errorf("GetConfig: %s", err)
+	}
+	if _, err := dl.GetBuildingConfig(); err != nil {
+		t.Errorf("GetBuildingConfig: %s", err)
+	}
+	if _, err := dl.GetUnitConfig(); err != nil {
+		t.Errorf("GetUnitConfig: %s", err)
+	}
+
+	// the changes are served after the next tick
+	playerIDs := w.Players()
+	villageIDs := w.Villages()
+	w.DisbandTribe(w.Tribes()[0])
+	w.Conquer(villageIDs[len(villageIDs)-1], playerIDs[0], time.Now().Add(-time.Minute))
+	w.AddPlayer(Player{ID: w.NextID(), Name: "new player"})
+	if players, _ := dl.LoadPlayers(); len(players) != 20 {
+		t.Errorf("LoadPlayers before the tick: expected 20 players, got %d", len(players))
+	}
+	srv.Tick()
+	if players, _ := dl.LoadPlayers(); len(players) != 21 {
+		t.Errorf("LoadPlayers after the tick: expected 21 players, got %d", len(players))
+	}
+	if tribes, _ := dl.LoadTribes(); len(tribes) != 2 {
+		t.Errorf("LoadTribes after the tick: expected 2 tribes, got %d", len(tribes))
+	}
+	ennoblements, err := dl.LoadEnnoblements(&twdataloader.LoadEnnoblementsConfig{
+		EnnobledAtGT: time.Now().Add(-time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("LoadEnnoblements: %s", err)
+	}
+	if len(ennoblements) != 1 || ennoblements[0].NewOwnerID != playerIDs[0] {
+		t.Errorf("LoadEnnoblements: unexpected ennoblements %+v", ennoblements)
+	}
+
+	srv.CloseWorld("zz1")
+	srv.Tick()
+	if _, err := dl.LoadVillages(); err == nil {
+		t.Error("LoadVillages: expected an error after the world has been closed")
+	}
+}
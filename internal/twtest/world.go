@@ -0,0 +1,310 @@
+package twtest
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Tribe struct {
+	ID   int
+	Name string
+	Tag  string
+	OD   OD
+}
+
+type Player struct {
+	ID      int
+	Name    string
+	TribeID int
+	OD      OD
+}
+
+type Village struct {
+	ID       int
+	Name     string
+	X        int
+	Y        int
+	PlayerID int
+	Points   int
+	Bonus    int
+}
+
+// OD holds the opponents defeated scores, the ranks are calculated from them.
+type OD struct {
+	Att int
+	Def int
+	Sup int
+}
+
+func (od OD) total() int {
+	return od.Att + od.Def + od.Sup
+}
+
+type Conquer struct {
+	VillageID  int
+	At         time.Time
+	NewOwnerID int
+	OldOwnerID int
+	OldTribeID int
+	NewTribeID int
+	Points     int
+}
+
+// World is a single game server (e.g. pl170). Its methods change the state of the world,
+// the changes are served after the next Server.Tick.
+type World struct {
+	Key string
+
+	mu       sync.Mutex
+	tribes   map[int]*Tribe
+	players  map[int]*Player
+	villages map[int]*Village
+	conquers []Conquer
+	nextID   int
+
+	published *files
+}
+
+func newWorld(key string) *World {
+	return &World{
+		Key:      key,
+		tribes:   make(map[int]*Tribe),
+		players:  make(map[int]*Player),
+		villages: make(map[int]*Village),
+		nextID:   1,
+	}
+}
+
+// NextID returns an id that isn't used by any tribe, player or village in the world.
+func (w *World) NextID() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.nextIDLocked()
+}
+
+func (w *World) nextIDLocked() int {
+	id := w.nextID
+	w.nextID++
+	return id
+}
+
+func (w *World) useID(id int) {
+	if id >= w.nextID {
+		w.nextID = id + 1
+	}
+}
+
+func (w *World) AddTribe(t Tribe) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.useID(t.ID)
+	w.tribes[t.ID] = &t
+}
+
+// DisbandTribe removes the tribe, its members become tribeless.
+func (w *World) DisbandTribe(id int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.tribes, id)
+	for _, p := range w.players {
+		if p.TribeID == id {
+			p.TribeID = 0
+		}
+	}
+}
+
+func (w *World) AddPlayer(p Player) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.useID(p.ID)
+	w.players[p.ID] = &p
+}
+
+// RemovePlayer removes the player (e.g. deleted account), its villages become barbarian.
+func (w *World) RemovePlayer(id int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.players, id)
+	for _, v := range w.villages {
+		if v.PlayerID == id {
+			v.PlayerID = 0
+		}
+	}
+}
+
+func (w *World) SetPlayerTribe(playerID, tribeID int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if p, ok := w.players[playerID]; ok {
+		p.TribeID = tribeID
+	}
+}
+
+func (w *World) SetPlayerOD(playerID int, od OD) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if p, ok := w.players[playerID]; ok {
+		p.OD = od
+	}
+}
+
+func (w *World) AddVillage(v Village) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.useID(v.ID)
+	w.villages[v.ID] = &v
+}
+
+// RemoveVillage removes the village from the map, it's rare, but the game does it e.g. when the world shrinks.
+func (w *World) RemoveVillage(id int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.villages, id)
+}
+
+// Conquer changes the owner of the village and records the conquer.
+func (w *World) Conquer(villageID, newOwnerID int, at time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	v, ok := w.villages[villageID]
+	if !ok {
+		return
+	}
+	c := Conquer{
+		VillageID:  villageID,
+		At:         at,
+		NewOwnerID: newOwnerID,
+		OldOwnerID: v.PlayerID,
+		Points:     v.Points,
+	}
+	if p, ok := w.players[v.PlayerID]; ok {
+		c.OldTribeID = p.TribeID
+	}
+	if p, ok := w.players[newOwnerID]; ok {
+		c.NewTribeID = p.TribeID
+	}
+	v.PlayerID = newOwnerID
+	w.conquers = append(w.conquers, c)
+}
+
+// Players returns the ids of the players sorted in ascending order.
+func (w *World) Players() []int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ids := make([]int, 0, len(w.players))
+	for id := range w.players {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Tribes returns the ids of the tribes sorted in ascending order.
+func (w *World) Tribes() []int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ids := make([]int, 0, len(w.tribes))
+	for id := range w.tribes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Villages returns the ids of the villages sorted in ascending order.
+func (w *World) Villages() []int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ids := make([]int, 0, len(w.villages))
+	for id := range w.villages {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Village returns a copy of the village.
+func (w *World) Village(id int) (Village, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	v, ok := w.villages[id]
+	if !ok {
+		return Village{}, false
+	}
+	return *v, true
+}
+
+type GenerateConfig struct {
+	Tribes   int
+	Players  int
+	Villages int
+	// Seed makes the generated data reproducible
+	Seed int64
+}
+
+// Generate adds random tribes, players and villages to the world. Every player gets at least one village
+// as long as there are enough villages, the rest of the villages are barbarian.
+func (w *World) Generate(cfg GenerateConfig) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	r := rand.New(rand.NewSource(cfg.Seed))
+
+	tribeIDs := make([]int, 0, cfg.Tribes)
+	for i := 0; i < cfg.Tribes; i++ {
+		id := w.nextIDLocked()
+		w.tribes[id] = &Tribe{
+			ID:   id,
+			Name: fmt.Sprintf("Tribe %d", id),
+			Tag:  fmt.Sprintf("T%d", id),
+			OD: OD{
+				Att: r.Intn(100000),
+				Def: r.Intn(100000),
+			},
+		}
+		tribeIDs = append(tribeIDs, id)
+	}
+
+	playerIDs := make([]int, 0, cfg.Players)
+	for i := 0; i < cfg.Players; i++ {
+		id := w.nextIDLocked()
+		p := &Player{
+			ID:   id,
+			Name: fmt.Sprintf("Player %d", id),
+			OD: OD{
+				Att: r.Intn(10000),
+				Def: r.Intn(10000),
+				Sup: r.Intn(1000),
+			},
+		}
+		// some players don't belong to any tribe
+		if len(tribeIDs) > 0 && r.Intn(4) > 0 {
+			p.TribeID = tribeIDs[r.Intn(len(tribeIDs))]
+		}
+		w.players[id] = p
+		playerIDs = append(playerIDs, id)
+	}
+
+	for i := 0; i < cfg.Villages; i++ {
+		id := w.nextIDLocked()
+		v := &Village{
+			ID:     id,
+			Name:   fmt.Sprintf("Village %d", id),
+			X:      500 + (i % 50),
+			Y:      500 + (i / 50),
+			Points: 26 + r.Intn(12000),
+		}
+		switch {
+		case i < len(playerIDs):
+			v.PlayerID = playerIDs[i]
+		case len(playerIDs) > 0 && r.Intn(2) == 0:
+			v.PlayerID = playerIDs[r.Intn(len(playerIDs))]
+		}
+		if v.PlayerID == 0 && r.Intn(10) == 0 {
+			v.Bonus = 1 + r.Intn(8)
+		}
+		w.villages[id] = v
+	}
+}
@@ -19,6 +19,7 @@ type Config struct {
 
 func Connect(cfg *Config) (*pg.DB, error) {
 	db := pg.Connect(prepareOptions())
+	db.AddQueryHook(queryTracer{})
 
 	if envutil.GetenvBool("LOG_DB_QUERIES") {
 		db.AddQueryHook(querylogger.Logger{
@@ -83,6 +84,12 @@ func prepareDB(db *pg.DB) error {
 		{
 			statement: pgDefaultValues,
 		},
+		{
+			statement: pgFailedTasksTable,
+		},
+		{
+			statement: pgTaskRunsTable,
+		},
 		{
 			statement: allVersionsPGInsertStatements,
 		},
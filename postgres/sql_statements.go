@@ -59,6 +59,13 @@ const (
 	`
 
 	pgFunctions = `
+		CREATE OR REPLACE FUNCTION clock_now()
+			RETURNS timestamptz AS
+		$BODY$
+			SELECT COALESCE(NULLIF(current_setting('twhelp.now', true), '')::timestamptz, now());
+		$BODY$
+		LANGUAGE sql STABLE;
+
 		CREATE OR REPLACE FUNCTION update_most_points_most_villages_best_rank_last_activity()
 			RETURNS trigger AS
 		$BODY$
@@ -66,34 +73,34 @@ const (
 			IF TG_OP = 'INSERT' THEN
 				IF NEW.most_points IS null OR NEW.points > NEW.most_points THEN
 					NEW.most_points = NEW.points;
-					NEW.most_points_at = now();
+					NEW.most_points_at = clock_now();
 				END IF;
 				IF NEW.most_villages IS null OR NEW.total_villages > NEW.most_villages THEN
 					NEW.most_villages = NEW.total_villages;
-					NEW.most_villages_at = now();
+					NEW.most_villages_at = clock_now();
 				END IF;
 				IF NEW.best_rank IS null OR NEW.rank < NEW.best_rank OR NEW.best_rank = 0 THEN
 					NEW.best_rank = NEW.rank;
-					NEW.best_rank_at = now();
+					NEW.best_rank_at = clock_now();
 				END IF;
 			END IF;
 			
 			IF TG_OP = 'UPDATE' THEN
 				IF NEW.most_points IS null OR NEW.points > OLD.most_points THEN
 					NEW.most_points = NEW.points;
-					NEW.most_points_at = now();
+					NEW.most_points_at = clock_now();
 				END IF;
 				IF NEW.most_villages IS null OR NEW.total_villages > OLD.most_villages THEN
 					NEW.most_villages = NEW.total_villages;
-					NEW.most_villages_at = now();
+					NEW.most_villages_at = clock_now();
 				END IF;
 				IF NEW.best_rank IS null OR NEW.rank < OLD.best_rank OR OLD.best_rank = 0 THEN
 					NEW.best_rank = NEW.rank;
-					NEW.best_rank_at = now();
+					NEW.best_rank_at = clock_now();
 				END IF;
 				if TG_TABLE_NAME = 'players' THEN
 					IF NEW.points > OLD.points OR NEW.score_att > OLD.score_att THEN
-						NEW.last_activity_at = now();
+						NEW.last_activity_at = clock_now();
 					END IF;
 				END IF;
 			END IF;
@@ -112,14 +119,14 @@ const (
 			IF TG_OP = 'INSERT' THEN
 				IF NEW.tribe_id <> 0 THEN
 					INSERT INTO ?0.tribe_changes(player_id,old_tribe_id,new_tribe_id,created_at)
-					VALUES(NEW.id,0,NEW.tribe_id,now());
+					VALUES(NEW.id,0,NEW.tribe_id,clock_now());
 				END IF;
 			END IF;
 
 			IF TG_OP = 'UPDATE' THEN
 				IF NEW.tribe_id <> OLD.tribe_id THEN
 					INSERT INTO ?0.tribe_changes(player_id,old_tribe_id,new_tribe_id,created_at)
-					VALUES(OLD.id,OLD.tribe_id,NEW.tribe_id,now());
+					VALUES(OLD.id,OLD.tribe_id,NEW.tribe_id,clock_now());
 				END IF;
 			END IF;
 
@@ -134,7 +141,7 @@ const (
 		BEGIN
 			IF NEW.name <> OLD.name AND old.exists = true THEN
 				INSERT INTO player_name_changes(version_code,player_id,old_name,new_name,change_date)
-					VALUES(?1,NEW.id,OLD.name,NEW.name,CURRENT_DATE)
+					VALUES(?1,NEW.id,OLD.name,NEW.name,clock_now()::date)
 					ON CONFLICT DO NOTHING;
 			END IF;
 
@@ -215,6 +222,49 @@ const (
 		ALTER TABLE ?0.stats ALTER COLUMN create_date set default CURRENT_DATE;
 	`
 
+	// the failed tasks (dead letters) of the queue, see queue.FailedTask
+	pgFailedTasksTable = `
+		CREATE TABLE IF NOT EXISTS public.failed_tasks (
+			id bigserial,
+			task_name text,
+			server_key text,
+			version_code text,
+			timezone text,
+			url text,
+			args bytea,
+			error text,
+			attempts bigint,
+			failed_at timestamptz DEFAULT now(),
+			PRIMARY KEY (id)
+		);
+	`
+
+	// the executions of the tasks, see queue.TaskRun
+	pgTaskRunsTable = `
+		CREATE TABLE IF NOT EXISTS public.task_runs (
+			id bigserial,
+			task_name text,
+			server_key text,
+			version_code text,
+			timezone text,
+			started_at timestamptz,
+			finished_at timestamptz,
+			duration bigint,
+			attempt bigint,
+			outcome text,
+			error text,
+			run_id text,
+			row_counts jsonb,
+			unchanged_row_counts jsonb,
+			PRIMARY KEY (id)
+		);
+		-- added after the table, the databases that already have it don't get them from CREATE TABLE
+		ALTER TABLE public.task_runs ADD COLUMN IF NOT EXISTS unchanged_row_counts jsonb;
+		ALTER TABLE public.task_runs ADD COLUMN IF NOT EXISTS run_id text;
+		CREATE INDEX IF NOT EXISTS task_runs_started_at_idx ON public.task_runs (started_at);
+		CREATE INDEX IF NOT EXISTS task_runs_task_name_server_key_idx ON public.task_runs (task_name, server_key, started_at);
+	`
+
 	pgDefaultValues = `
 		ALTER TABLE player_name_changes ALTER COLUMN change_date set default CURRENT_DATE;
 	`
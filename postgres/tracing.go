@@ -0,0 +1,69 @@
+package postgres
+
+import (
+	"context"
+	"strings"
+
+	"github.com/go-pg/pg/v10"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	maxTracedQueryLength = 2000
+)
+
+var tracer = otel.Tracer("github.com/tribalwarshelp/dataupdater/postgres")
+
+// queryTracer creates a span for each query, the parent span is taken from the context of the db (see pg.DB.WithContext).
+// The statement is recorded without the params.
+type queryTracer struct{}
+
+var _ pg.QueryHook = queryTracer{}
+
+func (queryTracer) BeforeQuery(ctx context.Context, _ *pg.QueryEvent) (context.Context, error) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		// the queries outside of a trace (e.g. made by the cron) would start a new trace each
+		return ctx, nil
+	}
+	ctx, _ = tracer.Start(ctx, "db.query", trace.WithSpanKind(trace.SpanKindClient))
+	return ctx, nil
+}
+
+func (queryTracer) AfterQuery(ctx context.Context, evt *pg.QueryEvent) error {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return nil
+	}
+	defer span.End()
+
+	query, err := evt.UnformattedQuery()
+	if err == nil {
+		statement := string(query)
+		operation := statement
+		if i := strings.IndexAny(operation, " \n\t("); i > 0 {
+			operation = operation[:i]
+		}
+		operation = strings.ToUpper(operation)
+		span.SetName(operation)
+		if len(statement) > maxTracedQueryLength {
+			statement = statement[:maxTracedQueryLength]
+		}
+		span.SetAttributes(
+			semconv.DBOperationKey.String(operation),
+			semconv.DBStatementKey.String(statement),
+		)
+	}
+	span.SetAttributes(semconv.DBSystemPostgreSQL)
+	if evt.Result != nil {
+		span.SetAttributes(attribute.Int("db.rows_affected", evt.Result.RowsAffected()))
+	}
+	if evt.Err != nil && evt.Err != pg.ErrNoRows {
+		span.RecordError(evt.Err)
+		span.SetStatus(codes.Error, evt.Err.Error())
+	}
+	return nil
+}
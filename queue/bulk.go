@@ -0,0 +1,160 @@
+package queue
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultBulkThreshold is the number of rows from which an entity is upserted via COPY.
+	// It's an estimate, run BenchmarkUpsertVillages against the target database to tune it.
+	defaultBulkThreshold = 5000
+)
+
+// bulkUpsert copies the rows into a temporary staging table and merges them into the table of the model
+// with a single INSERT ... SELECT ... ON CONFLICT instead of sending a multi-row INSERT with all of them.
+// The staging table is dropped at the end of the transaction.
+//
+// The values are the same as inserted by go-pg: the zero fields that go-pg replaces with DEFAULT are copied as NULL
+// and replaced with the default of the field (pg:"default:..."), the columns that are DEFAULT in every row are skipped.
+// The defaults using the wall clock use clock_now() instead, see clockDefault.
+func bulkUpsert(tx *pg.Tx, u upsert, rows interface{}) (orm.Result, error) {
+	slice := reflect.Indirect(reflect.ValueOf(rows))
+	if slice.Kind() != reflect.Slice {
+		return nil, errors.Errorf("bulkUpsert: expected a pointer to a slice, got %T", rows)
+	}
+	elemType := slice.Type().Elem()
+	if elemType.Kind() == reflect.Ptr {
+		elemType = elemType.Elem()
+	}
+	table := orm.GetTable(elemType)
+	fields := bulkFields(table.Fields, slice)
+	if len(fields) == 0 {
+		return nil, errors.Errorf("bulkUpsert: %s: no columns to copy", table.SQLName)
+	}
+
+	staging := "twhelp_staging_" + strings.Trim(string(table.Alias), `"`)
+	columns := make([]string, len(fields))
+	values := make([]string, len(fields))
+	for i, f := range fields {
+		columns[i] = string(f.Column)
+		values[i] = string(f.Column)
+		if f.Default != "" {
+			values[i] = "COALESCE(" + string(f.Column) + ", " + clockDefault(string(f.Default)) + ")"
+		}
+	}
+	columnList := strings.Join(columns, ", ")
+
+	if _, err := tx.Exec("DROP TABLE IF EXISTS " + staging); err != nil {
+		return nil, errors.Wrapf(err, "couldn't drop the staging table %s", staging)
+	}
+	if _, err := tx.Exec(
+		"CREATE TEMP TABLE " + staging + " ON COMMIT DROP AS SELECT " + columnList +
+			" FROM " + string(table.SQLName) + " WITH NO DATA",
+	); err != nil {
+		return nil, errors.Wrapf(err, "couldn't create the staging table %s", staging)
+	}
+	if _, err := tx.CopyFrom(
+		bytes.NewReader(encodeCopyRows(fields, slice)),
+		"COPY "+staging+" ("+columnList+") FROM STDIN",
+	); err != nil {
+		return nil, errors.Wrapf(err, "couldn't copy the rows to %s", staging)
+	}
+	res, err := tx.Exec(
+		"INSERT INTO " + string(table.SQLName) + " AS " + string(table.Alias) + " (" + columnList + ") " +
+			"SELECT " + strings.Join(values, ", ") + " FROM " + staging + " " +
+			"ON CONFLICT " + u.conflict + " DO UPDATE SET " + u.setSQL() + " WHERE " + u.changedSQL(table.Alias),
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't merge %s into %s", staging, table.SQLName)
+	}
+	return res, nil
+}
+
+// clockDefault replaces the wall clock in the default of a field with clock_now(),
+// so the replay (see Replay) writes the simulated time.
+func clockDefault(def string) string {
+	switch strings.ToLower(def) {
+	case "now()", "current_timestamp":
+		return "clock_now()"
+	case "current_date":
+		return "clock_now()::date"
+	}
+	return def
+}
+
+// bulkFields skips the fields that go-pg would insert as DEFAULT in every row,
+// except for the ones whose default uses the clock, the column default of the table would use the wall clock.
+func bulkFields(fields []*orm.Field, slice reflect.Value) []*orm.Field {
+	var result []*orm.Field
+	for _, f := range fields {
+		if f.Default != "" && clockDefault(string(f.Default)) != string(f.Default) {
+			result = append(result, f)
+			continue
+		}
+		for i := 0; i < slice.Len(); i++ {
+			if !isDefaultValue(f, reflect.Indirect(slice.Index(i))) {
+				result = append(result, f)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// isDefaultValue reports whether go-pg would insert DEFAULT instead of the value of the field (see orm.InsertQuery).
+func isDefaultValue(f *orm.Field, strct reflect.Value) bool {
+	return (f.Default != "" || f.NullZero()) && f.HasZeroValue(strct)
+}
+
+// encodeCopyRows encodes the rows in the text format of COPY.
+func encodeCopyRows(fields []*orm.Field, slice reflect.Value) []byte {
+	var buf bytes.Buffer
+	var value []byte
+	for i := 0; i < slice.Len(); i++ {
+		strct := reflect.Indirect(slice.Index(i))
+		for j, f := range fields {
+			if j > 0 {
+				buf.WriteByte('\t')
+			}
+			if isDefaultValue(f, strct) || isNilValue(f.Value(strct)) {
+				buf.WriteString(`\N`)
+				continue
+			}
+			value = f.AppendValue(value[:0], strct, 0)
+			writeCopyValue(&buf, value)
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+func isNilValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+		return v.IsNil()
+	}
+	return false
+}
+
+func writeCopyValue(buf *bytes.Buffer, value []byte) {
+	for _, c := range value {
+		switch c {
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package queue
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+
+	"github.com/tribalwarshelp/dataupdater/postgres"
+)
+
+type copyTestModel struct {
+	tableName struct{} `pg:"copy_test,alias:copy_test"`
+
+	ID         int            `pg:",pk"`
+	Name       string         `pg:"name"`
+	Points     int            `pg:",use_zero"`
+	Exists     *bool          `pg:",use_zero"`
+	CreateDate time.Time      `pg:"default:CURRENT_DATE,type:DATE,use_zero"`
+	Counts     map[string]int `pg:",type:jsonb"`
+	DeletedAt  time.Time
+	UpdatedAt  time.Time `pg:"default:now(),use_zero"`
+}
+
+func TestEncodeCopyRows(t *testing.T) {
+	exists := true
+	rows := []*copyTestModel{
+		{
+			ID:         1,
+			Name:       "tab\tbackslash\\newline\n",
+			Exists:     &exists,
+			CreateDate: time.Date(2021, time.July, 17, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			ID:     2,
+			Points: 5,
+			Counts: map[string]int{"x": 1},
+		},
+	}
+	slice := reflect.ValueOf(rows)
+	fields := bulkFields(orm.GetTable(reflect.TypeOf(copyTestModel{})).Fields, slice)
+
+	var columns []string
+	for _, f := range fields {
+		columns = append(columns, f.SQLName)
+	}
+	// updated_at is DEFAULT in every row, but it's copied as NULL and replaced with clock_now()
+	expectedColumns := []string{"id", "name", "points", "exists", "create_date", "counts", "updated_at"}
+	if !reflect.DeepEqual(columns, expectedColumns) {
+		t.Errorf("expected the columns %v (deleted_at is DEFAULT in every row), got %v", expectedColumns, columns)
+	}
+
+	expected := "1\ttab\\tbackslash\\\\newline\\n\t0\tTRUE\t2021-07-17 00:00:00+00:00:00\t\\N\t\\N\n" +
+		"2\t\\N\t5\t\\N\t\\N\t{\"x\":1}\t\\N\n"
+	if got := string(encodeCopyRows(fields, slice)); got != expected {
+		t.Errorf("expected:\n%q\ngot:\n%q", expected, got)
+	}
+}
+
+// benchServerKey doesn't collide with the servers of the end-to-end tests (zz1, zz2...)
+const benchServerKey = "zzbench"
+
+// BenchmarkUpsertVillages compares the multi-row INSERT with COPY into a staging table,
+// the villages are upserted into an existing table, so the first iteration inserts them and the others update them.
+func BenchmarkUpsertVillages(b *testing.B) {
+	env := newE2EEnv(b)
+	if _, err := env.db.Exec(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", benchServerKey)); err != nil {
+		b.Fatal(err)
+	}
+	if err := postgres.CreateServerSchema(env.db, &twmodel.Server{
+		Key:         benchServerKey,
+		VersionCode: e2eVersionCode,
+	}); err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		_, _ = env.db.Exec(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", benchServerKey))
+	}()
+	db := env.db.WithParam("SERVER", pg.Safe(benchServerKey))
+
+	for _, n := range []int{1000, 10000, 50000} {
+		villages := make([]*twmodel.Village, n)
+		for i := range villages {
+			villages[i] = &twmodel.Village{
+				ID:     i + 1,
+				Name:   fmt.Sprintf("Village %d", i+1),
+				Points: 26 + i%12000,
+				X:      i % 1000,
+				Y:      i / 1000,
+			}
+		}
+		for _, method := range []struct {
+			name          string
+			bulkThreshold int
+		}{
+			{"insert", -1},
+			{"copy", 1},
+		} {
+			b.Run(fmt.Sprintf("%s/%d", method.name, n), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if err := db.RunInTransaction(db.Context(), func(tx *pg.Tx) error {
+						_, err := execUpsert(tx, upsertVillages, &villages, method.bulkThreshold)
+						return err
+					}); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+		if _, err := db.Exec("TRUNCATE ?SERVER.villages"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -4,24 +4,165 @@ import (
 	"github.com/go-pg/pg/v10"
 	"github.com/go-redis/redis/v8"
 	"github.com/pkg/errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/tribalwarshelp/dataupdater/archive"
 )
 
 type Config struct {
+	// Backend defaults to BackendRedis
+	Backend Backend
+	// Redis is required by BackendRedis and ignored by BackendMemory
 	Redis       redis.UniversalClient
 	WorkerLimit int
 	DB          *pg.DB
+	// UniqueFor overrides defaultUniqueFor, a zero period disables the deduplication for the given task
+	UniqueFor map[string]time.Duration
+	// ServerLockWait is how long a task waits for the lock of a server held by another task (default 30s),
+	// ServerLockTTL is how long the lock remains valid if the task holding it dies (default 1m).
+	ServerLockWait time.Duration
+	ServerLockTTL  time.Duration
+	// RetryPolicies overrides the retry policy of the given tasks,
+	// zero fields are filled with the default values (3 attempts, 30s-30m backoff, no jitter).
+	RetryPolicies map[string]RetryPolicy
+	// RequestsPerSecondPerHost limits the requests sent to each game host (e.g. plemiona.pl) by all workers together,
+	// 0 means no limit
+	RequestsPerSecondPerHost int
+	// HTTP configures the client used to download the data from the game servers
+	HTTP *HTTPConfig
+	// Archive stores the raw files downloaded by updateServerData, nil disables archiving
+	Archive *archive.Archive
+	// TaskRunsRetention is how long the task runs are kept in public.task_runs (default 30 days),
+	// the older ones are deleted by the vacuum task
+	TaskRunsRetention time.Duration
+	// TaskRunsSampling overrides defaultTaskRunsSampling, N records one of every N successful runs of the given task
+	// for each server, 0 or 1 records all of them and a negative value none.
+	// The runs that have failed, been retried or rejected are always recorded.
+	TaskRunsSampling map[string]int
+	// BulkThreshold is the number of rows from which updateServerData upserts an entity (e.g. villages)
+	// via COPY into a staging table instead of a multi-row INSERT (default 5000), a negative value disables COPY
+	BulkThreshold int
+	// TxTimeout is the timeout of the transactions of updateServerData (default 20s),
+	// TxTimeoutPerThousandRows is added to it for every 1000 rows upserted in the transaction (default 1s).
+	TxTimeout                time.Duration
+	TxTimeoutPerThousandRows time.Duration
+	// ChunkedCommits commits the tribes, players and villages of updateServerData in separate transactions (in this order),
+	// so a failure in the villages doesn't roll back the players. The server's data_updated_at is updated with the villages.
+	ChunkedCommits bool
+	// MaxCountDropPercent rejects the data downloaded by updateServerData if the number of players, tribes or villages
+	// has dropped by more than the given percentage since the previous update (default 20), a negative value disables the check.
+	// The data is also rejected if it contains duplicated IDs.
+	MaxCountDropPercent int
+	// AcceptCountDropAfter accepts the drop (e.g. the world has really shrunk) once the given number of consecutive
+	// updates of a server have been rejected only because of it. It's disabled by default (0), the drop is never accepted.
+	AcceptCountDropAfter int
+	// MaxUnknownReferencesPercent rejects the data if more than the given percentage of players are in unknown tribes
+	// or of villages belong to unknown players (default 5), a negative value disables the check.
+	// The files are downloaded separately, so a few of them are expected.
+	MaxUnknownReferencesPercent int
+	// DownloadConcurrency is the max number of files downloaded at a time by updateServerData (default 4),
+	// 1 downloads them one by one. The rate limit (RequestsPerSecondPerHost) applies to each of them.
+	DownloadConcurrency int
+}
+
+type HTTPConfig struct {
+	// Timeout of a single request, including reading the body (default 10s)
+	Timeout time.Duration
+	// ProxyURL defaults to the proxy from the environment (HTTPS_PROXY, NO_PROXY...)
+	ProxyURL            string
+	UserAgent           string
+	MaxIdleConnsPerHost int
+	// TLSCAFile is a path to a PEM file with additional root CAs
+	TLSCAFile             string
+	TLSInsecureSkipVerify bool
+	// DisableCompression disables requesting gzip-compressed responses (Accept-Encoding: gzip)
+	DisableCompression bool
+	// Transport replaces the transport built from the fields above, e.g. to send the requests to a fake server in tests
+	Transport http.RoundTripper
 }
 
 func validateConfig(cfg *Config) error {
-	if cfg == nil || cfg.Redis == nil {
-		return errors.New("cfg.Redis is required")
+	if cfg == nil {
+		return errors.New("cfg is required")
+	}
+	switch cfg.Backend {
+	case "", BackendRedis:
+		if cfg.Redis == nil {
+			return errors.New("cfg.Redis is required")
+		}
+	case BackendMemory:
+	default:
+		return errors.Errorf("cfg.Backend: unknown backend '%s'", cfg.Backend)
+	}
+	if cfg.DB == nil {
+		return errors.New("cfg.DB is required")
+	}
+	if cfg.RequestsPerSecondPerHost < 0 {
+		return errors.New("cfg.RequestsPerSecondPerHost must not be negative")
+	}
+	if cfg.TaskRunsRetention < 0 {
+		return errors.New("cfg.TaskRunsRetention must not be negative")
+	}
+	if cfg.TxTimeout < 0 {
+		return errors.New("cfg.TxTimeout must not be negative")
+	}
+	if cfg.TxTimeoutPerThousandRows < 0 {
+		return errors.New("cfg.TxTimeoutPerThousandRows must not be negative")
+	}
+	if cfg.DownloadConcurrency < 0 {
+		return errors.New("cfg.DownloadConcurrency must not be negative")
+	}
+	if cfg.HTTP != nil {
+		if cfg.HTTP.Timeout < 0 {
+			return errors.New("cfg.HTTP.Timeout must not be negative")
+		}
+		if cfg.HTTP.ProxyURL != "" {
+			if _, err := url.Parse(cfg.HTTP.ProxyURL); err != nil {
+				return errors.Wrap(err, "cfg.HTTP.ProxyURL is invalid")
+			}
+		}
+	}
+	for taskName := range cfg.UniqueFor {
+		if !isKnownTask(taskName) {
+			return errors.Errorf("cfg.UniqueFor: unknown task '%s'", taskName)
+		}
+	}
+	for taskName := range cfg.TaskRunsSampling {
+		if !isKnownTask(taskName) {
+			return errors.Errorf("cfg.TaskRunsSampling: unknown task '%s'", taskName)
+		}
+	}
+	for taskName, policy := range cfg.RetryPolicies {
+		if !isKnownTask(taskName) {
+			return errors.Errorf("cfg.RetryPolicies: unknown task '%s'", taskName)
+		}
+		if err := policy.withDefaults(defaultRetryPolicy).validate(); err != nil {
+			return errors.Wrapf(err, "cfg.RetryPolicies: %s", taskName)
+		}
 	}
 	return nil
 }
 
 type registerTasksConfig struct {
-	DB    *pg.DB
-	Queue *Queue
+	DB             *pg.DB
+	Queue          *Queue
+	ServerLockWait time.Duration
+	ServerLockTTL  time.Duration
+
+	RequestsPerSecondPerHost    int
+	HTTP                        *HTTPConfig
+	Archive                     *archive.Archive
+	TaskRunsRetention           time.Duration
+	BulkThreshold               int
+	TxTimeout                   time.Duration
+	TxTimeoutPerThousandRows    time.Duration
+	ChunkedCommits              bool
+	MaxCountDropPercent         int
+	AcceptCountDropAfter        int
+	MaxUnknownReferencesPercent int
+	DownloadConcurrency         int
 }
 
 func validateRegisterTasksConfig(cfg *registerTasksConfig) error {
@@ -0,0 +1,23 @@
+package queue
+
+import (
+	"context"
+
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	defaultDownloadConcurrency = 4
+)
+
+// newDownloadGroup returns a group that runs up to limit downloads of an update at a time (1 if limit <= 0).
+// The first error cancels the returned context, so the data loader created with it (see contextTransport)
+// cancels the other downloads.
+func newDownloadGroup(ctx context.Context, limit int) (*errgroup.Group, context.Context) {
+	if limit <= 0 {
+		limit = 1
+	}
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(limit)
+	return g, ctx
+}
@@ -0,0 +1,57 @@
+package queue
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestDownloadGroup(t *testing.T) {
+	t.Run("limit", func(t *testing.T) {
+		var running, maxRunning int32
+		g, _ := newDownloadGroup(context.Background(), 2)
+		for i := 0; i < 8; i++ {
+			g.Go(func() error {
+				n := atomic.AddInt32(&running, 1)
+				for {
+					max := atomic.LoadInt32(&maxRunning)
+					if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+						break
+					}
+				}
+				time.Sleep(10 * time.Millisecond)
+				atomic.AddInt32(&running, -1)
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			t.Fatal(err)
+		}
+		if maxRunning != 2 {
+			t.Errorf("expected 2 downloads at a time, got %d", maxRunning)
+		}
+	})
+
+	t.Run("cancel on error", func(t *testing.T) {
+		expected := errors.New("couldn't load villages")
+		g, ctx := newDownloadGroup(context.Background(), 2)
+		g.Go(func() error {
+			return expected
+		})
+		g.Go(func() error {
+			// a request in progress is cancelled
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(5 * time.Second):
+				return errors.New("the download hasn't been cancelled")
+			}
+		})
+		if err := g.Wait(); err != expected {
+			t.Errorf("expected the first error (%s), got %v", expected, err)
+		}
+	})
+}
@@ -0,0 +1,760 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-pg/pg/v10"
+	"github.com/go-redis/redis/v8"
+	"github.com/tribalwarshelp/shared/tw/twdataloader"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+	"github.com/vmihailenco/taskq/v3"
+
+	"github.com/tribalwarshelp/dataupdater/internal/twtest"
+	"github.com/tribalwarshelp/dataupdater/postgres"
+)
+
+const (
+	e2eVersionCode = "zz"
+	e2eTimezone    = "UTC"
+)
+
+// e2eEnv runs the tasks against a real Postgres, Redis is replaced with miniredis and the game with twtest.Server.
+// The tasks are registered globally by taskq, so the environment is shared by all tests,
+// each test gets its own server (see newFixture).
+type e2eEnv struct {
+	db       *pg.DB
+	redis    *miniredis.Miniredis
+	srv      *twtest.Server
+	q        *Queue
+	fixtures int
+}
+
+var (
+	e2eOnce sync.Once
+	e2e     *e2eEnv
+	e2eErr  error
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if e2e != nil {
+		e2e.close()
+	}
+	os.Exit(code)
+}
+
+func newE2EEnv(t testing.TB) *e2eEnv {
+	t.Helper()
+	if os.Getenv("TEST_DB_NAME") == "" {
+		// the CI job must run them, see .circleci/config.yml
+		if os.Getenv("CI") != "" {
+			t.Fatal("TEST_DB_NAME isn't set, the end-to-end tests can't be skipped in CI")
+		}
+		t.Skip("TEST_DB_NAME isn't set, set TEST_DB_HOST, TEST_DB_PORT, TEST_DB_USER, TEST_DB_PASSWORD and TEST_DB_NAME " +
+			"to run the end-to-end tests, the database is modified by them")
+	}
+	e2eOnce.Do(func() {
+		e2e, e2eErr = setUpE2EEnv()
+	})
+	if e2eErr != nil {
+		t.Fatal(e2eErr)
+	}
+	return e2e
+}
+
+func setUpE2EEnv() (*e2eEnv, error) {
+	for _, name := range []string{"HOST", "PORT", "USER", "PASSWORD", "NAME"} {
+		if err := os.Setenv("DB_"+name, os.Getenv("TEST_DB_"+name)); err != nil {
+			return nil, err
+		}
+	}
+	db, err := postgres.Connect(nil)
+	if err != nil {
+		return nil, err
+	}
+	env := &e2eEnv{
+		db: db,
+	}
+	// the servers left by the previous runs
+	var keys []string
+	if err := db.Model(&twmodel.Server{}).Column("key").Where("version_code = ?", e2eVersionCode).Select(&keys); err != nil {
+		env.close()
+		return nil, err
+	}
+	for _, key := range keys {
+		if err := env.dropServer(key); err != nil {
+			env.close()
+			return nil, err
+		}
+	}
+	_, err = db.Model(&twmodel.Version{
+		Code:     e2eVersionCode,
+		Name:     "End-to-end tests",
+		Host:     twtest.DefaultHost,
+		Timezone: e2eTimezone,
+	}).
+		OnConflict("(code) DO UPDATE").
+		Set("host = EXCLUDED.host").
+		Set("timezone = EXCLUDED.timezone").
+		Insert()
+	if err != nil {
+		env.close()
+		return nil, err
+	}
+
+	env.redis, err = miniredis.Run()
+	if err != nil {
+		env.close()
+		return nil, err
+	}
+	env.srv = twtest.NewServer()
+
+	retryPolicies := make(map[string]RetryPolicy)
+	for _, taskName := range TaskNames() {
+		// a failed task is saved in failed_tasks straight away instead of waiting for the retries
+		retryPolicies[taskName] = RetryPolicy{MaxAttempts: 1}
+	}
+	env.q, err = New(&Config{
+		DB: db,
+		Redis: redis.NewClient(&redis.Options{
+			Addr: env.redis.Addr(),
+		}),
+		WorkerLimit:   1,
+		RetryPolicies: retryPolicies,
+		// the villages (120) are upserted via COPY, the tribes and players via INSERT
+		BulkThreshold: 100,
+		// one of 5 tribes is disbanded
+		MaxCountDropPercent: 50,
+		// every run is checked by env.run
+		TaskRunsSampling: map[string]int{
+			UpdateServerEnnoblements: 1,
+		},
+		HTTP: &HTTPConfig{
+			Transport: env.srv.Transport(),
+		},
+	})
+	if err != nil {
+		env.close()
+		return nil, err
+	}
+	if _, err := db.Exec("TRUNCATE public.failed_tasks, public.task_runs"); err != nil {
+		env.close()
+		return nil, err
+	}
+	return env, nil
+}
+
+func (env *e2eEnv) close() {
+	if env.srv != nil {
+		env.srv.Close()
+	}
+	if env.redis != nil {
+		env.redis.Close()
+	}
+	if env.db != nil {
+		_ = env.db.Close()
+	}
+}
+
+func (env *e2eEnv) dropServer(key string) error {
+	if _, err := env.db.Exec(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", key)); err != nil {
+		return err
+	}
+	_, err := env.db.Model(&twmodel.Server{}).Where("key = ?", key).Delete()
+	return err
+}
+
+// run adds the message to the queue and processes it together with the messages added by it.
+// The task must succeed and its run must be recorded in task_runs.
+func (env *e2eEnv) run(t *testing.T, msg *taskq.Message) {
+	t.Helper()
+	start := time.Now()
+	if err := env.q.Add(msg); err != nil {
+		t.Fatalf("couldn't add the message: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	for _, queue := range []taskq.Queue{env.q.main, env.q.ennoblements} {
+		if err := queue.Consumer().ProcessAll(ctx); err != nil {
+			t.Fatalf("%s: ProcessAll: %s", queue.Name(), err)
+		}
+	}
+
+	failedTasks, _, err := FailedTasks(ctx, env.db, &FailedTasksFilter{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failedTasks) > 0 {
+		var errs []string
+		for _, failedTask := range failedTasks {
+			errs = append(errs, failedTask.TaskName+": "+failedTask.Error)
+		}
+		t.Fatalf("%d tasks have failed:\n%s", len(failedTasks), strings.Join(errs, "\n"))
+	}
+
+	n, err := env.db.Model(&TaskRun{}).
+		Where("task_name = ? AND outcome = ? AND started_at >= ?", msg.TaskName, TaskRunOutcomeSuccess, start).
+		Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Fatalf("expected a successful run of %s to be recorded", msg.TaskName)
+	}
+}
+
+func (env *e2eEnv) version(t *testing.T) *twmodel.Version {
+	t.Helper()
+	version := &twmodel.Version{}
+	if err := env.db.Model(version).Where("code = ?", e2eVersionCode).Relation("SpecialServers").Select(); err != nil {
+		t.Fatalf("couldn't load the version: %s", err)
+	}
+	return version
+}
+
+// e2eFixture is a world of the fake game and its server in the database, used by a single test.
+// The other servers of the version are removed by the previous tests, so the tasks processing
+// all servers (e.g. updateEnnoblements) only process this one.
+type e2eFixture struct {
+	env   *e2eEnv
+	key   string
+	world *twtest.World
+}
+
+// newFixture adds a new world to the fake game, it's removed with its server when the test ends.
+// The server is created and its data is loaded by the first loadServersAndUpdateData, see load.
+func (env *e2eEnv) newFixture(t *testing.T) *e2eFixture {
+	t.Helper()
+	env.fixtures++
+	f := &e2eFixture{
+		env: env,
+		key: fmt.Sprintf("%s%d", e2eVersionCode, env.fixtures),
+	}
+	f.world = env.srv.AddWorld(f.key)
+	f.world.Generate(twtest.GenerateConfig{
+		Tribes:   5,
+		Players:  40,
+		Villages: 120,
+		Seed:     1,
+	})
+	env.srv.Tick()
+	t.Cleanup(func() {
+		env.srv.CloseWorld(f.key)
+		env.srv.Tick()
+		if err := env.dropServer(f.key); err != nil {
+			t.Errorf("couldn't drop the server %s: %s", f.key, err)
+		}
+		// a failure of this test doesn't fail the next ones
+		if _, err := env.db.Exec("TRUNCATE public.failed_tasks"); err != nil {
+			t.Errorf("couldn't truncate the failed tasks: %s", err)
+		}
+	})
+	return f
+}
+
+// load creates the server and loads its data.
+func (f *e2eFixture) load(t *testing.T) {
+	t.Helper()
+	f.env.run(t, GetTask(LoadServersAndUpdateData).WithArgs(context.Background(), f.env.version(t)))
+}
+
+// newLoadedFixture is newFixture followed by load.
+func (env *e2eEnv) newLoadedFixture(t *testing.T) *e2eFixture {
+	t.Helper()
+	f := env.newFixture(t)
+	f.load(t)
+	return f
+}
+
+func (f *e2eFixture) url() string {
+	return f.env.srv.WorldURL(f.key)
+}
+
+func (f *e2eFixture) serverDB() *pg.DB {
+	return f.env.db.WithParam("SERVER", pg.Safe(f.key))
+}
+
+func (f *e2eFixture) server(t *testing.T) *twmodel.Server {
+	t.Helper()
+	server := &twmodel.Server{}
+	if err := f.env.db.Model(server).Where("server.key = ?", f.key).Relation("Version").Select(); err != nil {
+		t.Fatalf("couldn't load the server: %s", err)
+	}
+	return server
+}
+
+func (f *e2eFixture) count(t *testing.T, model interface{}, where string, params ...interface{}) int {
+	t.Helper()
+	q := f.serverDB().Model(model)
+	if where != "" {
+		q = q.Where(where, params...)
+	}
+	n, err := q.Count()
+	if err != nil {
+		t.Fatalf("couldn't count %T: %s", model, err)
+	}
+	return n
+}
+
+// e2eTests are run in this order, each with its own fixture. Every task must be covered by a test named after it.
+var e2eTests = []struct {
+	name string
+	test func(t *testing.T, env *e2eEnv)
+}{
+	{
+		name: LoadVersionsAndUpdateServerData,
+		test: func(t *testing.T, env *e2eEnv) {
+			f := env.newFixture(t)
+
+			env.run(t, GetTask(LoadVersionsAndUpdateServerData).WithArgs(context.Background()))
+
+			server := f.server(t)
+			if server.Status != twmodel.ServerStatusOpen {
+				t.Errorf("expected the server to be open, got %s", server.Status)
+			}
+			if server.NumberOfPlayers != 40 || server.NumberOfTribes != 5 || server.NumberOfVillages != 120 {
+				t.Errorf(
+					"expected 40 players, 5 tribes and 120 villages, got %d, %d and %d",
+					server.NumberOfPlayers,
+					server.NumberOfTribes,
+					server.NumberOfVillages,
+				)
+			}
+			if n := f.count(t, (*twmodel.Player)(nil), "exists = true"); n != 40 {
+				t.Errorf("expected 40 players, got %d", n)
+			}
+			if n := f.count(t, (*twmodel.Tribe)(nil), "exists = true"); n != 5 {
+				t.Errorf("expected 5 tribes, got %d", n)
+			}
+			if n := f.count(t, (*twmodel.Village)(nil), ""); n != 120 {
+				t.Errorf("expected 120 villages, got %d", n)
+			}
+
+			runs, _, err := env.q.TaskRuns(context.Background(), &TaskRunsFilter{TaskName: UpdateServerData, ServerKey: f.key})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(runs) != 1 {
+				t.Fatalf("expected 1 run of %s, got %d", UpdateServerData, len(runs))
+			}
+			if run := runs[0]; run.Outcome != TaskRunOutcomeSuccess ||
+				run.VersionCode != e2eVersionCode ||
+				!strings.HasPrefix(run.RunID, f.key+"/") ||
+				run.RowCounts["players"] != 40 ||
+				run.RowCounts["villages"] != 120 {
+				t.Errorf(
+					"expected a successful run with 40 players, 120 villages and the run id, got %s with %v (%s)",
+					run.Outcome,
+					run.RowCounts,
+					run.RunID,
+				)
+			}
+		},
+	},
+	{
+		name: LoadServersAndUpdateData,
+		test: func(t *testing.T, env *e2eEnv) {
+			f := env.newLoadedFixture(t)
+			tribeIDs := f.world.Tribes()
+			playerIDs := f.world.Players()
+			disbanded := tribeIDs[0]
+			removed := playerIDs[0]
+			joined := f.world.NextID()
+			f.world.DisbandTribe(disbanded)
+			f.world.RemovePlayer(removed)
+			f.world.AddPlayer(twtest.Player{
+				ID:      joined,
+				Name:    "New player",
+				TribeID: tribeIDs[1],
+			})
+			env.srv.Tick()
+
+			f.load(t)
+
+			if n := f.count(t, (*twmodel.Tribe)(nil), "id = ? AND exists = false", disbanded); n != 1 {
+				t.Errorf("expected the tribe %d to be marked as deleted", disbanded)
+			}
+			if n := f.count(t, (*twmodel.Player)(nil), "id = ? AND exists = false", removed); n != 1 {
+				t.Errorf("expected the player %d to be marked as deleted", removed)
+			}
+			if n := f.count(t, (*twmodel.Player)(nil), "id = ? AND exists = true", joined); n != 1 {
+				t.Errorf("expected the player %d to be added", joined)
+			}
+			if n := f.count(t, (*twmodel.TribeChange)(nil), "player_id = ? AND new_tribe_id = ?", joined, tribeIDs[1]); n != 1 {
+				t.Errorf("expected the tribe change of the player %d to be logged", joined)
+			}
+			if n := f.count(t, (*twmodel.Player)(nil), "tribe_id = ?", disbanded); n != 0 {
+				t.Errorf("expected %d players to be still in the disbanded tribe, got %d", 0, n)
+			}
+
+			runs, _, err := env.q.TaskRuns(context.Background(), &TaskRunsFilter{TaskName: UpdateServerData, ServerKey: f.key, Limit: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(runs) != 1 {
+				t.Fatalf("expected a run of %s, got %d", UpdateServerData, len(runs))
+			}
+			// only the villages of the removed player may have changed
+			if run := runs[0]; run.UnchangedRowCounts["villages"] == 0 ||
+				run.RowCounts["villages"]+run.UnchangedRowCounts["villages"] != 120 {
+				t.Errorf(
+					"expected the unchanged villages to be skipped, got %v written and %v unchanged",
+					run.RowCounts,
+					run.UnchangedRowCounts,
+				)
+			}
+		},
+	},
+	{
+		name: "chunkedCommits",
+		test: func(t *testing.T, env *e2eEnv) {
+			f := env.newLoadedFixture(t)
+			tribeIDs := f.world.Tribes()
+			playerIDs := f.world.Players()
+			moved := playerIDs[len(playerIDs)-1]
+			f.world.SetPlayerTribe(moved, tribeIDs[len(tribeIDs)-1])
+			village := twtest.Village{
+				ID:       f.world.NextID(),
+				Name:     "New village",
+				X:        500,
+				Y:        500,
+				PlayerID: moved,
+				Points:   26,
+			}
+			f.world.AddVillage(village)
+			env.srv.Tick()
+
+			before := f.server(t)
+			newWorker := func() *workerUpdateServerData {
+				server := f.server(t)
+				downloads, _ := newDownloadGroup(context.Background(), defaultDownloadConcurrency)
+				return &workerUpdateServerData{
+					db: f.serverDB(),
+					dataloader: twdataloader.NewServerDataLoader(&twdataloader.ServerDataLoaderConfig{
+						BaseURL: f.url(),
+						Client:  env.srv.Client(),
+					}),
+					server:         server,
+					now:            time.Now,
+					bulkThreshold:  100,
+					chunkedCommits: true,
+					runID:          newUpdateRunID(server.Key, time.Now()),
+
+					maxCountDropPercent:         -1,
+					maxUnknownReferencesPercent: -1,
+					downloads:                   downloads,
+				}
+			}
+
+			// the new village can't be written, so the villages chunk fails after the tribes and players have been committed
+			if _, err := f.serverDB().Exec("ALTER TABLE ?SERVER.villages ADD CONSTRAINT e2e_chunked_commits CHECK (false) NOT VALID"); err != nil {
+				t.Fatal(err)
+			}
+			worker := newWorker()
+			err := worker.update()
+			if _, dropErr := f.serverDB().Exec("ALTER TABLE ?SERVER.villages DROP CONSTRAINT e2e_chunked_commits"); dropErr != nil {
+				t.Fatal(dropErr)
+			}
+			if err == nil {
+				t.Fatal("expected the update to fail")
+			}
+			if msg := err.Error(); !strings.Contains(msg, "run "+worker.runID+": the tribes, players have been committed") ||
+				!strings.Contains(msg, "couldn't commit the villages") {
+				t.Errorf("expected the error to name the committed chunks, got %s", msg)
+			}
+			if after := f.server(t); !after.DataUpdatedAt.Equal(before.DataUpdatedAt) ||
+				after.NumberOfVillages != before.NumberOfVillages {
+				t.Errorf(
+					"expected data_updated_at (%s) and the number of villages (%d) to be unchanged, got %s and %d",
+					before.DataUpdatedAt,
+					before.NumberOfVillages,
+					after.DataUpdatedAt,
+					after.NumberOfVillages,
+				)
+			}
+			if n := f.count(t, (*twmodel.Player)(nil), "id = ? AND tribe_id = ?", moved, tribeIDs[len(tribeIDs)-1]); n != 1 {
+				t.Errorf("expected the players to be committed, the player %d hasn't changed the tribe", moved)
+			}
+			if n := f.count(t, (*twmodel.Village)(nil), "id = ?", village.ID); n != 0 {
+				t.Errorf("expected the village %d not to be committed", village.ID)
+			}
+
+			// the next update writes the villages
+			if err := newWorker().update(); err != nil {
+				t.Fatal(err)
+			}
+			if after := f.server(t); !after.DataUpdatedAt.After(before.DataUpdatedAt) {
+				t.Errorf("expected data_updated_at to be updated, got %s", after.DataUpdatedAt)
+			}
+			if n := f.count(t, (*twmodel.Village)(nil), "id = ?", village.ID); n != 1 {
+				t.Errorf("expected the village %d to be committed", village.ID)
+			}
+		},
+	},
+	{
+		name: UpdateServerData,
+		test: func(t *testing.T, env *e2eEnv) {
+			f := env.newLoadedFixture(t)
+			tribe := twtest.Tribe{
+				ID:   f.world.NextID(),
+				Name: "New tribe",
+				Tag:  "NEW",
+			}
+			f.world.AddTribe(tribe)
+			env.srv.Tick()
+
+			env.run(t, GetTask(UpdateServerData).WithArgs(context.Background(), f.url(), f.server(t)))
+
+			if n := f.count(t, (*twmodel.Tribe)(nil), "id = ? AND exists = true", tribe.ID); n != 1 {
+				t.Errorf("expected the tribe %d to be added", tribe.ID)
+			}
+			if server := f.server(t); server.NumberOfTribes != len(f.world.Tribes()) {
+				t.Errorf("expected %d tribes, got %d", len(f.world.Tribes()), server.NumberOfTribes)
+			}
+		},
+	},
+	{
+		name: UpdateEnnoblements,
+		test: func(t *testing.T, env *e2eEnv) {
+			f := env.newLoadedFixture(t)
+			villageIDs := f.world.Villages()
+			playerIDs := f.world.Players()
+			villageID := villageIDs[len(villageIDs)-1]
+			newOwnerID := playerIDs[len(playerIDs)-1]
+			f.world.Conquer(villageID, newOwnerID, time.Now().Add(-time.Minute))
+			env.srv.Tick()
+
+			env.run(t, GetTask(UpdateEnnoblements).WithArgs(context.Background()))
+
+			if n := f.count(t, (*twmodel.Ennoblement)(nil), "village_id = ? AND new_owner_id = ?", villageID, newOwnerID); n != 1 {
+				t.Errorf("expected the ennoblement of the village %d to be saved", villageID)
+			}
+		},
+	},
+	{
+		name: UpdateServerEnnoblements,
+		test: func(t *testing.T, env *e2eEnv) {
+			f := env.newLoadedFixture(t)
+			villageIDs := f.world.Villages()
+			playerIDs := f.world.Players()
+			villageID := villageIDs[len(villageIDs)-2]
+			newOwnerID := playerIDs[0]
+			f.world.Conquer(villageID, newOwnerID, time.Now().Add(-30*time.Second))
+			env.srv.Tick()
+
+			env.run(t, GetTask(UpdateServerEnnoblements).WithArgs(context.Background(), f.url(), f.server(t)))
+
+			if n := f.count(t, (*twmodel.Ennoblement)(nil), "village_id = ? AND new_owner_id = ?", villageID, newOwnerID); n != 1 {
+				t.Errorf("expected the ennoblement of the village %d to be saved", villageID)
+			}
+		},
+	},
+	{
+		name: UpdateHistory,
+		test: func(t *testing.T, env *e2eEnv) {
+			f := env.newLoadedFixture(t)
+			// the server has been created today, so its history is considered up to date
+			f.setUpdatedAt(t, "history_updated_at", time.Now().Add(-48*time.Hour))
+
+			env.run(t, GetTask(UpdateHistory).WithArgs(context.Background(), e2eTimezone))
+
+			f.checkHistory(t)
+		},
+	},
+	{
+		name: UpdateServerHistory,
+		test: func(t *testing.T, env *e2eEnv) {
+			f := env.newLoadedFixture(t)
+
+			env.run(t, GetTask(UpdateServerHistory).WithArgs(context.Background(), e2eTimezone, f.server(t)))
+
+			f.checkHistory(t)
+		},
+	},
+	{
+		name: UpdateStats,
+		test: func(t *testing.T, env *e2eEnv) {
+			f := env.newLoadedFixture(t)
+			// the server has been created today, so its stats are considered up to date
+			f.setUpdatedAt(t, "stats_updated_at", time.Now().Add(-48*time.Hour))
+
+			env.run(t, GetTask(UpdateStats).WithArgs(context.Background(), e2eTimezone))
+
+			if n := f.count(t, (*twmodel.ServerStats)(nil), ""); n != 1 {
+				t.Errorf("expected 1 stats record, got %d", n)
+			}
+		},
+	},
+	{
+		name: UpdateServerStats,
+		test: func(t *testing.T, env *e2eEnv) {
+			f := env.newLoadedFixture(t)
+
+			env.run(t, GetTask(UpdateServerStats).WithArgs(context.Background(), e2eTimezone, f.server(t)))
+
+			stats := &twmodel.ServerStats{}
+			if err := f.serverDB().Model(stats).Limit(1).Select(); err != nil {
+				t.Fatalf("expected the stats to be saved: %s", err)
+			}
+			if villages := f.count(t, (*twmodel.Village)(nil), ""); stats.Villages != villages {
+				t.Errorf("expected %d villages in the stats, got %d", villages, stats.Villages)
+			}
+		},
+	},
+	{
+		name: Vacuum,
+		test: func(t *testing.T, env *e2eEnv) {
+			env.newLoadedFixture(t)
+			old := &TaskRun{
+				TaskName:   UpdateEnnoblements,
+				StartedAt:  time.Now().Add(-defaultTaskRunsRetention - time.Hour),
+				FinishedAt: time.Now().Add(-defaultTaskRunsRetention - time.Hour),
+				Outcome:    TaskRunOutcomeSuccess,
+			}
+			if _, err := env.db.Model(old).Insert(); err != nil {
+				t.Fatal(err)
+			}
+
+			env.run(t, GetTask(Vacuum).WithArgs(context.Background()))
+
+			if n, err := env.db.Model(&TaskRun{}).Where("id = ?", old.ID).Count(); err != nil || n != 0 {
+				t.Errorf("expected the run older than the retention period to be deleted (err: %v)", err)
+			}
+		},
+	},
+	{
+		name: VacuumServerData,
+		test: func(t *testing.T, env *e2eEnv) {
+			f := env.newLoadedFixture(t)
+			removed := f.world.Players()[0]
+			f.world.RemovePlayer(removed)
+			env.srv.Tick()
+			f.load(t)
+			env.run(t, GetTask(UpdateServerHistory).WithArgs(context.Background(), e2eTimezone, f.server(t)))
+			// the history of the players deleted more than 14 days ago is removed
+			if _, err := f.serverDB().Model(&twmodel.Player{}).
+				Set("deleted_at = ?", time.Now().Add(-15*day)).
+				Where("id = ?", removed).
+				Update(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.serverDB().Model(&twmodel.PlayerHistory{
+				PlayerID:   removed,
+				CreateDate: time.Now().Add(-20 * day),
+			}).Insert(); err != nil {
+				t.Fatal(err)
+			}
+
+			env.run(t, GetTask(VacuumServerData).WithArgs(context.Background(), f.server(t)))
+
+			if n := f.count(t, (*twmodel.PlayerHistory)(nil), "player_id = ?", removed); n != 0 {
+				t.Errorf("expected the history of the player %d to be deleted, got %d records", removed, n)
+			}
+			players := f.count(t, (*twmodel.Player)(nil), "exists = true")
+			if n := f.count(t, (*twmodel.PlayerHistory)(nil), ""); n != players {
+				t.Errorf("expected the history of the %d players to be kept, got %d records", players, n)
+			}
+		},
+	},
+	{
+		name: DeleteNonExistentVillages,
+		test: func(t *testing.T, env *e2eEnv) {
+			f := env.newLoadedFixture(t)
+			villageIDs := f.world.Villages()
+			removed := villageIDs[0]
+			f.world.RemoveVillage(removed)
+			env.srv.Tick()
+
+			env.run(t, GetTask(DeleteNonExistentVillages).WithArgs(context.Background()))
+
+			if n := f.count(t, (*twmodel.Village)(nil), "id = ?", removed); n != 0 {
+				t.Errorf("expected the village %d to be deleted", removed)
+			}
+			if n := f.count(t, (*twmodel.Village)(nil), ""); n != len(villageIDs)-1 {
+				t.Errorf("expected %d villages, got %d", len(villageIDs)-1, n)
+			}
+		},
+	},
+	{
+		name: ServerDeleteNonExistentVillages,
+		test: func(t *testing.T, env *e2eEnv) {
+			f := env.newLoadedFixture(t)
+			villageIDs := f.world.Villages()
+			removed := villageIDs[len(villageIDs)-1]
+			f.world.RemoveVillage(removed)
+			env.srv.Tick()
+
+			env.run(t, GetTask(ServerDeleteNonExistentVillages).WithArgs(context.Background(), f.url(), f.server(t)))
+
+			if n := f.count(t, (*twmodel.Village)(nil), "id = ?", removed); n != 0 {
+				t.Errorf("expected the village %d to be deleted", removed)
+			}
+		},
+	},
+	{
+		name: "closedServer",
+		test: func(t *testing.T, env *e2eEnv) {
+			f := env.newFixture(t)
+			// the version must have an open server, the task doesn't close the servers of a version without any
+			env.newLoadedFixture(t)
+			env.srv.CloseWorld(f.key)
+			env.srv.Tick()
+
+			f.load(t)
+
+			if server := f.server(t); server.Status != twmodel.ServerStatusClosed {
+				t.Errorf("expected the server to be closed, got %s", server.Status)
+			}
+		},
+	},
+}
+
+func TestE2E(t *testing.T) {
+	names := make(map[string]bool, len(e2eTests))
+	for _, test := range e2eTests {
+		names[test.name] = true
+	}
+	for _, taskName := range TaskNames() {
+		if !names[taskName] {
+			t.Errorf("expected %s to be covered by an end-to-end test", taskName)
+		}
+	}
+
+	env := newE2EEnv(t)
+	for _, test := range e2eTests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, env)
+		})
+	}
+}
+
+func (f *e2eFixture) setUpdatedAt(t *testing.T, column string, at time.Time) {
+	t.Helper()
+	if _, err := f.env.db.Model(&twmodel.Server{}).
+		Set("? = ?", pg.Ident(column), at).
+		Where("key = ?", f.key).
+		Update(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkHistory checks that the history of today has been written for the existing players and tribes.
+func (f *e2eFixture) checkHistory(t *testing.T) {
+	t.Helper()
+	players := f.count(t, (*twmodel.Player)(nil), "exists = true")
+	if n := f.count(t, (*twmodel.PlayerHistory)(nil), ""); n != players {
+		t.Errorf("expected %d player history records, got %d", players, n)
+	}
+	tribes := f.count(t, (*twmodel.Tribe)(nil), "exists = true")
+	if n := f.count(t, (*twmodel.TribeHistory)(nil), ""); n != tribes {
+		t.Errorf("expected %d tribe history records, got %d", tribes, n)
+	}
+}
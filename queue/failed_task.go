@@ -0,0 +1,130 @@
+package queue
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/pkg/errors"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+	"github.com/vmihailenco/taskq/v3"
+)
+
+// FailedTask is a message that has exhausted its retries (a dead letter).
+// The table is created by the postgres package.
+type FailedTask struct {
+	tableName struct{} `pg:"public.failed_tasks,alias:failed_task"`
+
+	ID          int                 `json:"id" pg:",pk"`
+	TaskName    string              `json:"taskName"`
+	ServerKey   string              `json:"serverKey"`
+	VersionCode twmodel.VersionCode `json:"versionCode"`
+	Timezone    string              `json:"timezone"`
+	URL         string              `json:"url"`
+	Args        []byte              `json:"-"`
+	Error       string              `json:"error"`
+	Attempts    int                 `json:"attempts" pg:",use_zero"`
+	FailedAt    time.Time           `json:"failedAt" pg:"default:now(),use_zero"`
+}
+
+func (q *Queue) saveFailedTask(msg *taskq.Message, taskErr error) {
+	args, err := msg.MarshalArgs()
+	if err != nil {
+		log.Warn(errors.Wrapf(err, "Queue.saveFailedTask: %s: Couldn't marshal the args", msg.TaskName))
+	}
+	info := newMessageInfo(msg)
+	failedTask := &FailedTask{
+		TaskName:    msg.TaskName,
+		ServerKey:   info.serverKey(),
+		VersionCode: info.versionCode(),
+		Timezone:    info.timezone,
+		URL:         info.url,
+		Args:        args,
+		Error:       taskErr.Error(),
+		Attempts:    msg.ReservedCount,
+		FailedAt:    time.Now(),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := q.db.ModelContext(ctx, failedTask).Insert(); err != nil {
+		log.
+			WithField("task", msg.TaskName).
+			Error(errors.Wrapf(err, "Queue.saveFailedTask: %s: Couldn't save the failed task", msg.TaskName))
+	}
+}
+
+type FailedTasksFilter struct {
+	TaskName  string
+	ServerKey string
+	Limit     int
+	Offset    int
+}
+
+// FailedTasks returns the failed tasks, the most recent first.
+// It only needs the database, the tasks can be listed without connecting to Redis.
+func FailedTasks(ctx context.Context, db *pg.DB, f *FailedTasksFilter) ([]*FailedTask, int, error) {
+	if f == nil {
+		f = &FailedTasksFilter{}
+	}
+	var failedTasks []*FailedTask
+	query := db.ModelContext(ctx, &failedTasks).Order("failed_at DESC", "id DESC")
+	if f.TaskName != "" {
+		query = query.Where("task_name = ?", f.TaskName)
+	}
+	if f.ServerKey != "" {
+		query = query.Where("server_key = ?", f.ServerKey)
+	}
+	if f.Limit > 0 {
+		query = query.Limit(f.Limit)
+	}
+	if f.Offset > 0 {
+		query = query.Offset(f.Offset)
+	}
+	total, err := query.SelectAndCount()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "couldn't load the failed tasks")
+	}
+	return failedTasks, total, nil
+}
+
+// ReplayFailedTask adds the failed task to the queue again and removes it from the failed tasks.
+// It returns an error and keeps the failed task if the same task for the same subject is already pending or running.
+func (q *Queue) ReplayFailedTask(ctx context.Context, id int) error {
+	failedTask := &FailedTask{}
+	if err := q.db.ModelContext(ctx, failedTask).Where("id = ?", id).Select(); err != nil {
+		return errors.Wrapf(err, "couldn't load the failed task %d", id)
+	}
+	task := GetTask(failedTask.TaskName)
+	if task == nil {
+		return errors.Errorf("failed task %d: unknown task '%s'", id, failedTask.TaskName)
+	}
+	msg := task.WithArgs(ctx)
+	msg.ArgsBin = failedTask.Args
+	args, err := q.decodeArgs(msg)
+	if err != nil {
+		return errors.Wrapf(err, "failed task %d: couldn't decode the args", id)
+	}
+	// the metadata isn't copied, the task starts a new trace and acquires the unique key again
+	msg = task.WithArgs(ctx, args...)
+	ok, err := q.TryAdd(msg)
+	if err != nil {
+		return errors.Wrapf(err, "failed task %d", id)
+	}
+	if !ok {
+		// the failed task is kept, so it can be replayed once the pending one has been processed
+		return errors.Errorf("failed task %d: %s is already pending or running", id, failedTask.TaskName)
+	}
+	return DiscardFailedTask(ctx, q.db, id)
+}
+
+// DiscardFailedTask removes the failed task, like FailedTasks it only needs the database.
+func DiscardFailedTask(ctx context.Context, db *pg.DB, id int) error {
+	result, err := db.ModelContext(ctx, &FailedTask{}).Where("id = ?", id).Delete()
+	if err != nil {
+		return errors.Wrapf(err, "couldn't delete the failed task %d", id)
+	}
+	if result.RowsAffected() == 0 {
+		return errors.Errorf("failed task %d doesn't exist", id)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/taskq/v3"
+)
+
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// wrapHandler decodes the message args before calling the handler,
+// so they're available to the code that runs around the handler (see messageInfo).
+// Each execution is recorded in public.task_runs.
+func (q *Queue) wrapHandler(opts *taskq.TaskOptions) taskq.Handler {
+	q.handlerTypes[opts.Name] = reflect.TypeOf(opts.Handler)
+	h := taskq.NewHandler(opts.Handler)
+	q.handlers[opts.Name] = h
+	return taskq.HandlerFunc(func(msg *taskq.Message) error {
+		if msg.Args == nil {
+			args, err := q.decodeArgs(msg)
+			if err != nil {
+				// no retry can decode them either, the unique key is taken from the metadata
+				q.releaseUniqueKey(msg)
+				return &retryError{
+					err:   errors.Wrapf(err, "couldn't decode the args of the task '%s'", opts.Name),
+					delay: 0,
+				}
+			}
+			msg.Args = args
+		}
+
+		run := newTaskRun(msg)
+		msg.Ctx = contextWithTaskRun(msg.Ctx, run)
+		span := startTaskSpan(msg)
+		start := time.Now()
+		err := h.HandleMessage(msg)
+		endSpan(span, err)
+		if err == nil {
+			observeTaskExecution(opts.Name, TaskRunOutcomeSuccess, start)
+			if q.sampleTaskRun(run) {
+				q.saveTaskRun(run, TaskRunOutcomeSuccess, nil)
+			}
+			q.releaseUniqueKey(msg)
+			return nil
+		}
+		if isRejectedData(err) {
+			observeTaskExecution(opts.Name, TaskRunOutcomeRejected, start)
+			q.saveTaskRun(run, TaskRunOutcomeRejected, err)
+			q.releaseUniqueKey(msg)
+			return nil
+		}
+
+		policy := q.retryPolicies[opts.Name]
+		if policy.shouldRetry(err, msg.ReservedCount) {
+			observeTaskExecution(opts.Name, TaskRunOutcomeRetry, start)
+			taskRetriesTotal.WithLabelValues(opts.Name).Inc()
+			q.saveTaskRun(run, TaskRunOutcomeRetry, err)
+			return &retryError{
+				err:   err,
+				delay: policy.backoff(msg.ReservedCount),
+			}
+		}
+		observeTaskExecution(opts.Name, TaskRunOutcomeFailed, start)
+		q.saveTaskRun(run, TaskRunOutcomeFailed, err)
+		q.releaseUniqueKey(msg)
+		q.saveFailedTask(msg, err)
+		return &retryError{
+			err:   err,
+			delay: 0,
+		}
+	})
+}
+
+func observeTaskExecution(taskName, outcome string, start time.Time) {
+	taskExecutionsTotal.WithLabelValues(taskName, outcome).Inc()
+	taskDurationSeconds.WithLabelValues(taskName, outcome).Observe(time.Since(start).Seconds())
+}
+
+// decodeArgs decodes the args of the message into the types expected by the handler of its task.
+func (q *Queue) decodeArgs(msg *taskq.Message) ([]interface{}, error) {
+	fnType, ok := q.handlerTypes[msg.TaskName]
+	if !ok {
+		return nil, errors.Errorf("unknown task '%s'", msg.TaskName)
+	}
+	return decodeArgs(fnType, msg)
+}
+
+func decodeArgs(fnType reflect.Type, msg *taskq.Message) ([]interface{}, error) {
+	b, err := msg.MarshalArgs()
+	if err != nil {
+		return nil, err
+	}
+	dec := msgpack.NewDecoder(bytes.NewBuffer(b))
+	n, err := dec.DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	inStart := 0
+	if fnType.NumIn() > 0 && fnType.In(0).Implements(contextType) {
+		inStart = 1
+	}
+	if n == -1 {
+		n = 0
+	}
+	if n != fnType.NumIn()-inStart {
+		return nil, errors.Errorf("got %d args, wanted %d", n, fnType.NumIn()-inStart)
+	}
+	args := make([]interface{}, n)
+	for i := 0; i < n; i++ {
+		arg := reflect.New(fnType.In(inStart + i)).Elem()
+		if err := dec.DecodeValue(arg); err != nil {
+			return nil, errors.Wrapf(err, "couldn't decode the arg %d", i)
+		}
+		args[i] = arg.Interface()
+	}
+	return args, nil
+}
+
+// messageInfo describes what the message is about, based on its args.
+type messageInfo struct {
+	server   *twmodel.Server
+	version  *twmodel.Version
+	timezone string
+	url      string
+}
+
+func newMessageInfo(msg *taskq.Message) messageInfo {
+	info := messageInfo{}
+	for _, arg := range msg.Args {
+		switch v := arg.(type) {
+		case *twmodel.Server:
+			info.server = v
+		case *twmodel.Version:
+			info.version = v
+		}
+	}
+	switch msg.TaskName {
+	case UpdateHistory, UpdateServerHistory, UpdateStats, UpdateServerStats:
+		if len(msg.Args) > 0 {
+			info.timezone, _ = msg.Args[0].(string)
+		}
+	case UpdateServerData, UpdateServerEnnoblements, ServerDeleteNonExistentVillages:
+		if len(msg.Args) > 0 {
+			info.url, _ = msg.Args[0].(string)
+		}
+	}
+	return info
+}
+
+func (info messageInfo) serverKey() string {
+	if info.server == nil {
+		return ""
+	}
+	return info.server.Key
+}
+
+func (info messageInfo) versionCode() twmodel.VersionCode {
+	if info.version != nil {
+		return info.version.Code
+	}
+	if info.server != nil {
+		return info.server.VersionCode
+	}
+	return ""
+}
+
+// key identifies the subject of the message, e.g. "server:pl170", "version:pl" or "timezone:Europe/Warsaw".
+func (info messageInfo) key() string {
+	switch {
+	case info.server != nil:
+		return "server:" + info.server.Key
+	case info.version != nil:
+		return "version:" + info.version.Code.String()
+	case info.timezone != "":
+		return "timezone:" + info.timezone
+	}
+	return ""
+}
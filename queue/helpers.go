@@ -1,9 +1,7 @@
 package queue
 
 import (
-	"github.com/tribalwarshelp/shared/tw/twdataloader"
 	"github.com/tribalwarshelp/shared/tw/twmodel"
-	"net/http"
 	"time"
 )
 
@@ -32,19 +30,6 @@ func calcPlayerDailyGrowth(diffInDays, points int) int {
 	return 0
 }
 
-func newHTTPClient() *http.Client {
-	return &http.Client{
-		Timeout: 10 * time.Second,
-	}
-}
-
-func newServerDataLoader(url string) *twdataloader.ServerDataLoader {
-	return twdataloader.NewServerDataLoader(&twdataloader.ServerDataLoaderConfig{
-		BaseURL: url,
-		Client:  newHTTPClient(),
-	})
-}
-
 type playersSearchableByID struct {
 	players []*twmodel.Player
 }
@@ -0,0 +1,320 @@
+package queue
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/go-redis/redis_rate/v9"
+	"github.com/pkg/errors"
+	"github.com/tribalwarshelp/shared/tw/twdataloader"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+)
+
+const (
+	defaultHTTPTimeout  = 10 * time.Second
+	rateLimitKeyPrefix  = "twhelp:queue:rate_limit:"
+	rateLimitMaxWaiting = 5 * time.Minute
+)
+
+// newHTTPClient returns a client for the given version host (e.g. plemiona.pl),
+// the requests sent by all workers to the same host share the rate limit.
+// The requests are cancelled together with ctx and their spans are children of the span in ctx.
+func (t *task) newHTTPClient(ctx context.Context, host string) *http.Client {
+	var transport http.RoundTripper = &nonRetryableStatusTransport{&metricsTransport{
+		next: t.httpTransport,
+		host: host,
+	}}
+	if t.httpConfig.UserAgent != "" {
+		transport = &userAgentTransport{
+			next:      transport,
+			userAgent: t.httpConfig.UserAgent,
+		}
+	}
+	timeout := t.httpConfig.Timeout
+	if timeout <= 0 {
+		timeout = defaultHTTPTimeout
+	}
+	transport = &timeoutTransport{
+		next:    transport,
+		timeout: timeout,
+	}
+	if t.rateLimiter != nil {
+		transport = &rateLimitedTransport{
+			next:    transport,
+			limiter: t.rateLimiter,
+			host:    host,
+		}
+	}
+	return &http.Client{
+		Transport: &contextTransport{
+			next: &tracingTransport{
+				next: transport,
+				ctx:  ctx,
+			},
+			ctx: ctx,
+		},
+	}
+}
+
+func (t *task) newServerDataLoader(
+	ctx context.Context,
+	url string,
+	server *twmodel.Server,
+) *twdataloader.ServerDataLoader {
+	return twdataloader.NewServerDataLoader(&twdataloader.ServerDataLoaderConfig{
+		BaseURL: url,
+		Client:  t.newHTTPClient(ctx, versionHost(url, server)),
+	})
+}
+
+// versionHost returns the host of the version the server belongs to, e.g. pl170.plemiona.pl => plemiona.pl.
+func versionHost(serverURL string, server *twmodel.Server) string {
+	if server.Version != nil && server.Version.Host != "" {
+		return server.Version.Host
+	}
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return serverURL
+	}
+	return strings.TrimPrefix(u.Hostname(), server.Key+".")
+}
+
+// newHTTPTransport returns the transport shared by all data loaders.
+func newHTTPTransport(cfg *HTTPConfig) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.ProxyURL != "" {
+		proxyURL, err := url.Parse(cfg.ProxyURL)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid proxy url")
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	if cfg.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	}
+	transport.DisableCompression = cfg.DisableCompression
+	if cfg.TLSCAFile != "" || cfg.TLSInsecureSkipVerify {
+		tlsCfg := &tls.Config{
+			InsecureSkipVerify: cfg.TLSInsecureSkipVerify,
+		}
+		if cfg.TLSCAFile != "" {
+			pem, err := ioutil.ReadFile(cfg.TLSCAFile)
+			if err != nil {
+				return nil, errors.Wrap(err, "couldn't read the CA file")
+			}
+			pool, err := x509.SystemCertPool()
+			if err != nil || pool == nil {
+				pool = x509.NewCertPool()
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, errors.Errorf("no certificates found in '%s'", cfg.TLSCAFile)
+			}
+			tlsCfg.RootCAs = pool
+		}
+		transport.TLSClientConfig = tlsCfg
+	}
+	return transport, nil
+}
+
+// contextTransport cancels the requests together with ctx, the data loaders send them without a context.
+// It allows to cancel the remaining downloads of an update once one of them has failed (see newDownloadGroup).
+// The context of the request (e.g. its deadline) still applies.
+type contextTransport struct {
+	next http.RoundTripper
+	ctx  context.Context
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.ctx == nil {
+		return t.next.RoundTrip(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-t.ctx.Done():
+			cancel()
+		case <-done:
+		}
+	}()
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(done)
+			cancel()
+		})
+	}
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	resp.Body = &cancelOnCloseBody{
+		ReadCloser: resp.Body,
+		cancel:     stop,
+	}
+	return resp, nil
+}
+
+type userAgentTransport struct {
+	next      http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.next.RoundTrip(req)
+}
+
+// nonRetryableStatusTransport turns the responses that won't change on retry
+// (e.g. 404 when the world has been closed) into errors marked with NonRetryable.
+type nonRetryableStatusTransport struct {
+	next http.RoundTripper
+}
+
+func (t *nonRetryableStatusTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusGone:
+		_ = resp.Body.Close()
+		return nil, NonRetryable(errors.Errorf("%s responded with %s", req.URL.String(), resp.Status))
+	}
+	return resp, nil
+}
+
+// timeoutTransport limits the time of a single request, including reading the body.
+// Unlike http.Client.Timeout, it doesn't include the time spent waiting for the rate limiter.
+type timeoutTransport struct {
+	next    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnCloseBody{
+		ReadCloser: resp.Body,
+		cancel:     cancel,
+	}
+	return resp, nil
+}
+
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnCloseBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// hostRateLimiter limits the number of requests per second sent to the given host by all workers together.
+// Without Redis (BackendMemory), the limit applies to the workers of the current process.
+type hostRateLimiter struct {
+	limiter *redis_rate.Limiter
+	limit   redis_rate.Limit
+	memory  *memoryRateLimiter
+}
+
+func newHostRateLimiter(client redis.UniversalClient, requestsPerSecond int) *hostRateLimiter {
+	if requestsPerSecond <= 0 {
+		return nil
+	}
+	if client == nil {
+		return &hostRateLimiter{
+			memory: newMemoryRateLimiter(requestsPerSecond),
+		}
+	}
+	return &hostRateLimiter{
+		limiter: redis_rate.NewLimiter(client),
+		limit:   redis_rate.PerSecond(requestsPerSecond),
+	}
+}
+
+// allow returns 0 if the request can be sent, otherwise how long to wait before trying again.
+func (l *hostRateLimiter) allow(ctx context.Context, host string) (time.Duration, error) {
+	if l.memory != nil {
+		return l.memory.allow(host), nil
+	}
+	res, err := l.limiter.Allow(ctx, rateLimitKeyPrefix+host, l.limit)
+	if err != nil {
+		return 0, err
+	}
+	if res.Allowed > 0 {
+		return 0, nil
+	}
+	return res.RetryAfter, nil
+}
+
+func (l *hostRateLimiter) wait(ctx context.Context, host string) error {
+	ctx, cancel := context.WithTimeout(ctx, rateLimitMaxWaiting)
+	defer cancel()
+	for {
+		retryAfter, err := l.allow(ctx, host)
+		if err != nil {
+			// Redis is unavailable, don't block the update because of that
+			log.WithField("host", host).Warn(errors.Wrap(err, "hostRateLimiter.wait: Couldn't check the rate limit"))
+			return nil
+		}
+		if retryAfter <= 0 {
+			return nil
+		}
+		timer := time.NewTimer(retryAfter)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Wrapf(ctx.Err(), "rate limit of the host '%s' exceeded", host)
+		case <-timer.C:
+		}
+	}
+}
+
+type rateLimitedTransport struct {
+	next    http.RoundTripper
+	limiter *hostRateLimiter
+	host    string
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter.wait(req.Context(), t.host); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
+
+// metricsTransport reports the number of requests to the given host and their latency.
+type metricsTransport struct {
+	next http.RoundTripper
+	host string
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	httpRequestDurationSeconds.WithLabelValues(t.host).Observe(time.Since(start).Seconds())
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	httpRequestsTotal.WithLabelValues(t.host, status).Inc()
+	return resp, err
+}
@@ -0,0 +1,77 @@
+package queue
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestContextTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	t.Run("cancelled with ctx", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		client := &http.Client{
+			Transport: &contextTransport{
+				next: http.DefaultTransport,
+				ctx:  ctx,
+			},
+		}
+		time.AfterFunc(50*time.Millisecond, cancel)
+		start := time.Now()
+		if _, err := client.Get(srv.URL); err == nil {
+			t.Fatal("expected the request to be cancelled")
+		}
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("expected the request to be cancelled together with ctx, it took %s", d)
+		}
+	})
+
+	t.Run("deadline of the request", func(t *testing.T) {
+		client := &http.Client{
+			Transport: &contextTransport{
+				next: http.DefaultTransport,
+				ctx:  context.Background(),
+			},
+			Timeout: 50 * time.Millisecond,
+		}
+		start := time.Now()
+		if _, err := client.Get(srv.URL); err == nil {
+			t.Fatal("expected the request to time out")
+		}
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("expected the timeout of the client to be kept, it took %s", d)
+		}
+	})
+
+	t.Run("body read after the request", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		}))
+		defer srv.Close()
+		client := &http.Client{
+			Transport: &contextTransport{
+				next: http.DefaultTransport,
+				ctx:  context.Background(),
+			},
+		}
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil || string(b) != "ok" {
+			t.Errorf("expected the body to be read, got '%s' (err: %v)", b, err)
+		}
+	})
+}
@@ -0,0 +1,132 @@
+package queue
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// memoryKeys replaces the Redis keys used by the unique keys and the server locks when the queue runs with BackendMemory.
+// The keys are visible only to the current process, which is enough since the messages don't leave it either.
+type memoryKeys struct {
+	mu   sync.Mutex
+	keys map[string]memoryKey
+}
+
+type memoryKey struct {
+	value     string
+	expiresAt time.Time
+}
+
+func newMemoryKeys() *memoryKeys {
+	return &memoryKeys{
+		keys: make(map[string]memoryKey),
+	}
+}
+
+// getLocked returns the value of the key, the expired keys are deleted.
+func (m *memoryKeys) getLocked(key string) (string, bool) {
+	k, ok := m.keys[key]
+	if !ok {
+		return "", false
+	}
+	if !k.expiresAt.After(time.Now()) {
+		delete(m.keys, key)
+		return "", false
+	}
+	return k.value, true
+}
+
+// setNX sets the key unless it's already set, like SET key value NX PX ttl.
+func (m *memoryKeys) setNX(key, value string, ttl time.Duration) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.getLocked(key); ok {
+		return false
+	}
+	m.keys[key] = memoryKey{
+		value:     value,
+		expiresAt: time.Now().Add(ttl),
+	}
+	return true
+}
+
+func (m *memoryKeys) del(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.keys, key)
+}
+
+// incr increments the counter stored in the key and sets its ttl, like INCR key + EXPIRE key ttl.
+func (m *memoryKeys) incr(key string, ttl time.Duration) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current, _ := m.getLocked(key)
+	n, _ := strconv.Atoi(current)
+	n++
+	m.keys[key] = memoryKey{
+		value:     strconv.Itoa(n),
+		expiresAt: time.Now().Add(ttl),
+	}
+	return n
+}
+
+// expireIfValue extends the ttl of the key as long as it still holds the given value.
+func (m *memoryKeys) expireIfValue(key, value string, ttl time.Duration) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if current, ok := m.getLocked(key); !ok || current != value {
+		return false
+	}
+	m.keys[key] = memoryKey{
+		value:     value,
+		expiresAt: time.Now().Add(ttl),
+	}
+	return true
+}
+
+// delIfValue deletes the key as long as it still holds the given value.
+func (m *memoryKeys) delIfValue(key, value string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if current, ok := m.getLocked(key); !ok || current != value {
+		return false
+	}
+	delete(m.keys, key)
+	return true
+}
+
+// memoryRateLimiter implements the same algorithm (GCRA) as redis_rate for a single process,
+// burst equals the number of requests per second.
+type memoryRateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	burst    time.Duration
+	tat      map[string]time.Time
+}
+
+func newMemoryRateLimiter(requestsPerSecond int) *memoryRateLimiter {
+	interval := time.Second / time.Duration(requestsPerSecond)
+	return &memoryRateLimiter{
+		interval: interval,
+		burst:    interval * time.Duration(requestsPerSecond),
+		tat:      make(map[string]time.Time),
+	}
+}
+
+// allow returns 0 if the request is allowed, otherwise how long the caller should wait before trying again.
+func (l *memoryRateLimiter) allow(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	tat := l.tat[key]
+	if tat.Before(now) {
+		tat = now
+	}
+	newTAT := tat.Add(l.interval)
+	if allowAt := newTAT.Add(-l.burst); allowAt.After(now) {
+		return allowAt.Sub(now)
+	}
+	l.tat[key] = newTAT
+	return 0
+}
@@ -0,0 +1,78 @@
+package queue
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/taskq/v3"
+)
+
+const (
+	// metadataUniqueKey and metadataUniqueToken identify the unique key held by the message, see acquireUniqueKey
+	metadataUniqueKey   = "twhelp-unique-key"
+	metadataUniqueToken = "twhelp-unique-token"
+)
+
+// messageMetadata is encoded after the msgpack array of the args in msg.ArgsBin, so the number of args doesn't change
+// and the consumers that don't know about it (e.g. the workers deployed before it was added) ignore it.
+// It carries the trace context of the code that has added the message (see startEnqueueSpan)
+// and the unique key held by the message (see acquireUniqueKey).
+type messageMetadata map[string]string
+
+// messageMetadataOf returns the metadata of the message, an empty map if it has none.
+func messageMetadataOf(msg *taskq.Message) messageMetadata {
+	if msg.ArgsBin == nil || msg.ArgsCompression != "" {
+		return messageMetadata{}
+	}
+	md, _, err := readMessageMetadata(msg.ArgsBin)
+	if err != nil || md == nil {
+		return messageMetadata{}
+	}
+	return md
+}
+
+// setMessageMetadata adds the values to the metadata of the message.
+func setMessageMetadata(msg *taskq.Message, values map[string]string) error {
+	if msg.ArgsCompression != "" {
+		return errors.New("the args are compressed")
+	}
+	b, err := msg.MarshalArgs()
+	if err != nil {
+		return err
+	}
+	md, argsLen, err := readMessageMetadata(b)
+	if err != nil {
+		return err
+	}
+	if md == nil {
+		md = make(messageMetadata, len(values))
+	}
+	for k, v := range values {
+		md[k] = v
+	}
+	encoded, err := msgpack.Marshal(md)
+	if err != nil {
+		return err
+	}
+	msg.ArgsBin = append(b[:argsLen:argsLen], encoded...)
+	return nil
+}
+
+// readMessageMetadata decodes the metadata encoded after the args, it returns nil if there is none.
+// argsLen is the length of the encoded args without the metadata.
+func readMessageMetadata(b []byte) (md messageMetadata, argsLen int, err error) {
+	r := bytes.NewReader(b)
+	dec := msgpack.NewDecoder(r)
+	if err := dec.Skip(); err != nil {
+		return nil, 0, errors.Wrap(err, "couldn't decode the args")
+	}
+	argsLen = len(b) - r.Len()
+	if r.Len() == 0 {
+		return nil, argsLen, nil
+	}
+	if err := dec.Decode(&md); err != nil {
+		return nil, argsLen, errors.Wrap(err, "couldn't decode the metadata")
+	}
+	return md, argsLen, nil
+}
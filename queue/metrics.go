@@ -0,0 +1,177 @@
+package queue
+
+import (
+	"context"
+
+	"github.com/go-pg/pg/v10/orm"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/vmihailenco/taskq/v3"
+)
+
+const (
+	metricsNamespace = "twhelp"
+	metricsSubsystem = "queue"
+)
+
+var (
+	serverLockContentionTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "server_lock_contention_total",
+		Help:      "Number of times a task had to wait for the lock of a server held by another task.",
+	}, []string{"task"})
+	serverLockTimeoutsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "server_lock_timeouts_total",
+		Help:      "Number of times a task gave up waiting for the lock of a server.",
+	}, []string{"task"})
+	serverLockWaitSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "server_lock_wait_seconds",
+		Help:      "Time spent waiting for the lock of a server held by another task.",
+		Buckets:   []float64{0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"task"})
+)
+
+var (
+	taskExecutionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "task_executions_total",
+		Help:      "Number of task executions by outcome: success, retry (failed, will be retried) or failed (failed permanently).",
+	}, []string{"task", "outcome"})
+	taskDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "task_duration_seconds",
+		Help:      "Duration of the task executions.",
+		Buckets:   []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"task", "outcome"})
+	taskRetriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "task_retries_total",
+		Help:      "Number of retries scheduled after a failed execution.",
+	}, []string{"task"})
+	rowsUpsertedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "rows_upserted_total",
+		Help:      "Number of rows inserted or updated by the tasks, by entity (table).",
+	}, []string{"entity"})
+	rowsUnchangedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "rows_unchanged_total",
+		Help:      "Number of rows skipped by the upserts because they haven't changed, by entity (table).",
+	}, []string{"entity"})
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "http_requests_total",
+		Help:      "Number of requests sent to the game hosts by status code, 'error' if no response has been received.",
+	}, []string{"host", "status"})
+	httpRequestDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time until the response headers from the game hosts have been received, the rate limit isn't included.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"host"})
+)
+
+var (
+	serverDataUpdatedTimestamp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "server_data_updated_timestamp_seconds",
+		Help:      "Time of the last successful update of the server data (data_updated_at) made by this process.",
+	}, []string{"server"})
+	serverHistoryUpdatedTimestamp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "server_history_updated_timestamp_seconds",
+		Help:      "Time of the last successful update of the server history (history_updated_at) made by this process.",
+	}, []string{"server"})
+	serverStatsUpdatedTimestamp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "server_stats_updated_timestamp_seconds",
+		Help:      "Time of the last successful update of the server stats (stats_updated_at) made by this process.",
+	}, []string{"server"})
+)
+
+// rowsUpserted counts the rows written in a transaction by entity, they're reported once it has been committed.
+type rowsUpserted struct {
+	written map[string]int
+	// unchanged are the rows skipped by the upserts (see upsert)
+	unchanged map[string]int
+}
+
+func newRowsUpserted() *rowsUpserted {
+	return &rowsUpserted{
+		written:   make(map[string]int),
+		unchanged: make(map[string]int),
+	}
+}
+
+func (r *rowsUpserted) add(entity string, res orm.Result) {
+	if res != nil {
+		r.written[entity] += res.RowsAffected()
+	}
+}
+
+// addUpsert adds the result of execUpsert, n is the number of upserted rows.
+func (r *rowsUpserted) addUpsert(entity string, res orm.Result, n int) {
+	r.add(entity, res)
+	if res != nil && n > res.RowsAffected() {
+		r.unchanged[entity] += n - res.RowsAffected()
+	}
+}
+
+// report adds the rows to the metrics and to the task run the context has been created for (see TaskRun).
+func (r *rowsUpserted) report(ctx context.Context) {
+	for entity, n := range r.written {
+		rowsUpsertedTotal.WithLabelValues(entity).Add(float64(n))
+	}
+	for entity, n := range r.unchanged {
+		rowsUnchangedTotal.WithLabelValues(entity).Add(float64(n))
+	}
+	if run := taskRunFromContext(ctx); run != nil && (len(r.written) > 0 || len(r.unchanged) > 0) {
+		run.addRows(r)
+	}
+}
+
+// queueDepthCollector reports the number of pending messages in each taskq queue at the time of scraping.
+type queueDepthCollector struct {
+	queues []taskq.Queue
+	desc   *prometheus.Desc
+}
+
+func newQueueDepthCollector(queues ...taskq.Queue) *queueDepthCollector {
+	return &queueDepthCollector{
+		queues: queues,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "depth"),
+			"Number of messages waiting in the queue.",
+			[]string{"queue"},
+			nil,
+		),
+	}
+}
+
+func (c *queueDepthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *queueDepthCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, queue := range c.queues {
+		n, err := queue.Len()
+		if err != nil {
+			log.WithField("queue", queue.Name()).Warn(errors.Wrapf(err, "queueDepthCollector.Collect: %s", queue.Name()))
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(n), queue.Name())
+	}
+}
@@ -4,20 +4,50 @@ import (
 	"context"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"reflect"
+	"sync"
 	"time"
 
+	"github.com/go-pg/pg/v10"
 	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/vmihailenco/taskq/v3"
+	"github.com/vmihailenco/taskq/v3/memqueue"
 	"github.com/vmihailenco/taskq/v3/redisq"
 )
 
 var log = logrus.WithField("package", "pkg/queue")
 
+// Backend determines where the messages are stored.
+type Backend string
+
+const (
+	// BackendRedis shares the messages between all processes connected to the same Redis
+	BackendRedis Backend = "redis"
+	// BackendMemory keeps the messages in the memory of the process that adds them, they're processed by the same
+	// process and lost on exit. The unique keys, the server locks and the rate limits are kept in memory as well.
+	// It's meant for the tests and the installations running the cron and the workers in a single process.
+	BackendMemory Backend = "memory"
+)
+
 type Queue struct {
-	redis        redis.UniversalClient
-	main         taskq.Queue
-	ennoblements taskq.Queue
-	factory      taskq.Factory
+	backend       Backend
+	redis         redis.UniversalClient
+	memoryKeys    *memoryKeys
+	db            *pg.DB
+	uniqueFor     map[string]time.Duration
+	retryPolicies map[string]RetryPolicy
+	handlerTypes  map[string]reflect.Type
+	handlers      map[string]taskq.Handler
+	main          taskq.Queue
+	ennoblements  taskq.Queue
+	factory       taskq.Factory
+
+	// taskRunsSampling holds defaultTaskRunsSampling merged with the config,
+	// taskRunsSampled counts the successful runs by task and server (see sampleTaskRun)
+	taskRunsSampling  map[string]int
+	taskRunsSampledMu sync.Mutex
+	taskRunsSampled   map[string]int
 }
 
 func New(cfg *Config) (*Queue, error) {
@@ -26,7 +56,36 @@ func New(cfg *Config) (*Queue, error) {
 	}
 
 	q := &Queue{
-		redis: cfg.Redis,
+		backend:       BackendRedis,
+		redis:         cfg.Redis,
+		db:            cfg.DB,
+		uniqueFor:     make(map[string]time.Duration),
+		retryPolicies: make(map[string]RetryPolicy),
+		handlerTypes:  make(map[string]reflect.Type),
+		handlers:      make(map[string]taskq.Handler),
+
+		taskRunsSampling: make(map[string]int),
+		taskRunsSampled:  make(map[string]int),
+	}
+	if cfg.Backend == BackendMemory {
+		q.backend = BackendMemory
+		q.redis = nil
+		q.memoryKeys = newMemoryKeys()
+	}
+	for taskName, period := range defaultUniqueFor {
+		q.uniqueFor[taskName] = period
+	}
+	for taskName, period := range cfg.UniqueFor {
+		q.uniqueFor[taskName] = period
+	}
+	for taskName, every := range defaultTaskRunsSampling {
+		q.taskRunsSampling[taskName] = every
+	}
+	for taskName, every := range cfg.TaskRunsSampling {
+		q.taskRunsSampling[taskName] = every
+	}
+	for _, taskName := range TaskNames() {
+		q.retryPolicies[taskName] = cfg.RetryPolicies[taskName].withDefaults(defaultRetryPolicy)
 	}
 
 	if err := q.init(cfg); err != nil {
@@ -37,13 +96,35 @@ func New(cfg *Config) (*Queue, error) {
 }
 
 func (q *Queue) init(cfg *Config) error {
-	q.factory = redisq.NewFactory()
+	if q.backend == BackendMemory {
+		q.factory = memqueue.NewFactory()
+	} else {
+		q.factory = redisq.NewFactory()
+	}
 	q.main = q.registerQueue("main", cfg.WorkerLimit)
 	q.ennoblements = q.registerQueue("ennoblements", cfg.WorkerLimit)
+	if err := prometheus.Register(newQueueDepthCollector(q.main, q.ennoblements)); err != nil {
+		log.Warn(errors.Wrap(err, "Queue.init: Couldn't register the queue depth metric"))
+	}
 
 	if err := registerTasks(&registerTasksConfig{
-		DB:    cfg.DB,
-		Queue: q,
+		DB:             cfg.DB,
+		Queue:          q,
+		ServerLockWait: cfg.ServerLockWait,
+		ServerLockTTL:  cfg.ServerLockTTL,
+
+		RequestsPerSecondPerHost:    cfg.RequestsPerSecondPerHost,
+		HTTP:                        cfg.HTTP,
+		Archive:                     cfg.Archive,
+		TaskRunsRetention:           cfg.TaskRunsRetention,
+		BulkThreshold:               cfg.BulkThreshold,
+		TxTimeout:                   cfg.TxTimeout,
+		TxTimeoutPerThousandRows:    cfg.TxTimeoutPerThousandRows,
+		ChunkedCommits:              cfg.ChunkedCommits,
+		MaxCountDropPercent:         cfg.MaxCountDropPercent,
+		AcceptCountDropAfter:        cfg.AcceptCountDropAfter,
+		MaxUnknownReferencesPercent: cfg.MaxUnknownReferencesPercent,
+		DownloadConcurrency:         cfg.DownloadConcurrency,
 	}); err != nil {
 		return errors.Wrapf(err, "couldn't register tasks")
 	}
@@ -82,7 +163,12 @@ func (q *Queue) getQueueByTaskName(name string) taskq.Queue {
 	return nil
 }
 
+// Start starts the workers. With BackendMemory, the workers have already been started by New,
+// so Start is a no-op.
 func (q *Queue) Start(ctx context.Context) error {
+	if q.backend == BackendMemory {
+		return nil
+	}
 	if err := q.factory.StartConsumers(ctx); err != nil {
 		return errors.Wrap(err, "couldn't start the queue")
 	}
@@ -97,12 +183,33 @@ func (q *Queue) Close() error {
 }
 
 func (q *Queue) Add(msg *taskq.Message) error {
+	_, err := q.TryAdd(msg)
+	return err
+}
+
+// TryAdd is like Add, but it also reports whether the message has been added,
+// it hasn't if the same task for the same subject is already pending or running.
+func (q *Queue) TryAdd(msg *taskq.Message) (bool, error) {
 	queue := q.getQueueByTaskName(msg.TaskName)
 	if queue == nil {
-		return errors.Errorf("couldn't add the message to the queue: unknown task name '%s'", msg.TaskName)
+		return false, errors.Errorf("couldn't add the message to the queue: unknown task name '%s'", msg.TaskName)
+	}
+	ok, err := q.acquireUniqueKey(msg)
+	if err != nil {
+		return false, errors.Wrap(err, "couldn't add the message to the queue")
 	}
+	if !ok {
+		log.
+			WithField("task", msg.TaskName).
+			Debugf("Queue.Add: %s: %s is already pending or running, skipping", msg.TaskName, newMessageInfo(msg).key())
+		return false, nil
+	}
+	span := startEnqueueSpan(msg)
 	if err := queue.Add(msg); err != nil {
-		return errors.Wrap(err, "couldn't add the message to the queue")
+		endSpan(span, err)
+		q.releaseUniqueKey(msg)
+		return false, errors.Wrap(err, "couldn't add the message to the queue")
 	}
-	return nil
+	span.End()
+	return true, nil
 }
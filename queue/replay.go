@@ -0,0 +1,261 @@
+package queue
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/pkg/errors"
+	"github.com/tribalwarshelp/shared/tw/twdataloader"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+
+	"github.com/tribalwarshelp/dataupdater/archive"
+	"github.com/tribalwarshelp/dataupdater/postgres"
+)
+
+const (
+	defaultReplayHistoryAt = time.Hour + 30*time.Minute
+	defaultReplayStatsAt   = time.Hour + 45*time.Minute
+)
+
+// replayResetTables are the tables rebuilt by the replay, the ennoblements aren't archived, so they're kept.
+var replayResetTables = []string{
+	"?SERVER.tribe_changes",
+	"?SERVER.daily_player_stats",
+	"?SERVER.daily_tribe_stats",
+	"?SERVER.player_history",
+	"?SERVER.tribe_history",
+	"?SERVER.stats",
+	"?SERVER.villages",
+	"?SERVER.players",
+	"?SERVER.tribes",
+}
+
+type ReplayConfig struct {
+	DB        *pg.DB
+	Archive   *archive.Archive
+	ServerKey string
+	// From and To limit the replayed snapshots, zero values mean no limit
+	From time.Time
+	To   time.Time
+	// HistoryAt and StatsAt are the times of day (in the timezone of the version) at which
+	// the history and stats are updated, by default 1:30 and 1:45 like in the default cron schedule.
+	HistoryAt time.Duration
+	StatsAt   time.Duration
+	// Reset truncates the tables rebuilt by the replay before the first snapshot is replayed
+	Reset bool
+}
+
+type ReplayResult struct {
+	Snapshots       int
+	FailedSnapshots int
+	HistoryUpdates  int
+	StatsUpdates    int
+}
+
+func validateReplayConfig(cfg *ReplayConfig) error {
+	if cfg == nil || cfg.DB == nil {
+		return errors.New("cfg.DB is required")
+	}
+	if cfg.Archive == nil {
+		return errors.New("cfg.Archive is required")
+	}
+	if cfg.ServerKey == "" {
+		return errors.New("cfg.ServerKey is required")
+	}
+	if cfg.HistoryAt < 0 || cfg.HistoryAt >= 24*time.Hour {
+		return errors.New("cfg.HistoryAt must be between 0 and 24h")
+	}
+	if cfg.StatsAt < 0 || cfg.StatsAt >= 24*time.Hour {
+		return errors.New("cfg.StatsAt must be between 0 and 24h")
+	}
+	return nil
+}
+
+type replayEvent struct {
+	at       time.Time
+	taskName string
+	snapshot *archive.Object
+}
+
+// Replay feeds the archived snapshots of the server through the same workers as updateServerData,
+// updateServerHistory and updateServerStats in chronological order. The clock of the workers is simulated,
+// so every snapshot is saved as if it had been downloaded at the time it was taken, and the history and stats
+// are updated once a day between the snapshots, like the cron does.
+// The server must not be updated by the workers at the same time.
+func Replay(ctx context.Context, cfg *ReplayConfig) (*ReplayResult, error) {
+	if err := validateReplayConfig(cfg); err != nil {
+		return nil, err
+	}
+	historyAt := cfg.HistoryAt
+	if historyAt == 0 {
+		historyAt = defaultReplayHistoryAt
+	}
+	statsAt := cfg.StatsAt
+	if statsAt == 0 {
+		statsAt = defaultReplayStatsAt
+	}
+
+	server := &twmodel.Server{}
+	if err := cfg.DB.Model(server).Where("server.key = ?", cfg.ServerKey).Relation("Version").Select(); err != nil {
+		return nil, errors.Wrapf(err, "couldn't load the server '%s'", cfg.ServerKey)
+	}
+	location, err := time.LoadLocation(server.Version.Timezone)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't load location for the timezone '%s'", server.Version.Timezone)
+	}
+	if err := postgres.CreateServerSchema(cfg.DB, server); err != nil {
+		return nil, errors.Wrap(err, "couldn't create the schema")
+	}
+	db := cfg.DB.WithParam("SERVER", pg.Safe(server.Key))
+
+	objects, err := cfg.Archive.Snapshots(ctx, server.Key)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]replayEvent, 0, len(objects))
+	for i := range objects {
+		obj := &objects[i]
+		if (!cfg.From.IsZero() && obj.TakenAt.Before(cfg.From)) || (!cfg.To.IsZero() && obj.TakenAt.After(cfg.To)) {
+			continue
+		}
+		events = append(events, replayEvent{
+			at:       obj.TakenAt,
+			taskName: UpdateServerData,
+			snapshot: obj,
+		})
+	}
+	if len(events) == 0 {
+		return nil, errors.Errorf("no snapshots of the server '%s' found", server.Key)
+	}
+	end := events[len(events)-1].at
+	if !cfg.To.IsZero() {
+		end = cfg.To
+	}
+	events = append(events, dailyReplayEvents(UpdateServerHistory, events[0].at, end, historyAt, location)...)
+	events = append(events, dailyReplayEvents(UpdateServerStats, events[0].at, end, statsAt, location)...)
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].at.Before(events[j].at)
+	})
+
+	if cfg.Reset {
+		if err := resetReplayTables(ctx, db); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &ReplayResult{}
+	entry := log.WithField("key", server.Key)
+	for _, event := range events {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		now := event.at
+		clock := func() time.Time {
+			return now
+		}
+		switch event.taskName {
+		case UpdateServerData:
+			result.Snapshots++
+			if err := replaySnapshot(ctx, cfg.Archive, db, server, event.snapshot, clock); err != nil {
+				// the same happens to a failed update, the next snapshot overwrites the data
+				result.FailedSnapshots++
+				entry.Warn(errors.Wrapf(err, "Replay: %s: Couldn't replay the snapshot '%s'", server.Key, event.snapshot.Key))
+				continue
+			}
+			entry.Debugf("Replay: %s: The snapshot '%s' has been replayed", server.Key, event.snapshot.Key)
+		case UpdateServerHistory:
+			err := (&workerUpdateServerHistory{
+				db:       db,
+				server:   server,
+				location: location,
+				now:      clock,
+			}).update()
+			if err != nil {
+				return result, errors.Wrapf(err, "couldn't update the history at %s", now)
+			}
+			result.HistoryUpdates++
+		case UpdateServerStats:
+			err := (&workerUpdateServerStats{
+				db:       db,
+				server:   server,
+				location: location,
+				now:      clock,
+			}).update()
+			if err != nil {
+				return result, errors.Wrapf(err, "couldn't update the stats at %s", now)
+			}
+			result.StatsUpdates++
+		}
+	}
+
+	return result, nil
+}
+
+func replaySnapshot(
+	ctx context.Context,
+	a *archive.Archive,
+	db *pg.DB,
+	server *twmodel.Server,
+	obj *archive.Object,
+	clock func() time.Time,
+) error {
+	snapshot, err := a.Load(ctx, obj.Key)
+	if err != nil {
+		return err
+	}
+	// the files are read from the snapshot, so the downloads don't need to be cancelled
+	downloads, _ := newDownloadGroup(ctx, defaultDownloadConcurrency)
+	return (&workerUpdateServerData{
+		db: db,
+		dataloader: twdataloader.NewServerDataLoader(&twdataloader.ServerDataLoaderConfig{
+			BaseURL: snapshot.URL,
+			Client: &http.Client{
+				Transport: snapshot.RoundTripper(),
+			},
+		}),
+		server: server,
+		now:    clock,
+
+		bulkThreshold: defaultBulkThreshold,
+		txTimeout: txTimeout{
+			base:            defaultTxTimeout,
+			perThousandRows: defaultTxTimeoutPerThousandRows,
+		},
+		runID: newUpdateRunID(server.Key, clock()),
+
+		maxCountDropPercent:         defaultMaxCountDropPercent,
+		maxUnknownReferencesPercent: defaultMaxUnknownReferencesPercent,
+		downloads:                   downloads,
+	}).update()
+}
+
+// dailyReplayEvents returns the events at the given time of day between from (exclusive) and to (inclusive).
+func dailyReplayEvents(taskName string, from, to time.Time, at time.Duration, location *time.Location) []replayEvent {
+	var events []replayEvent
+	local := from.In(location)
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, location)
+	for {
+		next := day.Add(at)
+		if next.After(to) {
+			return events
+		}
+		if next.After(from) {
+			events = append(events, replayEvent{
+				at:       next,
+				taskName: taskName,
+			})
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+}
+
+func resetReplayTables(ctx context.Context, db *pg.DB) error {
+	if _, err := db.ExecContext(ctx, "TRUNCATE "+strings.Join(replayResetTables, ", ")); err != nil {
+		return errors.Wrap(err, "couldn't truncate the tables")
+	}
+	return nil
+}
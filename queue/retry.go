@@ -0,0 +1,133 @@
+package queue
+
+import (
+	stderrors "errors"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultMinBackoff = 30 * time.Second
+	defaultMaxBackoff = 30 * time.Minute
+)
+
+// RetryPolicy describes how a task is retried after its handler returns an error.
+type RetryPolicy struct {
+	// MaxAttempts includes the first attempt, 1 means that the task is never retried.
+	MaxAttempts int
+	// The delay before the n-th retry is MinBackoff * 2^(n-1), but no more than MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Jitter randomizes the delay by up to ±Jitter*delay, it must be between 0 and 1.
+	Jitter float64
+	// IsRetryable reports whether the task should be retried after the given error.
+	// Errors marked with NonRetryable are never retried.
+	IsRetryable func(err error) bool
+}
+
+func (p RetryPolicy) validate() error {
+	if p.MaxAttempts < 1 {
+		return errors.New("MaxAttempts must be greater than 0")
+	}
+	if p.MinBackoff <= 0 || p.MaxBackoff <= 0 {
+		return errors.New("MinBackoff and MaxBackoff must be greater than 0")
+	}
+	if p.MinBackoff > p.MaxBackoff {
+		return errors.New("MinBackoff must not be greater than MaxBackoff")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return errors.New("Jitter must be between 0 and 1")
+	}
+	return nil
+}
+
+func (p RetryPolicy) shouldRetry(err error, attempt int) bool {
+	if attempt >= p.MaxAttempts || IsNonRetryable(err) {
+		return false
+	}
+	return p.IsRetryable == nil || p.IsRetryable(err)
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	d := float64(p.MinBackoff) * math.Pow(2, float64(attempt-1))
+	if d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (rand.Float64()*2 - 1)
+	}
+	return time.Duration(d)
+}
+
+// withDefaults fills the zero fields with the values from the given policy.
+func (p RetryPolicy) withDefaults(defaults RetryPolicy) RetryPolicy {
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = defaults.MaxAttempts
+	}
+	if p.MinBackoff == 0 {
+		p.MinBackoff = defaults.MinBackoff
+	}
+	if p.MaxBackoff == 0 {
+		p.MaxBackoff = defaults.MaxBackoff
+	}
+	if p.IsRetryable == nil {
+		p.IsRetryable = defaults.IsRetryable
+	}
+	return p
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	MaxAttempts: defaultRetryLimit,
+	MinBackoff:  defaultMinBackoff,
+	MaxBackoff:  defaultMaxBackoff,
+}
+
+type nonRetryableError struct {
+	err error
+}
+
+func (e *nonRetryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *nonRetryableError) Unwrap() error {
+	return e.err
+}
+
+// NonRetryable marks the error as permanent, a task that fails with such an error isn't retried
+// (e.g. the game server responds with 404 because the world has been closed).
+func NonRetryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &nonRetryableError{err}
+}
+
+func IsNonRetryable(err error) bool {
+	var target *nonRetryableError
+	return stderrors.As(err, &target)
+}
+
+// retryError tells taskq when the message should be retried (see taskq.Delayer), 0 means never.
+type retryError struct {
+	err   error
+	delay time.Duration
+}
+
+func (e *retryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryError) Unwrap() error {
+	return e.err
+}
+
+func (e *retryError) Delay() time.Duration {
+	return e.delay
+}
@@ -0,0 +1,224 @@
+package queue
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+)
+
+const (
+	defaultMaxCountDropPercent = 20
+	// defaultMaxUnknownReferencesPercent tolerates e.g. the members of a tribe disbanded
+	// between the downloads of ally.txt and player.txt
+	defaultMaxUnknownReferencesPercent = 5
+	// maxRejectionExamples is the number of IDs listed in a reason, e.g. the duplicated IDs
+	maxRejectionExamples = 10
+
+	countDropRejectionsKeyPrefix = "twhelp:queue:count_drop_rejections:"
+	countDropRejectionsTTL       = 7 * day
+	countDropRejectionsTimeout   = 5 * time.Second
+)
+
+// rejectedDataError means that the data downloaded from the game server looks partial or corrupted,
+// so it hasn't been written. The task isn't retried, the next update downloads the data again.
+type rejectedDataError struct {
+	reasons []string
+}
+
+func (e *rejectedDataError) Error() string {
+	return "the downloaded data has been rejected: " + strings.Join(e.reasons, "; ")
+}
+
+func isRejectedData(err error) bool {
+	var target *rejectedDataError
+	return stderrors.As(err, &target)
+}
+
+// checkData compares the downloaded data with the previous update of the server (number_of_players etc.)
+// and checks its integrity, it returns *rejectedDataError if something is wrong.
+func (w *workerUpdateServerData) checkData(
+	tribes []*twmodel.Tribe,
+	players []*twmodel.Player,
+	villages []*twmodel.Village,
+) error {
+	var drops, reasons []string
+	if w.maxCountDropPercent >= 0 {
+		drops = appendCountDrop(drops, "players", w.server.NumberOfPlayers, len(players), w.maxCountDropPercent)
+		drops = appendCountDrop(drops, "tribes", w.server.NumberOfTribes, len(tribes), w.maxCountDropPercent)
+		drops = appendCountDrop(drops, "villages", w.server.NumberOfVillages, len(villages), w.maxCountDropPercent)
+	}
+
+	tribeIDs := make(map[int]bool, len(tribes))
+	var duplicatedTribes []int
+	for _, tribe := range tribes {
+		if tribeIDs[tribe.ID] {
+			duplicatedTribes = append(duplicatedTribes, tribe.ID)
+		}
+		tribeIDs[tribe.ID] = true
+	}
+	reasons = appendIDs(reasons, "duplicated tribes", duplicatedTribes)
+
+	playerIDs := make(map[int]bool, len(players))
+	var duplicatedPlayers, playersInUnknownTribes []int
+	for _, player := range players {
+		if playerIDs[player.ID] {
+			duplicatedPlayers = append(duplicatedPlayers, player.ID)
+		}
+		playerIDs[player.ID] = true
+		if player.TribeID != 0 && !tribeIDs[player.TribeID] {
+			playersInUnknownTribes = append(playersInUnknownTribes, player.ID)
+		}
+	}
+	reasons = appendIDs(reasons, "duplicated players", duplicatedPlayers)
+	reasons = w.appendUnknownReferences(reasons, "players in unknown tribes", playersInUnknownTribes, len(players))
+
+	villageIDs := make(map[int]bool, len(villages))
+	var duplicatedVillages, villagesOfUnknownPlayers []int
+	for _, village := range villages {
+		if villageIDs[village.ID] {
+			duplicatedVillages = append(duplicatedVillages, village.ID)
+		}
+		villageIDs[village.ID] = true
+		if village.PlayerID != 0 && !playerIDs[village.PlayerID] {
+			villagesOfUnknownPlayers = append(villagesOfUnknownPlayers, village.ID)
+		}
+	}
+	reasons = appendIDs(reasons, "duplicated villages", duplicatedVillages)
+	reasons = w.appendUnknownReferences(reasons, "villages of unknown players", villagesOfUnknownPlayers, len(villages))
+
+	if len(drops) == 0 {
+		w.resetCountDropRejections()
+	}
+	// the data rejected for other reasons isn't counted as rejected because of the drop,
+	// it's probably partial rather than a world that has really shrunk
+	if len(reasons) > 0 {
+		return &rejectedDataError{append(drops, reasons...)}
+	}
+	if len(drops) > 0 && !w.acceptCountDrop(drops) {
+		return &rejectedDataError{drops}
+	}
+	return nil
+}
+
+// acceptCountDrop counts the consecutive updates of the server rejected only because of the count drop
+// and reports whether the drop should be accepted, i.e. the previous acceptCountDropAfter updates have been rejected.
+// The drop is never accepted if acceptCountDropAfter isn't positive.
+func (w *workerUpdateServerData) acceptCountDrop(drops []string) bool {
+	if w.countDropRejections == nil || w.acceptCountDropAfter <= 0 {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), countDropRejectionsTimeout)
+	defer cancel()
+	entry := log.WithField("key", w.server.Key)
+	rejections, err := w.countDropRejections.incr(ctx, w.server.Key)
+	if err != nil {
+		entry.Warn(errors.Wrapf(err, "workerUpdateServerData.acceptCountDrop: %s: Couldn't count the rejections", w.server.Key))
+		return false
+	}
+	if rejections <= w.acceptCountDropAfter {
+		return false
+	}
+	entry.Warnf(
+		"workerUpdateServerData.acceptCountDrop: %s: The previous %d updates have been rejected because of the count drop, accepting it: %s",
+		w.server.Key,
+		rejections-1,
+		strings.Join(drops, "; "),
+	)
+	return true
+}
+
+// resetCountDropRejections resets the counter of acceptCountDrop after an update without the drop.
+func (w *workerUpdateServerData) resetCountDropRejections() {
+	if w.countDropRejections == nil || w.acceptCountDropAfter <= 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), countDropRejectionsTimeout)
+	defer cancel()
+	if err := w.countDropRejections.reset(ctx, w.server.Key); err != nil {
+		log.
+			WithField("key", w.server.Key).
+			Warn(errors.Wrapf(err, "workerUpdateServerData.resetCountDropRejections: %s: Couldn't reset the rejections", w.server.Key))
+	}
+}
+
+// appendUnknownReferences rejects the data if more than maxUnknownReferencesPercent of the rows reference
+// an unknown tribe or player. The files are downloaded separately, so a few such references are expected,
+// e.g. a player may have been deleted after player.txt has been downloaded, but before village.txt.
+func (w *workerUpdateServerData) appendUnknownReferences(reasons []string, what string, ids []int, total int) []string {
+	if len(ids) == 0 || w.maxUnknownReferencesPercent < 0 {
+		return reasons
+	}
+	percent := float64(len(ids)) / float64(total) * 100
+	if percent <= float64(w.maxUnknownReferencesPercent) {
+		return reasons
+	}
+	return appendIDs(reasons, fmt.Sprintf("%s (%.1f%%, max %d%%)", what, percent, w.maxUnknownReferencesPercent), ids)
+}
+
+func appendCountDrop(reasons []string, entity string, previous, current, maxDropPercent int) []string {
+	if previous <= 0 || current >= previous {
+		return reasons
+	}
+	if drop := float64(previous-current) / float64(previous) * 100; drop > float64(maxDropPercent) {
+		reasons = append(reasons, fmt.Sprintf(
+			"the number of %s has dropped by %.1f%% (from %d to %d, max %d%%)",
+			entity,
+			drop,
+			previous,
+			current,
+			maxDropPercent,
+		))
+	}
+	return reasons
+}
+
+func appendIDs(reasons []string, what string, ids []int) []string {
+	if len(ids) == 0 {
+		return reasons
+	}
+	examples := ids
+	if len(examples) > maxRejectionExamples {
+		examples = examples[:maxRejectionExamples]
+	}
+	reason := fmt.Sprintf("%d %s (%s", len(ids), what, strings.Trim(fmt.Sprint(examples), "[]"))
+	if len(examples) < len(ids) {
+		reason += "..."
+	}
+	return append(reasons, reason+")")
+}
+
+// countDropRejections counts the consecutive updates of each server rejected because of the count drop,
+// in Redis or, with BackendMemory, in the memory of the process. The counter expires after countDropRejectionsTTL.
+type countDropRejections struct {
+	redis  redis.UniversalClient
+	memory *memoryKeys
+}
+
+func (r *countDropRejections) incr(ctx context.Context, serverKey string) (int, error) {
+	key := countDropRejectionsKeyPrefix + serverKey
+	if r.memory != nil {
+		return r.memory.incr(key, countDropRejectionsTTL), nil
+	}
+	pipe := r.redis.TxPipeline()
+	incr := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, countDropRejectionsTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return int(incr.Val()), nil
+}
+
+func (r *countDropRejections) reset(ctx context.Context, serverKey string) error {
+	key := countDropRejectionsKeyPrefix + serverKey
+	if r.memory != nil {
+		r.memory.del(key)
+		return nil
+	}
+	return r.redis.Del(ctx, key).Err()
+}
@@ -0,0 +1,215 @@
+package queue
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+)
+
+func TestCheckData(t *testing.T) {
+	newData := func() ([]*twmodel.Tribe, []*twmodel.Player, []*twmodel.Village) {
+		tribes := []*twmodel.Tribe{{ID: 1}, {ID: 2}}
+		players := []*twmodel.Player{{ID: 1, TribeID: 1}, {ID: 2, TribeID: 2}, {ID: 3}, {ID: 4}}
+		villages := []*twmodel.Village{{ID: 1, PlayerID: 1}, {ID: 2, PlayerID: 4}, {ID: 3}, {ID: 4}}
+		return tribes, players, villages
+	}
+	server := &twmodel.Server{
+		Key:              "pl170",
+		NumberOfPlayers:  5,
+		NumberOfTribes:   2,
+		NumberOfVillages: 4,
+	}
+
+	tests := []struct {
+		name                        string
+		modify                      func(tribes *[]*twmodel.Tribe, players *[]*twmodel.Player, villages *[]*twmodel.Village)
+		maxCountDropPercent         int
+		maxUnknownReferencesPercent int
+		expected                    []string
+	}{
+		{
+			name:                "valid",
+			maxCountDropPercent: defaultMaxCountDropPercent,
+		},
+		{
+			name: "count drop",
+			modify: func(tribes *[]*twmodel.Tribe, players *[]*twmodel.Player, villages *[]*twmodel.Village) {
+				*players = (*players)[:2]
+				*villages = (*villages)[:1]
+			},
+			maxCountDropPercent: defaultMaxCountDropPercent,
+			expected: []string{
+				"the number of players has dropped by 60.0% (from 5 to 2, max 20%)",
+				"the number of villages has dropped by 75.0% (from 4 to 1, max 20%)",
+			},
+		},
+		{
+			name: "count drop check disabled",
+			modify: func(tribes *[]*twmodel.Tribe, players *[]*twmodel.Player, villages *[]*twmodel.Village) {
+				*players = (*players)[:2]
+				*villages = (*villages)[:1]
+			},
+			maxCountDropPercent: -1,
+		},
+		{
+			name: "duplicated IDs",
+			modify: func(tribes *[]*twmodel.Tribe, players *[]*twmodel.Player, villages *[]*twmodel.Village) {
+				*tribes = append(*tribes, &twmodel.Tribe{ID: 2})
+				*villages = append(*villages, &twmodel.Village{ID: 3}, &twmodel.Village{ID: 4})
+			},
+			maxCountDropPercent: defaultMaxCountDropPercent,
+			expected: []string{
+				"1 duplicated tribes (2)",
+				"2 duplicated villages (3 4)",
+			},
+		},
+		{
+			name: "unknown references",
+			modify: func(tribes *[]*twmodel.Tribe, players *[]*twmodel.Player, villages *[]*twmodel.Village) {
+				*tribes = append((*tribes)[:1], &twmodel.Tribe{ID: 3})
+				*villages = append(*villages, &twmodel.Village{ID: 5, PlayerID: 10})
+			},
+			maxCountDropPercent: defaultMaxCountDropPercent,
+			expected: []string{
+				"1 players in unknown tribes (25.0%, max 5%) (2)",
+				"1 villages of unknown players (20.0%, max 5%) (5)",
+			},
+		},
+		{
+			name: "unknown references within the limit",
+			modify: func(tribes *[]*twmodel.Tribe, players *[]*twmodel.Player, villages *[]*twmodel.Village) {
+				*tribes = append((*tribes)[:1], &twmodel.Tribe{ID: 3})
+				*villages = append(*villages, &twmodel.Village{ID: 5, PlayerID: 10})
+			},
+			maxCountDropPercent:         defaultMaxCountDropPercent,
+			maxUnknownReferencesPercent: 25,
+		},
+		{
+			name: "unknown references check disabled",
+			modify: func(tribes *[]*twmodel.Tribe, players *[]*twmodel.Player, villages *[]*twmodel.Village) {
+				*tribes = (*tribes)[:1]
+			},
+			maxCountDropPercent:         -1,
+			maxUnknownReferencesPercent: -1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tribes, players, villages := newData()
+			if test.modify != nil {
+				test.modify(&tribes, &players, &villages)
+			}
+			maxUnknownReferencesPercent := test.maxUnknownReferencesPercent
+			if maxUnknownReferencesPercent == 0 {
+				maxUnknownReferencesPercent = defaultMaxUnknownReferencesPercent
+			}
+			w := &workerUpdateServerData{
+				server:                      server,
+				maxCountDropPercent:         test.maxCountDropPercent,
+				maxUnknownReferencesPercent: maxUnknownReferencesPercent,
+			}
+			err := w.checkData(tribes, players, villages)
+			if len(test.expected) == 0 {
+				if err != nil {
+					t.Errorf("expected no error, got %s", err)
+				}
+				return
+			}
+			if !isRejectedData(err) {
+				t.Fatalf("expected the data to be rejected, got %v", err)
+			}
+			if reasons := err.(*rejectedDataError).reasons; strings.Join(reasons, "\n") != strings.Join(test.expected, "\n") {
+				t.Errorf("expected the reasons:\n%s\ngot:\n%s", strings.Join(test.expected, "\n"), strings.Join(reasons, "\n"))
+			}
+		})
+	}
+}
+
+func TestCheckDataAcceptsCountDropAfterRejections(t *testing.T) {
+	server := &twmodel.Server{
+		Key:             "pl170",
+		NumberOfPlayers: 10,
+	}
+	players := []*twmodel.Player{{ID: 1}, {ID: 2}}
+	w := &workerUpdateServerData{
+		server:                      server,
+		maxCountDropPercent:         defaultMaxCountDropPercent,
+		maxUnknownReferencesPercent: defaultMaxUnknownReferencesPercent,
+		acceptCountDropAfter:        2,
+		countDropRejections:         &countDropRejections{memory: newMemoryKeys()},
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := w.checkData(nil, players, nil); !isRejectedData(err) {
+			t.Fatalf("expected the update %d to be rejected, got %v", i+1, err)
+		}
+	}
+	if err := w.checkData(nil, players, nil); err != nil {
+		t.Fatalf("expected the drop to be accepted after 2 rejections, got %s", err)
+	}
+
+	// the next update without the drop resets the counter
+	server.NumberOfPlayers = len(players)
+	if err := w.checkData(nil, players, nil); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	server.NumberOfPlayers = 10
+	if err := w.checkData(nil, players, nil); !isRejectedData(err) {
+		t.Fatalf("expected the drop to be rejected again, got %v", err)
+	}
+}
+
+func TestCheckDataCountsOnlyCountDropRejections(t *testing.T) {
+	server := &twmodel.Server{
+		Key:             "pl170",
+		NumberOfPlayers: 10,
+	}
+	players := []*twmodel.Player{{ID: 1}, {ID: 2}}
+	duplicatedPlayers := []*twmodel.Player{{ID: 1}, {ID: 1}}
+	w := &workerUpdateServerData{
+		server:                      server,
+		maxCountDropPercent:         defaultMaxCountDropPercent,
+		maxUnknownReferencesPercent: defaultMaxUnknownReferencesPercent,
+		acceptCountDropAfter:        1,
+		countDropRejections:         &countDropRejections{memory: newMemoryKeys()},
+	}
+
+	// the data is also rejected because of the duplicates, so it isn't counted
+	for i := 0; i < 3; i++ {
+		err := w.checkData(nil, duplicatedPlayers, nil)
+		if !isRejectedData(err) {
+			t.Fatalf("expected the update %d to be rejected, got %v", i+1, err)
+		}
+		if reasons := err.(*rejectedDataError).reasons; len(reasons) != 2 {
+			t.Fatalf("expected the drop and the duplicates, got %v", reasons)
+		}
+	}
+	if err := w.checkData(nil, players, nil); !isRejectedData(err) {
+		t.Fatalf("expected the first update rejected only because of the drop to be rejected, got %v", err)
+	}
+	if err := w.checkData(nil, players, nil); err != nil {
+		t.Fatalf("expected the drop to be accepted after 1 rejection, got %s", err)
+	}
+}
+
+func TestCheckDataNeverAcceptsCountDropByDefault(t *testing.T) {
+	server := &twmodel.Server{
+		Key:             "pl170",
+		NumberOfPlayers: 10,
+	}
+	players := []*twmodel.Player{{ID: 1}, {ID: 2}}
+	w := &workerUpdateServerData{
+		server:                      server,
+		maxCountDropPercent:         defaultMaxCountDropPercent,
+		maxUnknownReferencesPercent: defaultMaxUnknownReferencesPercent,
+		countDropRejections:         &countDropRejections{memory: newMemoryKeys()},
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := w.checkData(nil, players, nil); !isRejectedData(err) {
+			t.Fatalf("expected the update %d to be rejected, got %v", i+1, err)
+		}
+	}
+}
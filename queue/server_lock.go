@@ -0,0 +1,215 @@
+package queue
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bsm/redislock"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+const (
+	serverLockKeyPrefix      = "twhelp:queue:server_lock:"
+	defaultServerLockWait    = 30 * time.Second
+	defaultServerLockTTL     = time.Minute
+	serverLockRetryBackoff   = 250 * time.Millisecond
+	serverLockReleaseTimeout = 5 * time.Second
+)
+
+var (
+	errServerLockNotObtained = errors.New("server lock not obtained")
+	// errServerLockLost means that the lock couldn't be refreshed while the task was running
+	errServerLockLost = errors.New("server lock lost")
+)
+
+// serverLocker ensures that only one task at a time works on the schema of the given server.
+// The lock expires after ttl unless it's refreshed, it's refreshed every ttl/2 as long as the task is running.
+// If a refresh fails, the task is cancelled.
+// The lock is kept in Redis or, with BackendMemory, in the memory of the process.
+type serverLocker struct {
+	client *redislock.Client
+	memory *memoryKeys
+	wait   time.Duration
+	ttl    time.Duration
+}
+
+func newServerLocker(client redis.UniversalClient, memory *memoryKeys, wait, ttl time.Duration) *serverLocker {
+	if wait <= 0 {
+		wait = defaultServerLockWait
+	}
+	if ttl <= 0 {
+		ttl = defaultServerLockTTL
+	}
+	l := &serverLocker{
+		memory: memory,
+		wait:   wait,
+		ttl:    ttl,
+	}
+	if memory == nil {
+		l.client = redislock.New(client)
+	}
+	return l
+}
+
+// lock obtains the lock of the given server. The returned context is derived from ctx
+// and is cancelled as soon as the lock can't be refreshed, so the task stops writing to the schema.
+// unlock releases the lock, it returns errServerLockLost if the lock has been lost in the meantime,
+// i.e. the task may have written to the schema without holding it. unlock may be called more than once.
+func (l *serverLocker) lock(
+	ctx context.Context,
+	taskName,
+	serverKey string,
+) (lockedCtx context.Context, unlock func() error, err error) {
+	key := serverLockKeyPrefix + serverKey
+	lock, err := l.obtain(ctx, key, taskName, false)
+	if err == errServerLockNotObtained {
+		serverLockContentionTotal.WithLabelValues(taskName).Inc()
+		start := time.Now()
+		waitCtx, cancel := context.WithTimeout(ctx, l.wait)
+		lock, err = l.obtain(waitCtx, key, taskName, true)
+		cancel()
+		serverLockWaitSeconds.WithLabelValues(taskName).Observe(time.Since(start).Seconds())
+		if err == errServerLockNotObtained {
+			serverLockTimeoutsTotal.WithLabelValues(taskName).Inc()
+			return nil, nil, errors.Errorf("couldn't lock the server '%s' within %s, another task is still running", serverKey, l.wait)
+		}
+	}
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "couldn't lock the server '%s'", serverKey)
+	}
+
+	lockedCtx, cancelLocked := context.WithCancel(ctx)
+	var lost int32
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(l.ttl / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				refreshCtx, cancel := context.WithTimeout(context.Background(), l.ttl/2)
+				err := lock.refresh(refreshCtx, l.ttl)
+				cancel()
+				if err != nil {
+					// the lock may expire before the next refresh, the task mustn't write to the schema anymore
+					atomic.StoreInt32(&lost, 1)
+					cancelLocked()
+					log.
+						WithField("key", serverKey).
+						Error(errors.Wrapf(err, "serverLocker: %s: Couldn't refresh the lock, cancelling the task", serverKey))
+					return
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	var unlockErr error
+	return lockedCtx, func() error {
+		once.Do(func() {
+			close(done)
+			<-stopped
+			cancelLocked()
+			ctx, cancel := context.WithTimeout(context.Background(), serverLockReleaseTimeout)
+			defer cancel()
+			if err := lock.release(ctx); err != nil {
+				log.
+					WithField("key", serverKey).
+					Warn(errors.Wrapf(err, "serverLocker: %s: Couldn't release the lock", serverKey))
+			}
+			if atomic.LoadInt32(&lost) == 1 {
+				unlockErr = errors.Wrapf(errServerLockLost, "server '%s'", serverKey)
+			}
+		})
+		return unlockErr
+	}, nil
+}
+
+// obtain returns errServerLockNotObtained if the lock is held by another task,
+// with retry it tries again every serverLockRetryBackoff until ctx is done.
+func (l *serverLocker) obtain(ctx context.Context, key, taskName string, retry bool) (heldServerLock, error) {
+	if l.memory == nil {
+		opts := &redislock.Options{Metadata: taskName}
+		if retry {
+			opts.RetryStrategy = redislock.LinearBackoff(serverLockRetryBackoff)
+		}
+		lock, err := l.client.Obtain(ctx, key, l.ttl, opts)
+		if err == redislock.ErrNotObtained {
+			return nil, errServerLockNotObtained
+		}
+		if err != nil {
+			return nil, err
+		}
+		return redisServerLock{lock}, nil
+	}
+
+	token := taskName + ":" + strconv.FormatInt(atomic.AddInt64(&memoryServerLockTokens, 1), 10)
+	for {
+		if l.memory.setNX(key, token, l.ttl) {
+			return &memoryServerLock{
+				keys:  l.memory,
+				key:   key,
+				token: token,
+			}, nil
+		}
+		if !retry {
+			return nil, errServerLockNotObtained
+		}
+		timer := time.NewTimer(serverLockRetryBackoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, errServerLockNotObtained
+		case <-timer.C:
+		}
+	}
+}
+
+type heldServerLock interface {
+	refresh(ctx context.Context, ttl time.Duration) error
+	release(ctx context.Context) error
+}
+
+type redisServerLock struct {
+	lock *redislock.Lock
+}
+
+func (l redisServerLock) refresh(ctx context.Context, ttl time.Duration) error {
+	return l.lock.Refresh(ctx, ttl, nil)
+}
+
+func (l redisServerLock) release(ctx context.Context) error {
+	if err := l.lock.Release(ctx); err != nil && err != redislock.ErrLockNotHeld {
+		return err
+	}
+	return nil
+}
+
+// memoryServerLockTokens distinguishes the locks obtained by the tasks running in the same process
+var memoryServerLockTokens int64
+
+type memoryServerLock struct {
+	keys  *memoryKeys
+	key   string
+	token string
+}
+
+func (l *memoryServerLock) refresh(_ context.Context, ttl time.Duration) error {
+	if !l.keys.expireIfValue(l.key, l.token, ttl) {
+		return errors.New("the lock has expired")
+	}
+	return nil
+}
+
+func (l *memoryServerLock) release(_ context.Context) error {
+	l.keys.delIfValue(l.key, l.token)
+	return nil
+}
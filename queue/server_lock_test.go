@@ -0,0 +1,57 @@
+package queue
+
+import (
+	"context"
+	stderrors "errors"
+	"testing"
+	"time"
+)
+
+func TestServerLocker(t *testing.T) {
+	t.Run("lock lost", func(t *testing.T) {
+		memory := newMemoryKeys()
+		l := newServerLocker(nil, memory, time.Second, 50*time.Millisecond)
+		ctx, unlock, err := l.lock(context.Background(), UpdateServerData, "pl170")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer unlock()
+
+		// e.g. the key has expired while the worker was stuck
+		memory.del(serverLockKeyPrefix + "pl170")
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+			t.Fatal("expected the context of the task to be cancelled")
+		}
+		if err := unlock(); !stderrors.Is(err, errServerLockLost) {
+			t.Errorf("expected errServerLockLost, got %v", err)
+		}
+	})
+
+	t.Run("released", func(t *testing.T) {
+		memory := newMemoryKeys()
+		l := newServerLocker(nil, memory, 100*time.Millisecond, 50*time.Millisecond)
+		ctx, unlock, err := l.lock(context.Background(), UpdateServerData, "pl170")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := l.lock(context.Background(), UpdateServerStats, "pl170"); err == nil {
+			t.Fatal("expected the second lock to time out")
+		}
+		if ctx.Err() != nil {
+			t.Fatal("expected the lock to be refreshed while the task is running")
+		}
+		if err := unlock(); err != nil {
+			t.Fatalf("expected no error, got %s", err)
+		}
+		if ctx.Err() == nil {
+			t.Error("expected the context to be cancelled after unlocking")
+		}
+		_, unlock, err = l.lock(context.Background(), UpdateServerStats, "pl170")
+		if err != nil {
+			t.Fatalf("expected the lock to be released, got %s", err)
+		}
+		_ = unlock()
+	})
+}
@@ -0,0 +1,48 @@
+package queue
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tribalwarshelp/shared/tw/twdataloader"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+
+	"github.com/tribalwarshelp/dataupdater/archive"
+)
+
+const snapshotSaveTimeout = time.Minute
+
+// newSnapshotServerDataLoader works like newServerDataLoader, but additionally records the downloaded files
+// in the returned snapshot. The snapshot is nil if archiving is disabled.
+func (t *task) newSnapshotServerDataLoader(
+	ctx context.Context,
+	url string,
+	server *twmodel.Server,
+	takenAt time.Time,
+) (*twdataloader.ServerDataLoader, *archive.Snapshot) {
+	if t.archive == nil {
+		return t.newServerDataLoader(ctx, url, server), nil
+	}
+	snapshot := archive.NewSnapshot(server.Key, string(server.VersionCode), url, takenAt)
+	client := t.newHTTPClient(ctx, versionHost(url, server))
+	client.Transport = snapshot.Transport(client.Transport)
+	return twdataloader.NewServerDataLoader(&twdataloader.ServerDataLoaderConfig{
+		BaseURL: url,
+		Client:  client,
+	}), snapshot
+}
+
+// saveSnapshot archives the snapshot, a failure doesn't fail the task.
+func (t *task) saveSnapshot(snapshot *archive.Snapshot) {
+	if snapshot == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotSaveTimeout)
+	defer cancel()
+	if err := t.archive.Save(ctx, snapshot); err != nil {
+		log.
+			WithField("key", snapshot.ServerKey).
+			Warn(errors.Wrapf(err, "task.saveSnapshot: %s: Couldn't archive the downloaded files", snapshot.ServerKey))
+	}
+}
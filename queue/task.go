@@ -1,11 +1,15 @@
 package queue
 
 import (
+	"context"
 	"github.com/go-pg/pg/v10"
 	"github.com/pkg/errors"
 	"github.com/vmihailenco/taskq/v3"
+	"net/http"
 	"sync"
 	"time"
+
+	"github.com/tribalwarshelp/dataupdater/archive"
 )
 
 const (
@@ -25,10 +29,63 @@ const (
 	defaultRetryLimit               = 3
 )
 
+// TaskNames returns the names of all tasks defined in this package.
+func TaskNames() []string {
+	return []string{
+		LoadVersionsAndUpdateServerData,
+		LoadServersAndUpdateData,
+		UpdateServerData,
+		Vacuum,
+		VacuumServerData,
+		UpdateEnnoblements,
+		UpdateServerEnnoblements,
+		UpdateHistory,
+		UpdateServerHistory,
+		UpdateStats,
+		UpdateServerStats,
+		DeleteNonExistentVillages,
+		ServerDeleteNonExistentVillages,
+	}
+}
+
+func isKnownTask(name string) bool {
+	for _, taskName := range TaskNames() {
+		if taskName == name {
+			return true
+		}
+	}
+	return false
+}
+
 type task struct {
 	db              *pg.DB
 	queue           *Queue
 	cachedLocations sync.Map
+	serverLocker    *serverLocker
+	rateLimiter     *hostRateLimiter
+	httpConfig      *HTTPConfig
+	httpTransport   http.RoundTripper
+	archive         *archive.Archive
+	// taskRunsRetention is how long the task runs are kept, see taskVacuum
+	taskRunsRetention time.Duration
+	// bulkThreshold, txTimeout and chunkedCommits are passed to workerUpdateServerData
+	bulkThreshold  int
+	txTimeout      txTimeout
+	chunkedCommits bool
+	// maxCountDropPercent, acceptCountDropAfter and maxUnknownReferencesPercent are passed to workerUpdateServerData,
+	// < 0 disables the check (<= 0 for acceptCountDropAfter)
+	maxCountDropPercent         int
+	acceptCountDropAfter        int
+	countDropRejections         *countDropRejections
+	maxUnknownReferencesPercent int
+	downloadConcurrency         int
+}
+
+// lockServer must be called by the tasks that modify the schema of the given server.
+// The task must use the returned context, which is cancelled if the lock is lost,
+// and fail if the returned func, which releases the lock, returns an error.
+func (t *task) lockServer(ctx context.Context, taskName, serverKey string) (context.Context, func() error, error) {
+	return t.serverLocker.lock(ctx, taskName, serverKey)
 }
 
 func (t *task) loadLocation(timezone string) (*time.Location, error) {
@@ -49,9 +106,67 @@ func registerTasks(cfg *registerTasksConfig) error {
 		return errors.Wrap(err, "config is invalid")
 	}
 
+	httpCfg := cfg.HTTP
+	if httpCfg == nil {
+		httpCfg = &HTTPConfig{}
+	}
+	httpTransport := httpCfg.Transport
+	if httpTransport == nil {
+		var err error
+		httpTransport, err = newHTTPTransport(httpCfg)
+		if err != nil {
+			return errors.Wrap(err, "couldn't create the http transport")
+		}
+	}
+	taskRunsRetention := cfg.TaskRunsRetention
+	if taskRunsRetention <= 0 {
+		taskRunsRetention = defaultTaskRunsRetention
+	}
+	bulkThreshold := cfg.BulkThreshold
+	if bulkThreshold == 0 {
+		bulkThreshold = defaultBulkThreshold
+	}
+	txTimeoutPerThousandRows := cfg.TxTimeoutPerThousandRows
+	if txTimeoutPerThousandRows == 0 {
+		txTimeoutPerThousandRows = defaultTxTimeoutPerThousandRows
+	}
+	maxCountDropPercent := cfg.MaxCountDropPercent
+	if maxCountDropPercent == 0 {
+		maxCountDropPercent = defaultMaxCountDropPercent
+	}
+	maxUnknownReferencesPercent := cfg.MaxUnknownReferencesPercent
+	if maxUnknownReferencesPercent == 0 {
+		maxUnknownReferencesPercent = defaultMaxUnknownReferencesPercent
+	}
+	downloadConcurrency := cfg.DownloadConcurrency
+	if downloadConcurrency <= 0 {
+		downloadConcurrency = defaultDownloadConcurrency
+	}
 	t := &task{
-		db:    cfg.DB,
-		queue: cfg.Queue,
+		db:            cfg.DB,
+		queue:         cfg.Queue,
+		serverLocker:  newServerLocker(cfg.Queue.redis, cfg.Queue.memoryKeys, cfg.ServerLockWait, cfg.ServerLockTTL),
+		rateLimiter:   newHostRateLimiter(cfg.Queue.redis, cfg.RequestsPerSecondPerHost),
+		httpConfig:    httpCfg,
+		httpTransport: httpTransport,
+		archive:       cfg.Archive,
+
+		taskRunsRetention: taskRunsRetention,
+		bulkThreshold:     bulkThreshold,
+		txTimeout: txTimeout{
+			base:            cfg.TxTimeout,
+			perThousandRows: txTimeoutPerThousandRows,
+		},
+		chunkedCommits: cfg.ChunkedCommits,
+
+		maxCountDropPercent:  maxCountDropPercent,
+		acceptCountDropAfter: cfg.AcceptCountDropAfter,
+		countDropRejections: &countDropRejections{
+			redis:  cfg.Queue.redis,
+			memory: cfg.Queue.memoryKeys,
+		},
+		maxUnknownReferencesPercent: maxUnknownReferencesPercent,
+		downloadConcurrency:         downloadConcurrency,
 	}
 	options := []*taskq.TaskOptions{
 		{
@@ -87,9 +202,8 @@ func registerTasks(cfg *registerTasksConfig) error {
 			Handler: (&taskUpdateHistory{t}).execute,
 		},
 		{
-			Name:       UpdateServerHistory,
-			RetryLimit: defaultRetryLimit,
-			Handler:    (&taskUpdateServerHistory{t}).execute,
+			Name:    UpdateServerHistory,
+			Handler: (&taskUpdateServerHistory{t}).execute,
 		},
 		{
 			Name:    UpdateStats,
@@ -110,9 +224,11 @@ func registerTasks(cfg *registerTasksConfig) error {
 	}
 	for _, taskOptions := range options {
 		opts := taskOptions
-		if opts.RetryLimit == 0 {
-			opts.RetryLimit = defaultRetryLimit
-		}
+		policy := cfg.Queue.retryPolicies[opts.Name]
+		opts.RetryLimit = policy.MaxAttempts
+		opts.MinBackoff = policy.MinBackoff
+		opts.MaxBackoff = policy.MaxBackoff
+		opts.Handler = cfg.Queue.wrapHandler(opts)
 		taskq.RegisterTask(opts)
 	}
 
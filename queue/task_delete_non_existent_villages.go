@@ -11,9 +11,9 @@ type taskDeleteNonExistentVillages struct {
 	*task
 }
 
-func (t *taskDeleteNonExistentVillages) execute() error {
+func (t *taskDeleteNonExistentVillages) execute(ctx context.Context) error {
 	var servers []*twmodel.Server
-	err := t.db.
+	err := t.db.WithContext(ctx).
 		Model(&servers).
 		Relation("Version").
 		Where("status = ?", twmodel.ServerStatusOpen).
@@ -31,7 +31,7 @@ func (t *taskDeleteNonExistentVillages) execute() error {
 		err := t.queue.Add(
 			GetTask(ServerDeleteNonExistentVillages).
 				WithArgs(
-					context.Background(),
+					ctx,
 					twurlbuilder.BuildServerURL(server.Key, server.Version.Host),
 					server,
 				),
@@ -20,7 +20,7 @@ type serverWithURL struct {
 	url             string
 }
 
-func (t *taskLoadServersAndUpdateData) execute(version *twmodel.Version) error {
+func (t *taskLoadServersAndUpdateData) execute(ctx context.Context, version *twmodel.Version) error {
 	if err := t.validatePayload(version); err != nil {
 		log.Debug(errors.Wrap(err, "taskLoadServersAndUpdateData.execute"))
 		return nil
@@ -30,7 +30,7 @@ func (t *taskLoadServersAndUpdateData) execute(version *twmodel.Version) error {
 	loadedServers, err := twdataloader.
 		NewVersionDataLoader(&twdataloader.VersionDataLoaderConfig{
 			Host:   version.Host,
-			Client: newHTTPClient(),
+			Client: t.newHTTPClient(ctx, version.Host),
 		}).
 		LoadServers()
 	if err != nil {
@@ -50,7 +50,7 @@ func (t *taskLoadServersAndUpdateData) execute(version *twmodel.Version) error {
 			VersionCode: version.Code,
 			Version:     version,
 		}
-		if err := postgres.CreateServerSchema(t.db, server); err != nil {
+		if err := postgres.CreateServerSchema(t.db.WithContext(ctx), server); err != nil {
 			logrus.Warn(errors.Wrapf(err, "taskLoadServersAndUpdateData.execute: %s: Couldn't create the schema", server.Key))
 			continue
 		}
@@ -62,7 +62,7 @@ func (t *taskLoadServersAndUpdateData) execute(version *twmodel.Version) error {
 	}
 
 	if len(servers) > 0 {
-		if _, err := t.db.Model(&servers).
+		if _, err := t.db.WithContext(ctx).Model(&servers).
 			OnConflict("(key) DO UPDATE").
 			Set("status = ?", twmodel.ServerStatusOpen).
 			Set("version_code = EXCLUDED.version_code").
@@ -74,7 +74,7 @@ func (t *taskLoadServersAndUpdateData) execute(version *twmodel.Version) error {
 		}
 	}
 
-	if _, err := t.db.Model(&twmodel.Server{}).
+	if _, err := t.db.WithContext(ctx).Model(&twmodel.Server{}).
 		Set("status = ?", twmodel.ServerStatusClosed).
 		Where("key NOT IN (?) AND version_code = ?", pg.In(serverKeys), version.Code).
 		Update(); err != nil {
@@ -85,7 +85,7 @@ func (t *taskLoadServersAndUpdateData) execute(version *twmodel.Version) error {
 
 	entry.Infof("%s: Servers have been loaded", version.Host)
 	for _, server := range servers {
-		err := t.queue.Add(GetTask(UpdateServerData).WithArgs(context.Background(), server.url, server.Server))
+		err := t.queue.Add(GetTask(UpdateServerData).WithArgs(ctx, server.url, server.Server))
 		if err != nil {
 			log.
 				WithField("key", server.Key).
@@ -0,0 +1,203 @@
+package queue
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+	"github.com/vmihailenco/taskq/v3"
+)
+
+const (
+	TaskRunOutcomeSuccess = "success"
+	// TaskRunOutcomeRetry means the run has failed and the task will be retried
+	TaskRunOutcomeRetry = "retry"
+	// TaskRunOutcomeFailed means the run has failed and the task has been saved as a failed task (or run manually)
+	TaskRunOutcomeFailed = "failed"
+	// TaskRunOutcomeRejected means the downloaded data looked partial or corrupted and hasn't been written, see checkData
+	TaskRunOutcomeRejected = "rejected"
+
+	// defaultTaskRunsRetention bounds the size of public.task_runs. Without sampling (see defaultTaskRunsSampling),
+	// updateServerEnnoblements alone (every minute for every open server) would add ~430k rows a day for 300 servers,
+	// ~13M rows within the retention period. The other tasks add a few rows per server a day (updateServerData 24).
+	defaultTaskRunsRetention = 30 * day
+)
+
+// defaultTaskRunsSampling records only one of every N successful runs of the given task for each server,
+// so updateServerEnnoblements records a run per server an hour (~7k rows a day for 300 servers).
+// The runs that have failed, been retried or rejected are always recorded.
+var defaultTaskRunsSampling = map[string]int{
+	UpdateServerEnnoblements: 60,
+}
+
+// TaskRun records a single execution of a task.
+// The table is created by the postgres package.
+type TaskRun struct {
+	tableName struct{} `pg:"public.task_runs,alias:task_run"`
+
+	ID          int64               `json:"id" pg:",pk"`
+	TaskName    string              `json:"taskName"`
+	ServerKey   string              `json:"serverKey"`
+	VersionCode twmodel.VersionCode `json:"versionCode"`
+	Timezone    string              `json:"timezone"`
+	StartedAt   time.Time           `json:"startedAt" pg:",use_zero"`
+	FinishedAt  time.Time           `json:"finishedAt" pg:",use_zero"`
+	// Duration in milliseconds
+	Duration int64  `json:"duration" pg:",use_zero"`
+	Attempt  int    `json:"attempt" pg:",use_zero"`
+	Outcome  string `json:"outcome"`
+	Error    string `json:"error"`
+	// RunID identifies the transactions of an update of the server data (see Config.ChunkedCommits),
+	// it's empty for the other tasks
+	RunID string `json:"runID"`
+	// RowCounts is the number of rows written by entity (e.g. players, villages), it's empty if nothing has been written
+	RowCounts map[string]int `json:"rowCounts" pg:",type:jsonb"`
+	// UnchangedRowCounts is the number of rows skipped by entity because they haven't changed
+	UnchangedRowCounts map[string]int `json:"unchangedRowCounts" pg:",type:jsonb"`
+
+	mu sync.Mutex
+}
+
+func newTaskRun(msg *taskq.Message) *TaskRun {
+	info := newMessageInfo(msg)
+	return &TaskRun{
+		TaskName:    msg.TaskName,
+		ServerKey:   info.serverKey(),
+		VersionCode: info.versionCode(),
+		Timezone:    info.timezone,
+		StartedAt:   time.Now(),
+		Attempt:     msg.ReservedCount,
+	}
+}
+
+// addRows is called by rowsUpserted.report, the rows may be reported by several transactions of the same run.
+func (run *TaskRun) addRows(upserted *rowsUpserted) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	run.RowCounts = addRowCounts(run.RowCounts, upserted.written)
+	run.UnchangedRowCounts = addRowCounts(run.UnchangedRowCounts, upserted.unchanged)
+}
+
+func (run *TaskRun) setRunID(id string) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	run.RunID = id
+}
+
+func addRowCounts(counts, rows map[string]int) map[string]int {
+	if len(rows) == 0 {
+		return counts
+	}
+	if counts == nil {
+		counts = make(map[string]int, len(rows))
+	}
+	for entity, n := range rows {
+		counts[entity] += n
+	}
+	return counts
+}
+
+type taskRunContextKey struct{}
+
+func contextWithTaskRun(ctx context.Context, run *TaskRun) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, taskRunContextKey{}, run)
+}
+
+// taskRunFromContext returns the run the context has been created for (see wrapHandler), nil outside of a task.
+func taskRunFromContext(ctx context.Context) *TaskRun {
+	if ctx == nil {
+		return nil
+	}
+	run, _ := ctx.Value(taskRunContextKey{}).(*TaskRun)
+	return run
+}
+
+// sampleTaskRun reports whether the successful run should be recorded (see Config.TaskRunsSampling).
+func (q *Queue) sampleTaskRun(run *TaskRun) bool {
+	every := q.taskRunsSampling[run.TaskName]
+	if every < 0 {
+		return false
+	}
+	if every <= 1 {
+		return true
+	}
+	key := run.TaskName + ":" + run.ServerKey
+	q.taskRunsSampledMu.Lock()
+	defer q.taskRunsSampledMu.Unlock()
+	n := q.taskRunsSampled[key]
+	q.taskRunsSampled[key] = (n + 1) % every
+	return n == 0
+}
+
+// saveTaskRun records the outcome of the run, a failure to save it doesn't affect the task.
+func (q *Queue) saveTaskRun(run *TaskRun, outcome string, taskErr error) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	run.FinishedAt = time.Now()
+	run.Duration = run.FinishedAt.Sub(run.StartedAt).Milliseconds()
+	run.Outcome = outcome
+	if taskErr != nil {
+		run.Error = taskErr.Error()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := q.db.ModelContext(ctx, run).Insert(); err != nil {
+		log.
+			WithField("task", run.TaskName).
+			Warn(errors.Wrapf(err, "Queue.saveTaskRun: %s: Couldn't save the task run", run.TaskName))
+	}
+}
+
+type TaskRunsFilter struct {
+	TaskName  string
+	ServerKey string
+	Outcome   string
+	Limit     int
+	Offset    int
+}
+
+// TaskRuns returns the task runs, the most recent first.
+func (q *Queue) TaskRuns(ctx context.Context, f *TaskRunsFilter) ([]*TaskRun, int, error) {
+	if f == nil {
+		f = &TaskRunsFilter{}
+	}
+	var runs []*TaskRun
+	query := q.db.ModelContext(ctx, &runs).Order("started_at DESC", "id DESC")
+	if f.TaskName != "" {
+		query = query.Where("task_name = ?", f.TaskName)
+	}
+	if f.ServerKey != "" {
+		query = query.Where("server_key = ?", f.ServerKey)
+	}
+	if f.Outcome != "" {
+		query = query.Where("outcome = ?", f.Outcome)
+	}
+	if f.Limit > 0 {
+		query = query.Limit(f.Limit)
+	}
+	if f.Offset > 0 {
+		query = query.Offset(f.Offset)
+	}
+	total, err := query.SelectAndCount()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "couldn't load the task runs")
+	}
+	return runs, total, nil
+}
+
+// deleteOldTaskRuns removes the runs started before the retention period, it's done by the vacuum task.
+func (t *task) deleteOldTaskRuns(ctx context.Context) (int, error) {
+	res, err := t.db.WithContext(ctx).
+		Model(&TaskRun{}).
+		Where("started_at < ?", time.Now().Add(-t.taskRunsRetention)).
+		Delete()
+	if err != nil {
+		return 0, errors.Wrap(err, "couldn't delete the old task runs")
+	}
+	return res.RowsAffected(), nil
+}
@@ -0,0 +1,36 @@
+package queue
+
+import "testing"
+
+func TestSampleTaskRun(t *testing.T) {
+	q := &Queue{
+		taskRunsSampling: map[string]int{
+			UpdateServerEnnoblements: 3,
+			UpdateServerHistory:      -1,
+		},
+		taskRunsSampled: make(map[string]int),
+	}
+	count := func(taskName, serverKey string, runs int) int {
+		recorded := 0
+		for i := 0; i < runs; i++ {
+			if q.sampleTaskRun(&TaskRun{TaskName: taskName, ServerKey: serverKey}) {
+				recorded++
+			}
+		}
+		return recorded
+	}
+
+	if n := count(UpdateServerEnnoblements, "pl170", 7); n != 3 {
+		t.Errorf("expected 3 of 7 runs of %s to be recorded, got %d", UpdateServerEnnoblements, n)
+	}
+	// each server is sampled separately
+	if n := count(UpdateServerEnnoblements, "pl171", 1); n != 1 {
+		t.Errorf("expected the first run of another server to be recorded, got %d", n)
+	}
+	if n := count(UpdateServerHistory, "pl170", 5); n != 0 {
+		t.Errorf("expected none of the runs of %s to be recorded, got %d", UpdateServerHistory, n)
+	}
+	if n := count(UpdateServerData, "pl170", 5); n != 5 {
+		t.Errorf("expected all runs of %s to be recorded, got %d", UpdateServerData, n)
+	}
+}
@@ -1,6 +1,7 @@
 package queue
 
 import (
+	"context"
 	"github.com/go-pg/pg/v10"
 	"github.com/pkg/errors"
 	"github.com/tribalwarshelp/shared/tw/twdataloader"
@@ -11,18 +12,29 @@ type taskServerDeleteNonExistentVillages struct {
 	*task
 }
 
-func (t *taskServerDeleteNonExistentVillages) execute(url string, server *twmodel.Server) error {
+func (t *taskServerDeleteNonExistentVillages) execute(ctx context.Context, url string, server *twmodel.Server) error {
 	if err := t.validatePayload(server); err != nil {
 		log.Debug(errors.Wrap(err, "taskServerDeleteNonExistentVillages.execute"))
 		return nil
 	}
 	entry := log.WithField("key", server.Key)
+	ctx, unlock, err := t.lockServer(ctx, ServerDeleteNonExistentVillages, server.Key)
+	if err != nil {
+		err = errors.Wrap(err, "taskServerDeleteNonExistentVillages.execute")
+		entry.Warn(err)
+		return err
+	}
+	defer unlock()
 	entry.Infof("taskServerDeleteNonExistentVillages.execute: %s: Deleting non-existent villages...", server.Key)
-	err := (&workerDeleteNonExistentVillages{
-		db:         t.db.WithParam("SERVER", pg.Safe(server.Key)),
-		dataloader: newServerDataLoader(url),
+	err = (&workerDeleteNonExistentVillages{
+		db:         t.db.WithContext(ctx).WithParam("SERVER", pg.Safe(server.Key)),
+		dataloader: t.newServerDataLoader(ctx, url, server),
 		server:     server,
 	}).delete()
+	// if the lock has been lost, the task has been cancelled or has written the data without holding it
+	if unlockErr := unlock(); unlockErr != nil {
+		err = unlockErr
+	}
 	if err != nil {
 		err = errors.Wrap(err, "taskServerDeleteNonExistentVillages.execute")
 		entry.Error(err)
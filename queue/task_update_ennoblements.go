@@ -11,9 +11,9 @@ type taskUpdateEnnoblements struct {
 	*task
 }
 
-func (t *taskUpdateEnnoblements) execute() error {
+func (t *taskUpdateEnnoblements) execute(ctx context.Context) error {
 	var servers []*twmodel.Server
-	err := t.db.
+	err := t.db.WithContext(ctx).
 		Model(&servers).
 		Relation("Version").
 		Where("status = ?", twmodel.ServerStatusOpen).
@@ -27,7 +27,7 @@ func (t *taskUpdateEnnoblements) execute() error {
 	for _, server := range servers {
 		err := t.queue.Add(
 			GetTask(UpdateServerEnnoblements).
-				WithArgs(context.Background(), twurlbuilder.BuildServerURL(server.Key, server.Version.Host), server),
+				WithArgs(ctx, twurlbuilder.BuildServerURL(server.Key, server.Version.Host), server),
 		)
 		if err != nil {
 			log.
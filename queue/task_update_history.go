@@ -11,7 +11,7 @@ type taskUpdateHistory struct {
 	*task
 }
 
-func (t *taskUpdateHistory) execute(timezone string) error {
+func (t *taskUpdateHistory) execute(ctx context.Context, timezone string) error {
 	entry := log.WithField("timezone", timezone)
 	location, err := t.loadLocation(timezone)
 	if err != nil {
@@ -22,7 +22,7 @@ func (t *taskUpdateHistory) execute(timezone string) error {
 	year, month, day := time.Now().In(location).Date()
 	date := time.Date(year, month, day, 1, 30, 0, 0, location)
 	var servers []*twmodel.Server
-	err = t.db.
+	err = t.db.WithContext(ctx).
 		Model(&servers).
 		Where(
 			"status = ? AND (history_updated_at IS NULL OR history_updated_at < ?) AND timezone = ?",
@@ -41,7 +41,7 @@ func (t *taskUpdateHistory) execute(timezone string) error {
 		WithField("numberOfServers", len(servers)).
 		Info("taskUpdateHistory.execute: Update of the history has started")
 	for _, server := range servers {
-		err := t.queue.Add(GetTask(UpdateServerHistory).WithArgs(context.Background(), timezone, server))
+		err := t.queue.Add(GetTask(UpdateServerHistory).WithArgs(ctx, timezone, server))
 		if err != nil {
 			log.
 				WithField("key", server.Key).
@@ -3,10 +3,11 @@ package queue
 import (
 	"context"
 	"github.com/go-pg/pg/v10"
-	"github.com/go-pg/pg/v10/orm"
 	"github.com/pkg/errors"
 	"github.com/tribalwarshelp/shared/tw/twdataloader"
 	"github.com/tribalwarshelp/shared/tw/twmodel"
+	"golang.org/x/sync/errgroup"
+	"strings"
 	"time"
 )
 
@@ -14,19 +15,56 @@ type taskUpdateServerData struct {
 	*task
 }
 
-func (t *taskUpdateServerData) execute(url string, server *twmodel.Server) error {
+func (t *taskUpdateServerData) execute(ctx context.Context, url string, server *twmodel.Server) error {
 	if err := t.validatePayload(server); err != nil {
 		log.Debug(errors.Wrap(err, "taskUpdateServerData.execute"))
 		return nil
 	}
 	now := time.Now()
 	entry := log.WithField("key", server.Key)
+	ctx, unlock, err := t.lockServer(ctx, UpdateServerData, server.Key)
+	if err != nil {
+		err = errors.Wrap(err, "taskUpdateServerData.execute")
+		entry.Warn(err)
+		return err
+	}
+	defer unlock()
+	runID := newUpdateRunID(server.Key, now)
+	// a partial commit can be traced from the run
+	if run := taskRunFromContext(ctx); run != nil {
+		run.setRunID(runID)
+	}
 	entry.Infof("taskUpdateServerData.execute: %s: Update of the server data has started...", server.Key)
-	err := (&workerUpdateServerData{
-		db:         t.db.WithParam("SERVER", pg.Safe(server.Key)),
-		dataloader: newServerDataLoader(url),
+	downloads, downloadCtx := newDownloadGroup(ctx, t.downloadConcurrency)
+	dataloader, snapshot := t.newSnapshotServerDataLoader(downloadCtx, url, server, now)
+	err = (&workerUpdateServerData{
+		db:         t.db.WithContext(ctx).WithParam("SERVER", pg.Safe(server.Key)),
+		dataloader: dataloader,
 		server:     server,
+		now:        time.Now,
+
+		bulkThreshold:  t.bulkThreshold,
+		txTimeout:      t.txTimeout,
+		chunkedCommits: t.chunkedCommits,
+		runID:          runID,
+
+		maxCountDropPercent:         t.maxCountDropPercent,
+		acceptCountDropAfter:        t.acceptCountDropAfter,
+		countDropRejections:         t.countDropRejections,
+		maxUnknownReferencesPercent: t.maxUnknownReferencesPercent,
+		downloads:                   downloads,
 	}).update()
+	// if the lock has been lost, the task has been cancelled or has written the data without holding it
+	if unlockErr := unlock(); unlockErr != nil {
+		err = unlockErr
+	}
+	// the files are archived even if the update has failed, they may help to find out why
+	t.saveSnapshot(snapshot)
+	if isRejectedData(err) {
+		err = errors.Wrap(err, "taskUpdateServerData.execute")
+		entry.Warn(err)
+		return err
+	}
 	if err != nil {
 		err = errors.Wrap(err, "taskUpdateServerData.execute")
 		entry.Error(err)
@@ -54,6 +92,50 @@ type workerUpdateServerData struct {
 	db         *pg.DB
 	dataloader *twdataloader.ServerDataLoader
 	server     *twmodel.Server
+	// now is time.Now, except for the replay which simulates the time the data has been downloaded
+	now func() time.Time
+	// bulkThreshold is the number of rows from which an entity is upserted via COPY, see execUpsert
+	bulkThreshold int
+	txTimeout     txTimeout
+	// chunkedCommits commits the tribes, players and villages in separate transactions
+	chunkedCommits bool
+	// runID identifies the update in the logs, errors and task runs, it's shared by all its transactions
+	runID string
+	// maxCountDropPercent is the max drop of the number of players, tribes or villages
+	// compared to the previous update, see checkData
+	maxCountDropPercent int
+	// acceptCountDropAfter is the number of consecutive updates rejected because of the count drop
+	// after which it's accepted (<= 0 never), the rejections are counted by countDropRejections (nil disables it)
+	acceptCountDropAfter int
+	countDropRejections  *countDropRejections
+	// maxUnknownReferencesPercent is the max percentage of players in unknown tribes and villages of unknown players
+	maxUnknownReferencesPercent int
+	// downloads runs the downloads, the data loader must be created with its context (see newDownloadGroup)
+	downloads *errgroup.Group
+}
+
+const (
+	defaultTxTimeout                = 20 * time.Second
+	defaultTxTimeoutPerThousandRows = time.Second
+)
+
+type txTimeout struct {
+	base            time.Duration
+	perThousandRows time.Duration
+}
+
+func (t txTimeout) forRows(rows int) time.Duration {
+	base := t.base
+	if base <= 0 {
+		base = defaultTxTimeout
+	}
+	return base + time.Duration(int64(t.perThousandRows)*int64(rows)/1000)
+}
+
+// newUpdateRunID returns the id of the update of the server data started at the given time,
+// it has the same format as the key of the snapshot of the update.
+func newUpdateRunID(serverKey string, startedAt time.Time) string {
+	return serverKey + "/" + startedAt.UTC().Format("20060102T150405Z")
 }
 
 type loadPlayersResult struct {
@@ -64,9 +146,14 @@ type loadPlayersResult struct {
 	numberOfPlayers int
 }
 
-func (w *workerUpdateServerData) loadPlayers(od map[int]*twmodel.OpponentsDefeated) (loadPlayersResult, error) {
+func (w *workerUpdateServerData) loadPlayers(
+	players []*twmodel.Player,
+	od map[int]*twmodel.OpponentsDefeated,
+) (loadPlayersResult, error) {
 	var ennoblements []*twmodel.Ennoblement
-	result := loadPlayersResult{}
+	result := loadPlayersResult{
+		players: players,
+	}
 	if err := w.db.
 		Model(&ennoblements).
 		DistinctOn("new_owner_id").
@@ -76,14 +163,9 @@ func (w *workerUpdateServerData) loadPlayers(od map[int]*twmodel.OpponentsDefeat
 		return result, errors.Wrap(err, "couldn't load ennoblements")
 	}
 
-	var err error
-	result.players, err = w.dataloader.LoadPlayers()
-	if err != nil {
-		return result, err
-	}
 	result.numberOfPlayers = len(result.players)
 
-	now := time.Now()
+	now := w.now()
 	result.playersToServer = make([]*twmodel.PlayerToServer, result.numberOfPlayers)
 	result.ids = make([]int, result.numberOfPlayers)
 	searchableByNewOwnerID := &ennoblementsSearchableByNewOwnerID{ennoblements}
@@ -100,6 +182,8 @@ func (w *workerUpdateServerData) loadPlayers(od map[int]*twmodel.OpponentsDefeat
 			player.DailyGrowth = calcPlayerDailyGrowth(diffInDays, player.Points)
 		}
 
+		setPlayerTimestamps(player, now)
+
 		result.playersToServer[index] = &twmodel.PlayerToServer{
 			PlayerID:  player.ID,
 			ServerKey: w.server.Key,
@@ -125,6 +209,36 @@ func (w *workerUpdateServerData) loadPlayers(od map[int]*twmodel.OpponentsDefeat
 	return result, nil
 }
 
+// setPlayerTimestamps sets the timestamps that would otherwise be set to the wall clock by the column defaults,
+// they're written only if the player is new (see upsertPlayers).
+func setPlayerTimestamps(player *twmodel.Player, now time.Time) {
+	for _, t := range []*time.Time{
+		&player.JoinedAt,
+		&player.BestRankAt,
+		&player.MostPointsAt,
+		&player.MostVillagesAt,
+		&player.LastActivityAt,
+	} {
+		if t.IsZero() {
+			*t = now
+		}
+	}
+}
+
+// setTribeTimestamps is like setPlayerTimestamps, but for a tribe.
+func setTribeTimestamps(tribe *twmodel.Tribe, now time.Time) {
+	for _, t := range []*time.Time{
+		&tribe.CreatedAt,
+		&tribe.BestRankAt,
+		&tribe.MostPointsAt,
+		&tribe.MostVillagesAt,
+	} {
+		if t.IsZero() {
+			*t = now
+		}
+	}
+}
+
 type loadTribesResult struct {
 	ids            []int
 	tribes         []*twmodel.Tribe
@@ -132,17 +246,19 @@ type loadTribesResult struct {
 	numberOfTribes int
 }
 
-func (w *workerUpdateServerData) loadTribes(od map[int]*twmodel.OpponentsDefeated, numberOfVillages int) (loadTribesResult, error) {
-	var err error
-	result := loadTribesResult{}
-	result.tribes, err = w.dataloader.LoadTribes()
-	if err != nil {
-		return result, err
+func (w *workerUpdateServerData) loadTribes(
+	tribes []*twmodel.Tribe,
+	od map[int]*twmodel.OpponentsDefeated,
+	numberOfVillages int,
+) (loadTribesResult, error) {
+	result := loadTribesResult{
+		tribes: tribes,
 	}
-
 	result.numberOfTribes = len(result.tribes)
 	result.ids = make([]int, result.numberOfTribes)
+	now := w.now()
 	for index, tribe := range result.tribes {
+		setTribeTimestamps(tribe, now)
 		tribeOD, ok := od[tribe.ID]
 		if ok {
 			tribe.OpponentsDefeated = *tribeOD
@@ -237,214 +353,342 @@ func (w *workerUpdateServerData) calculateDailyPlayerStats(
 }
 
 func (w *workerUpdateServerData) update() error {
-	pod, err := w.dataloader.LoadOD(false)
-	if err != nil {
+	var (
+		pod         map[int]*twmodel.OpponentsDefeated
+		tod         map[int]*twmodel.OpponentsDefeated
+		villages    []*twmodel.Village
+		tribes      []*twmodel.Tribe
+		players     []*twmodel.Player
+		cfg         *twmodel.ServerConfig
+		buildingCfg *twmodel.BuildingConfig
+		unitCfg     *twmodel.UnitConfig
+	)
+	// the files are independent of each other, so they're downloaded concurrently
+	g := w.downloads
+	g.Go(func() (err error) {
+		pod, err = w.dataloader.LoadOD(false)
 		return errors.Wrap(err, "couldn't load players OD")
-	}
-
-	tod, err := w.dataloader.LoadOD(true)
-	if err != nil {
+	})
+	g.Go(func() (err error) {
+		tod, err = w.dataloader.LoadOD(true)
 		return errors.Wrap(err, "couldn't load tribes OD")
-	}
-
-	villages, err := w.dataloader.LoadVillages()
-	if err != nil {
+	})
+	g.Go(func() (err error) {
+		villages, err = w.dataloader.LoadVillages()
 		return errors.Wrap(err, "couldn't load villages")
-	}
-	numberOfVillages := len(villages)
-
-	tribesResult, err := w.loadTribes(tod, countPlayerVillages(villages))
-	if err != nil {
+	})
+	g.Go(func() (err error) {
+		tribes, err = w.dataloader.LoadTribes()
 		return errors.Wrap(err, "couldn't load tribes")
-	}
-
-	playersResult, err := w.loadPlayers(pod)
-	if err != nil {
+	})
+	g.Go(func() (err error) {
+		players, err = w.dataloader.LoadPlayers()
 		return errors.Wrap(err, "couldn't load players")
+	})
+	g.Go(func() (err error) {
+		cfg, err = w.dataloader.GetConfig()
+		return errors.Wrap(err, "couldn't load server config")
+	})
+	g.Go(func() (err error) {
+		buildingCfg, err = w.dataloader.GetBuildingConfig()
+		return errors.Wrap(err, "couldn't load building config")
+	})
+	g.Go(func() (err error) {
+		unitCfg, err = w.dataloader.GetUnitConfig()
+		return errors.Wrap(err, "couldn't load unit config")
+	})
+	if err := g.Wait(); err != nil {
+		return err
 	}
+	numberOfVillages := len(villages)
 
-	cfg, err := w.dataloader.GetConfig()
-	if err != nil {
-		return errors.Wrap(err, "couldn't load server config")
+	if err := w.checkData(tribes, players, villages); err != nil {
+		return err
 	}
 
-	buildingCfg, err := w.dataloader.GetBuildingConfig()
+	tribesResult, err := w.loadTribes(tribes, tod, countPlayerVillages(villages))
 	if err != nil {
-		return errors.Wrap(err, "couldn't load building config")
+		return errors.Wrap(err, "couldn't prepare tribes")
 	}
 
-	unitCfg, err := w.dataloader.GetUnitConfig()
+	playersResult, err := w.loadPlayers(players, pod)
 	if err != nil {
-		return errors.Wrap(err, "couldn't load unit config")
+		return errors.Wrap(err, "couldn't prepare players")
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
-	defer cancel()
-	return w.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
-		if len(tribesResult.deletedTribes) > 0 {
-			if _, err := tx.Model(&twmodel.Tribe{}).
-				Where("tribe.id  = ANY (?)", pg.Array(tribesResult.deletedTribes)).
-				Set("exists = false").
-				Set("deleted_at = now()").
-				Set("dominance = 0").
-				Update(); err != nil && err != pg.ErrNoRows {
-				return errors.Wrap(err, "couldn't update non-existent tribes")
-			}
-		}
-
-		if tribesResult.numberOfTribes > 0 {
-			if _, err := tx.Model(&tribesResult.tribes).
-				OnConflict("(id) DO UPDATE").
-				Set("name = EXCLUDED.name").
-				Set("tag = EXCLUDED.tag").
-				Set("total_members = EXCLUDED.total_members").
-				Set("total_villages = EXCLUDED.total_villages").
-				Set("points = EXCLUDED.points").
-				Set("all_points = EXCLUDED.all_points").
-				Set("rank = EXCLUDED.rank").
-				Set("exists = EXCLUDED.exists").
-				Set("dominance = EXCLUDED.dominance").
-				Set("deleted_at = null").
-				Apply(appendODSetClauses).
-				Returning("NULL").
-				Insert(); err != nil {
-				return errors.Wrap(err, "couldn't insert tribes")
-			}
+	now := w.now()
+	chunks := []updateChunk{
+		{
+			name: "tribes",
+			rows: len(tribesResult.tribes),
+			fn: func(tx *pg.Tx, upserted *rowsUpserted) error {
+				if len(tribesResult.deletedTribes) > 0 {
+					if _, err := tx.Model(&twmodel.Tribe{}).
+						Where("tribe.id  = ANY (?)", pg.Array(tribesResult.deletedTribes)).
+						Set("exists = false").
+						Set("deleted_at = ?", now).
+						Set("dominance = 0").
+						Update(); err != nil && err != pg.ErrNoRows {
+						return errors.Wrap(err, "couldn't update non-existent tribes")
+					}
+				}
 
-			var tribesHistory []*twmodel.TribeHistory
-			if err := tx.
-				Model(&tribesHistory).
-				DistinctOn("tribe_id").
-				Column("tribe_history.*").
-				Where("tribe.exists = true").
-				Order("tribe_id DESC", "create_date DESC").
-				Relation("Tribe._").
-				Select(); err != nil && err != pg.ErrNoRows {
-				return errors.Wrap(err, "couldn't select tribe history records")
-			}
-			todaysTribeStats := w.calculateTodaysTribeStats(tribesResult.tribes, tribesHistory)
-			if len(todaysTribeStats) > 0 {
-				if _, err := tx.
-					Model(&todaysTribeStats).
-					OnConflict("ON CONSTRAINT daily_tribe_stats_tribe_id_create_date_key DO UPDATE").
-					Set("members = EXCLUDED.members").
-					Set("villages = EXCLUDED.villages").
-					Set("points = EXCLUDED.points").
-					Set("all_points = EXCLUDED.all_points").
-					Set("rank = EXCLUDED.rank").
-					Set("dominance = EXCLUDED.dominance").
-					Apply(appendODSetClauses).
-					Returning("NULL").
-					Insert(); err != nil {
-					return errors.Wrap(err, "couldn't insert today's tribe stats")
+				if tribesResult.numberOfTribes > 0 {
+					res, err := execUpsert(tx, upsertTribes, &tribesResult.tribes, w.bulkThreshold)
+					if err != nil {
+						return errors.Wrap(err, "couldn't insert tribes")
+					}
+					upserted.addUpsert("tribes", res, len(tribesResult.tribes))
+
+					var tribesHistory []*twmodel.TribeHistory
+					if err := tx.
+						Model(&tribesHistory).
+						DistinctOn("tribe_id").
+						Column("tribe_history.*").
+						Where("tribe.exists = true").
+						Order("tribe_id DESC", "create_date DESC").
+						Relation("Tribe._").
+						Select(); err != nil && err != pg.ErrNoRows {
+						return errors.Wrap(err, "couldn't select tribe history records")
+					}
+					todaysTribeStats := w.calculateTodaysTribeStats(tribesResult.tribes, tribesHistory)
+					if len(todaysTribeStats) > 0 {
+						res, err := execUpsert(tx, upsertDailyTribeStats, &todaysTribeStats, w.bulkThreshold)
+						if err != nil {
+							return errors.Wrap(err, "couldn't insert today's tribe stats")
+						}
+						upserted.addUpsert("daily_tribe_stats", res, len(todaysTribeStats))
+					}
+				}
+				return nil
+			},
+		},
+		{
+			name: "players",
+			rows: len(playersResult.players),
+			fn: func(tx *pg.Tx, upserted *rowsUpserted) error {
+				if len(playersResult.deletedPlayers) > 0 {
+					if _, err := tx.Model(&twmodel.Player{}).
+						Where("player.id = ANY (?)", pg.Array(playersResult.deletedPlayers)).
+						Set("exists = false").
+						Set("deleted_at = ?", now).
+						Set("tribe_id = 0").
+						Update(); err != nil && err != pg.ErrNoRows {
+						return errors.Wrap(err, "couldn't mark players as deleted")
+					}
 				}
-			}
-		}
 
-		if len(playersResult.deletedPlayers) > 0 {
-			if _, err := tx.Model(&twmodel.Player{}).
-				Where("player.id = ANY (?)", pg.Array(playersResult.deletedPlayers)).
-				Set("exists = false").
-				Set("deleted_at = now()").
-				Set("tribe_id = 0").
-				Update(); err != nil && err != pg.ErrNoRows {
-				return errors.Wrap(err, "couldn't mark players as deleted")
-			}
-		}
+				if playersResult.numberOfPlayers > 0 {
+					res, err := execUpsert(tx, upsertPlayers, &playersResult.players, w.bulkThreshold)
+					if err != nil {
+						return errors.Wrap(err, "couldn't insert players")
+					}
+					upserted.addUpsert("players", res, len(playersResult.players))
+
+					var playerHistory []*twmodel.PlayerHistory
+					if err := tx.Model(&playerHistory).
+						DistinctOn("player_id").
+						Column("player_history.*").
+						Where("player.exists = true").
+						Relation("Player._").
+						Order("player_id DESC", "create_date DESC").
+						Select(); err != nil && err != pg.ErrNoRows {
+						return errors.Wrap(err, "couldn't select player history records")
+					}
+					todaysPlayerStats := w.calculateDailyPlayerStats(playersResult.players, playerHistory)
+					if len(todaysPlayerStats) > 0 {
+						res, err := execUpsert(tx, upsertDailyPlayerStats, &todaysPlayerStats, w.bulkThreshold)
+						if err != nil {
+							return errors.Wrap(err, "couldn't insert today's player stats")
+						}
+						upserted.addUpsert("daily_player_stats", res, len(todaysPlayerStats))
+					}
+				}
 
-		if playersResult.numberOfPlayers > 0 {
-			if _, err := tx.Model(&playersResult.players).
-				OnConflict("(id) DO UPDATE").
-				Set("name = EXCLUDED.name").
-				Set("total_villages = EXCLUDED.total_villages").
-				Set("points = EXCLUDED.points").
-				Set("rank = EXCLUDED.rank").
-				Set("exists = EXCLUDED.exists").
-				Set("tribe_id = EXCLUDED.tribe_id").
-				Set("daily_growth = EXCLUDED.daily_growth").
-				Set("deleted_at = null").
-				Returning("NULL").
-				Apply(appendODSetClauses).
-				Insert(); err != nil {
-				return errors.Wrap(err, "couldn't insert players")
-			}
+				if len(playersResult.playersToServer) > 0 {
+					if _, err := tx.
+						Model(&playersResult.playersToServer).
+						OnConflict("DO NOTHING").
+						Returning("NULL").
+						Insert(); err != nil {
+						return errors.Wrap(err, "couldn't associate players with the server")
+					}
+				}
+				return nil
+			},
+		},
+		{
+			// the server is updated in the last chunk, so data_updated_at changes only if all chunks have been committed
+			name: "villages",
+			rows: numberOfVillages,
+			fn: func(tx *pg.Tx, upserted *rowsUpserted) error {
+				if len(villages) > 0 {
+					res, err := execUpsert(tx, upsertVillages, &villages, w.bulkThreshold)
+					if err != nil {
+						return errors.Wrap(err, "couldn't insert villages")
+					}
+					upserted.addUpsert("villages", res, len(villages))
+				}
 
-			var playerHistory []*twmodel.PlayerHistory
-			if err := tx.Model(&playerHistory).
-				DistinctOn("player_id").
-				Column("player_history.*").
-				Where("player.exists = true").
-				Relation("Player._").
-				Order("player_id DESC", "create_date DESC").
-				Select(); err != nil && err != pg.ErrNoRows {
-				return errors.Wrap(err, "couldn't select player history records")
-			}
-			todaysPlayerStats := w.calculateDailyPlayerStats(playersResult.players, playerHistory)
-			if len(todaysPlayerStats) > 0 {
-				if _, err := tx.
-					Model(&todaysPlayerStats).
-					OnConflict("ON CONSTRAINT daily_player_stats_player_id_create_date_key DO UPDATE").
-					Set("villages = EXCLUDED.villages").
-					Set("points = EXCLUDED.points").
-					Set("rank = EXCLUDED.rank").
-					Apply(appendODSetClauses).
-					Returning("NULL").
-					Insert(); err != nil {
-					return errors.Wrap(err, "couldn't insert today's player stats")
+				if _, err := tx.Model(w.server).
+					Set("data_updated_at = ?", now).
+					Set("unit_config = ?", unitCfg).
+					Set("building_config = ?", buildingCfg).
+					Set("config = ?", cfg).
+					Set("number_of_players = ?", playersResult.numberOfPlayers).
+					Set("number_of_tribes = ?", tribesResult.numberOfTribes).
+					Set("number_of_villages = ?", numberOfVillages).
+					Returning("*").
+					WherePK().
+					Update(); err != nil {
+					return errors.Wrap(err, "couldn't update server")
 				}
-			}
+				return nil
+			},
+		},
+	}
+	if !w.chunkedCommits {
+		if err := w.commit(now, chunks...); err != nil {
+			return err
 		}
-
-		if len(playersResult.playersToServer) > 0 {
-			if _, err := tx.
-				Model(&playersResult.playersToServer).
-				OnConflict("DO NOTHING").
-				Returning("NULL").
-				Insert(); err != nil {
-				return errors.Wrap(err, "couldn't associate players with the server")
+	} else {
+		for i, chunk := range chunks {
+			if err := w.commit(now, chunk); err != nil {
+				if i > 0 {
+					return errors.Wrapf(err, "run %s: the %s have been committed", w.runID, joinChunkNames(chunks[:i]))
+				}
+				return err
 			}
 		}
+	}
+	serverDataUpdatedTimestamp.WithLabelValues(w.server.Key).Set(float64(now.Unix()))
+	return nil
+}
 
-		if len(villages) > 0 {
-			if _, err := tx.Model(&villages).
-				OnConflict("(id) DO UPDATE").
-				Set("name = EXCLUDED.name").
-				Set("points = EXCLUDED.points").
-				Set("x = EXCLUDED.x").
-				Set("y = EXCLUDED.y").
-				Set("bonus = EXCLUDED.bonus").
-				Set("player_id = EXCLUDED.player_id").
-				Returning("NULL").
-				Insert(); err != nil {
-				return errors.Wrap(err, "couldn't insert villages")
-			}
-		}
+// updateChunk is a part of the update that may be committed separately (see Config.ChunkedCommits).
+type updateChunk struct {
+	name string
+	// rows is the number of upserted rows, the timeout of the transaction depends on it
+	rows int
+	fn   func(tx *pg.Tx, upserted *rowsUpserted) error
+}
 
-		if _, err := tx.Model(w.server).
-			Set("data_updated_at = ?", time.Now()).
-			Set("unit_config = ?", unitCfg).
-			Set("building_config = ?", buildingCfg).
-			Set("config = ?", cfg).
-			Set("number_of_players = ?", playersResult.numberOfPlayers).
-			Set("number_of_tribes = ?", tribesResult.numberOfTribes).
-			Set("number_of_villages = ?", numberOfVillages).
-			Returning("*").
-			WherePK().
-			Update(); err != nil {
-			return errors.Wrap(err, "couldn't update server")
+// commit runs the chunks in a single transaction.
+// All transactions of the run use the same clock, so the deleted_at, data_updated_at etc. are consistent across them.
+func (w *workerUpdateServerData) commit(now time.Time, chunks ...updateChunk) error {
+	rows := 0
+	for _, chunk := range chunks {
+		rows += chunk.rows
+	}
+	ctx, cancel := context.WithTimeout(w.db.Context(), w.txTimeout.forRows(rows))
+	defer cancel()
+	upserted := newRowsUpserted()
+	err := w.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		// the triggers use clock_now() instead of now()
+		if _, err := tx.Exec("SELECT set_config('twhelp.now', ?, true)", now.Format(time.RFC3339Nano)); err != nil {
+			return errors.Wrap(err, "couldn't set the clock")
+		}
+		for _, chunk := range chunks {
+			if err := chunk.fn(tx, upserted); err != nil {
+				return err
+			}
 		}
 		return nil
 	})
+	if err != nil {
+		return errors.Wrapf(err, "couldn't commit the %s", joinChunkNames(chunks))
+	}
+	upserted.report(w.db.Context())
+	log.
+		WithFields(map[string]interface{}{
+			"key":   w.server.Key,
+			"runID": w.runID,
+			"rows":  rows,
+		}).
+		Debugf("workerUpdateServerData.commit: %s: The %s have been committed", w.server.Key, joinChunkNames(chunks))
+	return nil
+}
+
+func joinChunkNames(chunks []updateChunk) string {
+	names := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		names[i] = chunk.name
+	}
+	return strings.Join(names, ", ")
 }
 
-func appendODSetClauses(q *orm.Query) (*orm.Query, error) {
-	return q.Set("rank_att = EXCLUDED.rank_att").
-			Set("score_att = EXCLUDED.score_att").
-			Set("rank_def = EXCLUDED.rank_def").
-			Set("score_def = EXCLUDED.score_def").
-			Set("rank_sup = EXCLUDED.rank_sup").
-			Set("score_sup = EXCLUDED.score_sup").
-			Set("rank_total = EXCLUDED.rank_total").
-			Set("score_total = EXCLUDED.score_total"),
-		nil
+var odColumns = []string{
+	"rank_att",
+	"score_att",
+	"rank_def",
+	"score_def",
+	"rank_sup",
+	"score_sup",
+	"rank_total",
+	"score_total",
 }
+
+var (
+	upsertTribes = upsert{
+		conflict: "(id)",
+		set: append(
+			excluded(append([]string{
+				"name",
+				"tag",
+				"total_members",
+				"total_villages",
+				"points",
+				"all_points",
+				"rank",
+				"exists",
+				"dominance",
+			}, odColumns...)...),
+			setClause{column: "deleted_at", value: "null"},
+		),
+	}
+	upsertDailyTribeStats = upsert{
+		conflict: "ON CONSTRAINT daily_tribe_stats_tribe_id_create_date_key",
+		set: excluded(append([]string{
+			"members",
+			"villages",
+			"points",
+			"all_points",
+			"rank",
+			"dominance",
+		}, odColumns...)...),
+	}
+	upsertPlayers = upsert{
+		conflict: "(id)",
+		set: append(
+			excluded(append([]string{
+				"name",
+				"total_villages",
+				"points",
+				"rank",
+				"exists",
+				"tribe_id",
+				"daily_growth",
+			}, odColumns...)...),
+			setClause{column: "deleted_at", value: "null"},
+		),
+	}
+	upsertDailyPlayerStats = upsert{
+		conflict: "ON CONSTRAINT daily_player_stats_player_id_create_date_key",
+		set: excluded(append([]string{
+			"villages",
+			"points",
+			"rank",
+		}, odColumns...)...),
+	}
+	upsertVillages = upsert{
+		conflict: "(id)",
+		set: excluded(
+			"name",
+			"points",
+			"x",
+			"y",
+			"bonus",
+			"player_id",
+		),
+	}
+)
@@ -0,0 +1,59 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTxTimeoutForRows(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeout  txTimeout
+		rows     int
+		expected time.Duration
+	}{
+		{
+			name:     "default base",
+			timeout:  txTimeout{},
+			rows:     100000,
+			expected: defaultTxTimeout,
+		},
+		{
+			name:     "negative base",
+			timeout:  txTimeout{base: -time.Second, perThousandRows: time.Second},
+			rows:     0,
+			expected: defaultTxTimeout,
+		},
+		{
+			name:     "no rows",
+			timeout:  txTimeout{base: 5 * time.Second, perThousandRows: time.Second},
+			rows:     0,
+			expected: 5 * time.Second,
+		},
+		{
+			name:     "per thousand rows",
+			timeout:  txTimeout{base: 5 * time.Second, perThousandRows: time.Second},
+			rows:     30000,
+			expected: 35 * time.Second,
+		},
+		{
+			name:     "part of a thousand rows",
+			timeout:  txTimeout{base: 5 * time.Second, perThousandRows: time.Second},
+			rows:     1500,
+			expected: 6500 * time.Millisecond,
+		},
+		{
+			name:     "large world",
+			timeout:  txTimeout{base: defaultTxTimeout, perThousandRows: defaultTxTimeoutPerThousandRows},
+			rows:     2000000,
+			expected: defaultTxTimeout + 2000*time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.timeout.forRows(tt.rows); got != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package queue
 
 import (
+	"context"
 	"github.com/go-pg/pg/v10"
 	"github.com/pkg/errors"
 	"github.com/tribalwarshelp/shared/tw/twdataloader"
@@ -11,7 +12,7 @@ type taskUpdateServerEnnoblements struct {
 	*task
 }
 
-func (t *taskUpdateServerEnnoblements) execute(url string, server *twmodel.Server) error {
+func (t *taskUpdateServerEnnoblements) execute(ctx context.Context, url string, server *twmodel.Server) error {
 	if err := t.validatePayload(server); err != nil {
 		log.Debug(errors.Wrap(err, "taskUpdateServerEnnoblements.execute"))
 		return nil
@@ -19,8 +20,8 @@ func (t *taskUpdateServerEnnoblements) execute(url string, server *twmodel.Serve
 	entry := log.WithField("key", server.Key)
 	entry.Debugf("%s: update of the ennoblements has started...", server.Key)
 	err := (&workerUpdateServerEnnoblements{
-		db:         t.db.WithParam("SERVER", pg.Safe(server.Key)),
-		dataloader: newServerDataLoader(url),
+		db:         t.db.WithContext(ctx).WithParam("SERVER", pg.Safe(server.Key)),
+		dataloader: t.newServerDataLoader(ctx, url, server),
 	}).update()
 	if err != nil {
 		err = errors.Wrap(err, "taskUpdateServerEnnoblements.execute")
@@ -67,9 +68,13 @@ func (w *workerUpdateServerEnnoblements) update() error {
 	}
 
 	if len(ennoblements) > 0 {
-		if _, err := w.db.Model(&ennoblements).Returning("NULL").Insert(); err != nil {
+		res, err := w.db.Model(&ennoblements).Returning("NULL").Insert()
+		if err != nil {
 			return errors.Wrap(err, "couldn't insert ennoblements")
 		}
+		upserted := newRowsUpserted()
+		upserted.add("ennoblements", res)
+		upserted.report(w.db.Context())
 	}
 
 	return nil
@@ -1,6 +1,7 @@
 package queue
 
 import (
+	"context"
 	"github.com/go-pg/pg/v10"
 	"github.com/pkg/errors"
 	"github.com/tribalwarshelp/shared/tw/twmodel"
@@ -11,7 +12,7 @@ type taskUpdateServerHistory struct {
 	*task
 }
 
-func (t *taskUpdateServerHistory) execute(timezone string, server *twmodel.Server) error {
+func (t *taskUpdateServerHistory) execute(ctx context.Context, timezone string, server *twmodel.Server) error {
 	if err := t.validatePayload(server); err != nil {
 		log.Debug(errors.Wrap(err, "taskUpdateServerHistory.execute"))
 		return nil
@@ -23,12 +24,24 @@ func (t *taskUpdateServerHistory) execute(timezone string, server *twmodel.Serve
 		return err
 	}
 	entry := log.WithField("key", server.Key)
+	ctx, unlock, err := t.lockServer(ctx, UpdateServerHistory, server.Key)
+	if err != nil {
+		err = errors.Wrap(err, "taskUpdateServerHistory.execute")
+		entry.Warn(err)
+		return err
+	}
+	defer unlock()
 	entry.Infof("taskUpdateServerHistory.execute: %s: Update of the server history has started...", server.Key)
 	err = (&workerUpdateServerHistory{
-		db:       t.db.WithParam("SERVER", pg.Safe(server.Key)),
+		db:       t.db.WithContext(ctx).WithParam("SERVER", pg.Safe(server.Key)),
 		server:   server,
 		location: location,
+		now:      time.Now,
 	}).update()
+	// if the lock has been lost, the task has been cancelled or has written the data without holding it
+	if unlockErr := unlock(); unlockErr != nil {
+		err = unlockErr
+	}
 	if err != nil {
 		err = errors.Wrap(err, "taskUpdateServerHistory.execute")
 		entry.Error(err)
@@ -51,6 +64,7 @@ type workerUpdateServerHistory struct {
 	db       *pg.DB
 	server   *twmodel.Server
 	location *time.Location
+	now      func() time.Time
 }
 
 func (w *workerUpdateServerHistory) update() error {
@@ -59,7 +73,7 @@ func (w *workerUpdateServerHistory) update() error {
 		return errors.Wrap(err, "couldn't load players")
 	}
 
-	now := time.Now().In(w.location)
+	now := w.now().In(w.location)
 	createDate := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
 	var ph []*twmodel.PlayerHistory
 	for _, player := range players {
@@ -103,20 +117,25 @@ func (w *workerUpdateServerHistory) update() error {
 		}
 	}(w.server)
 
+	upserted := newRowsUpserted()
 	if len(ph) > 0 {
-		if _, err := w.db.Model(&ph).Returning("NULL").Insert(); err != nil {
+		res, err := w.db.Model(&ph).Returning("NULL").Insert()
+		if err != nil {
 			return errors.Wrap(err, "couldn't insert players history")
 		}
+		upserted.add("player_history", res)
 	}
 
 	if len(th) > 0 {
-		if _, err := w.db.Model(&th).Returning("NULL").Insert(); err != nil {
+		res, err := w.db.Model(&th).Returning("NULL").Insert()
+		if err != nil {
 			return errors.Wrap(err, "couldn't insert tribes history")
 		}
+		upserted.add("tribe_history", res)
 	}
 
 	if _, err := tx.Model(w.server).
-		Set("history_updated_at = ?", time.Now()).
+		Set("history_updated_at = ?", w.now()).
 		WherePK().
 		Returning("*").
 		Update(); err != nil {
@@ -124,5 +143,10 @@ func (w *workerUpdateServerHistory) update() error {
 
 	}
 
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	upserted.report(w.db.Context())
+	serverHistoryUpdatedTimestamp.WithLabelValues(w.server.Key).Set(float64(w.now().Unix()))
+	return nil
 }
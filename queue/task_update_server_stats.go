@@ -1,6 +1,7 @@
 package queue
 
 import (
+	"context"
 	"github.com/go-pg/pg/v10"
 	"github.com/pkg/errors"
 	"github.com/tribalwarshelp/shared/tw/twmodel"
@@ -11,7 +12,7 @@ type taskUpdateServerStats struct {
 	*task
 }
 
-func (t *taskUpdateServerStats) execute(timezone string, server *twmodel.Server) error {
+func (t *taskUpdateServerStats) execute(ctx context.Context, timezone string, server *twmodel.Server) error {
 	if err := t.validatePayload(server); err != nil {
 		log.Debug(errors.Wrap(err, "taskUpdateServerStats.execute"))
 		return nil
@@ -23,12 +24,24 @@ func (t *taskUpdateServerStats) execute(timezone string, server *twmodel.Server)
 		return err
 	}
 	entry := log.WithField("key", server.Key)
+	ctx, unlock, err := t.lockServer(ctx, UpdateServerStats, server.Key)
+	if err != nil {
+		err = errors.Wrap(err, "taskUpdateServerStats.execute")
+		entry.Warn(err)
+		return err
+	}
+	defer unlock()
 	entry.Infof("taskUpdateServerStats.execute: %s: Update of the server stats has started...", server.Key)
 	err = (&workerUpdateServerStats{
-		db:       t.db.WithParam("SERVER", pg.Safe(server.Key)),
+		db:       t.db.WithContext(ctx).WithParam("SERVER", pg.Safe(server.Key)),
 		server:   server,
 		location: location,
+		now:      time.Now,
 	}).update()
+	// if the lock has been lost, the task has been cancelled or has written the data without holding it
+	if unlockErr := unlock(); unlockErr != nil {
+		err = unlockErr
+	}
 	if err != nil {
 		err = errors.Wrap(err, "taskUpdateServerStats.execute")
 		entry.Error(err)
@@ -51,6 +64,7 @@ type workerUpdateServerStats struct {
 	db       *pg.DB
 	server   *twmodel.Server
 	location *time.Location
+	now      func() time.Time
 }
 
 func (w *workerUpdateServerStats) prepare() (*twmodel.ServerStats, error) {
@@ -91,7 +105,7 @@ func (w *workerUpdateServerStats) prepare() (*twmodel.ServerStats, error) {
 		return nil, errors.Wrap(err, "couldn't count villages")
 	}
 
-	now := time.Now().In(w.location)
+	now := w.now().In(w.location)
 	createDate := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
 	return &twmodel.ServerStats{
 		ActivePlayers:   activePlayers,
@@ -126,12 +140,15 @@ func (w *workerUpdateServerStats) update() error {
 		}
 	}(w.server)
 
-	if _, err := tx.Model(stats).Returning("NULL").Insert(); err != nil {
+	upserted := newRowsUpserted()
+	res, err := tx.Model(stats).Returning("NULL").Insert()
+	if err != nil {
 		return errors.Wrap(err, "couldn't insert server stats")
 	}
+	upserted.add("stats", res)
 
 	_, err = tx.Model(w.server).
-		Set("stats_updated_at = ?", time.Now()).
+		Set("stats_updated_at = ?", w.now()).
 		WherePK().
 		Returning("*").
 		Update()
@@ -139,5 +156,10 @@ func (w *workerUpdateServerStats) update() error {
 		return errors.Wrap(err, "couldn't update the server")
 	}
 
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	upserted.report(w.db.Context())
+	serverStatsUpdatedTimestamp.WithLabelValues(w.server.Key).Set(float64(w.now().Unix()))
+	return nil
 }
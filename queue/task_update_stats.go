@@ -11,7 +11,7 @@ type taskUpdateStats struct {
 	*task
 }
 
-func (t *taskUpdateStats) execute(timezone string) error {
+func (t *taskUpdateStats) execute(ctx context.Context, timezone string) error {
 	entry := log.WithField("timezone", timezone)
 	location, err := t.loadLocation(timezone)
 	if err != nil {
@@ -22,7 +22,7 @@ func (t *taskUpdateStats) execute(timezone string) error {
 	year, month, day := time.Now().In(location).Date()
 	date := time.Date(year, month, day, 1, 45, 0, 0, location)
 	var servers []*twmodel.Server
-	err = t.db.
+	err = t.db.WithContext(ctx).
 		Model(&servers).
 		Where(
 			"status = ? AND (stats_updated_at IS NULL OR stats_updated_at < ?) AND timezone = ?",
@@ -41,7 +41,7 @@ func (t *taskUpdateStats) execute(timezone string) error {
 		WithField("numberOfServers", len(servers)).
 		Info("taskUpdateStats.execute: Update of the stats has started")
 	for _, server := range servers {
-		err := t.queue.Add(GetTask(UpdateServerStats).WithArgs(context.Background(), timezone, server))
+		err := t.queue.Add(GetTask(UpdateServerStats).WithArgs(ctx, timezone, server))
 		if err != nil {
 			log.
 				WithField("key", server.Key).
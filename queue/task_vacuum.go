@@ -10,9 +10,9 @@ type taskVacuum struct {
 	*task
 }
 
-func (t *taskVacuum) execute() error {
+func (t *taskVacuum) execute(ctx context.Context) error {
 	var servers []*twmodel.Server
-	err := t.db.
+	err := t.db.WithContext(ctx).
 		Model(&servers).
 		Select()
 	if err != nil {
@@ -21,8 +21,15 @@ func (t *taskVacuum) execute() error {
 		return err
 	}
 	log.Infof("taskVacuum.execute: The database vacumming process has started...")
+	deleted, err := t.deleteOldTaskRuns(ctx)
+	if err != nil {
+		// the task runs are only a record, vacuuming the servers matters more
+		log.Warn(errors.Wrap(err, "taskVacuum.execute"))
+	} else {
+		log.WithField("deleted", deleted).Debugf("taskVacuum.execute: Deleted %d old task runs", deleted)
+	}
 	for _, server := range servers {
-		err := t.queue.Add(GetTask(VacuumServerData).WithArgs(context.Background(), server))
+		err := t.queue.Add(GetTask(VacuumServerData).WithArgs(ctx, server))
 		if err != nil {
 			log.
 				WithField("key", server.Key).
@@ -1,6 +1,7 @@
 package queue
 
 import (
+	"context"
 	"github.com/go-pg/pg/v10"
 	"github.com/pkg/errors"
 	"github.com/tribalwarshelp/shared/tw/twmodel"
@@ -15,17 +16,28 @@ type taskVacuumServerData struct {
 	*task
 }
 
-func (t *taskVacuumServerData) execute(server *twmodel.Server) error {
+func (t *taskVacuumServerData) execute(ctx context.Context, server *twmodel.Server) error {
 	if err := t.validatePayload(server); err != nil {
 		log.Debug(errors.Wrap(err, "taskVacuumServerData.execute"))
 		return nil
 	}
 	entry := log.WithField("key", server.Key)
+	ctx, unlock, err := t.lockServer(ctx, VacuumServerData, server.Key)
+	if err != nil {
+		err = errors.Wrap(err, "taskVacuumServerData.execute")
+		entry.Warn(err)
+		return err
+	}
+	defer unlock()
 	entry.Infof("taskVacuumServerData.execute: %s: Vacumming the database...", server.Key)
-	err := (&workerVacuumServerDB{
-		db:     t.db.WithParam("SERVER", pg.Safe(server.Key)),
+	err = (&workerVacuumServerDB{
+		db:     t.db.WithContext(ctx).WithParam("SERVER", pg.Safe(server.Key)),
 		server: server,
 	}).vacuum()
+	// if the lock has been lost, the task has been cancelled or has written the data without holding it
+	if unlockErr := unlock(); unlockErr != nil {
+		err = unlockErr
+	}
 	if err != nil {
 		err = errors.Wrap(err, "taskVacuumServerData.execute")
 		entry.Error(err)
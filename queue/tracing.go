@@ -0,0 +1,131 @@
+package queue
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/taskq/v3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName = "github.com/tribalwarshelp/dataupdater/queue"
+)
+
+var tracer = otel.Tracer(tracerName)
+
+// startEnqueueSpan starts the span of adding the message to the queue and adds its trace context
+// to the metadata of the message (see messageMetadata), so the task continues the trace.
+// Nothing is added if tracing is disabled.
+func startEnqueueSpan(msg *taskq.Message) trace.Span {
+	ctx := msg.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, span := tracer.Start(
+		ctx,
+		msg.TaskName+" send",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(taskAttributes(msg)...),
+	)
+	if span.SpanContext().IsValid() {
+		carrier := propagation.MapCarrier{}
+		otel.GetTextMapPropagator().Inject(ctx, carrier)
+		if len(carrier) > 0 {
+			if err := setMessageMetadata(msg, carrier); err != nil {
+				log.
+					WithField("task", msg.TaskName).
+					Warn(errors.Wrapf(err, "startEnqueueSpan: %s: Couldn't append the trace context", msg.TaskName))
+			}
+		}
+	}
+	return span
+}
+
+// startTaskSpan starts the span of processing the message, it continues the trace of the code that has added it.
+// msg.Ctx is replaced with a context holding the span, it's passed to the handler.
+func startTaskSpan(msg *taskq.Message) trace.Span {
+	ctx := msg.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if md := messageMetadataOf(msg); len(md) > 0 {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(md))
+	}
+	ctx, span := tracer.Start(
+		ctx,
+		msg.TaskName,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(append(taskAttributes(msg), attribute.Int("task.attempt", msg.ReservedCount))...),
+	)
+	msg.Ctx = ctx
+	return span
+}
+
+func taskAttributes(msg *taskq.Message) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.String("task.name", msg.TaskName),
+	}
+	info := newMessageInfo(msg)
+	if key := info.serverKey(); key != "" {
+		attrs = append(attrs, attribute.String("server.key", key))
+	}
+	if code := info.versionCode(); code != "" {
+		attrs = append(attrs, attribute.String("version.code", code.String()))
+	}
+	if info.timezone != "" {
+		attrs = append(attrs, attribute.String("timezone", info.timezone))
+	}
+	return attrs
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracingTransport creates a span for each request. The data loaders don't pass a context to the requests,
+// so the parent span is taken from the context of the task that has created the client.
+type tracingTransport struct {
+	next http.RoundTripper
+	ctx  context.Context
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := t.ctx
+	if trace.SpanContextFromContext(req.Context()).IsValid() {
+		ctx = req.Context()
+	}
+	_, span := tracer.Start(
+		ctx,
+		"HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(req.Method),
+			semconv.HTTPURLKey.String(req.URL.String()),
+			semconv.HTTPHostKey.String(req.URL.Host),
+		),
+	)
+	// the span is added to the context of the request, which keeps its own deadline and cancellation
+	resp, err := t.next.RoundTrip(req.WithContext(trace.ContextWithSpan(req.Context(), span)))
+	if err != nil {
+		endSpan(span, err)
+		return resp, err
+	}
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+	if resp.StatusCode >= http.StatusBadRequest {
+		span.SetStatus(codes.Error, "HTTP "+strconv.Itoa(resp.StatusCode))
+	}
+	span.End()
+	return resp, nil
+}
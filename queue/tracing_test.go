@@ -0,0 +1,154 @@
+package queue
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+	"github.com/vmihailenco/taskq/v3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTraceCarrier(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prevTP, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(prevTP)
+		otel.SetTextMapPropagator(prevPropagator)
+	}()
+
+	handlerType := reflect.TypeOf(func(ctx context.Context, timezone string, server *twmodel.Server) error {
+		return nil
+	})
+	server := &twmodel.Server{Key: "zz1"}
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "parent")
+	msg := &taskq.Message{
+		Ctx:      ctx,
+		TaskName: UpdateServerStats,
+		Args:     []interface{}{"UTC", server},
+	}
+	startEnqueueSpan(msg).End()
+	parent.End()
+	if len(msg.Args) != 2 {
+		t.Fatalf("expected the number of args not to change, got %d args", len(msg.Args))
+	}
+
+	// the message is read back from the queue
+	b, err := msg.MarshalArgs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := &taskq.Message{
+		Ctx:      context.Background(),
+		TaskName: UpdateServerStats,
+		ArgsBin:  b,
+	}
+	received.Args, err = decodeArgs(handlerType, received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	span := startTaskSpan(received)
+	span.End()
+
+	if len(received.Args) != 2 {
+		t.Fatalf("expected 2 args, got %d args", len(received.Args))
+	}
+	if got, _ := received.Args[1].(*twmodel.Server); got == nil || got.Key != server.Key {
+		t.Errorf("expected the server %s, got %v", server.Key, received.Args[1])
+	}
+	if got, want := span.SpanContext().TraceID(), parent.SpanContext().TraceID(); got != want {
+		t.Errorf("expected the task span to belong to the trace %s, got %s", want, got)
+	}
+	if got := trace.SpanContextFromContext(received.Ctx); !got.Equal(span.SpanContext()) {
+		t.Errorf("expected the context passed to the handler to hold the task span")
+	}
+	if n := len(recorder.Ended()); n != 3 {
+		t.Errorf("expected 3 spans (parent, send, task), got %d", n)
+	}
+}
+
+func TestMessageMetadata(t *testing.T) {
+	prevPropagator := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTextMapPropagator(prevPropagator)
+
+	server := &twmodel.Server{Key: "zz1"}
+	carrier := messageMetadata{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}
+
+	t.Run("consumer unaware of the carrier", func(t *testing.T) {
+		msg := &taskq.Message{
+			TaskName: UpdateServerStats,
+			Args:     []interface{}{"UTC", server},
+		}
+		if err := setMessageMetadata(msg, carrier); err != nil {
+			t.Fatal(err)
+		}
+		// e.g. a worker deployed before tracing was added
+		var got *twmodel.Server
+		h := taskq.NewHandler(func(ctx context.Context, timezone string, server *twmodel.Server) error {
+			got = server
+			return nil
+		})
+		err := h.HandleMessage(&taskq.Message{
+			Ctx:      context.Background(),
+			TaskName: UpdateServerStats,
+			ArgsBin:  msg.ArgsBin,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == nil || got.Key != server.Key {
+			t.Errorf("expected the server %s, got %v", server.Key, got)
+		}
+	})
+
+	t.Run("appended twice", func(t *testing.T) {
+		msg := &taskq.Message{
+			TaskName: UpdateServerStats,
+			Args:     []interface{}{"UTC", server},
+		}
+		if err := setMessageMetadata(msg, messageMetadata{"traceparent": "x"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := setMessageMetadata(msg, carrier); err != nil {
+			t.Fatal(err)
+		}
+		got, _, err := readMessageMetadata(msg.ArgsBin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, carrier) {
+			t.Errorf("expected the carrier %v, got %v", carrier, got)
+		}
+	})
+}
+
+func TestDecodeArgsWithoutTraceCarrier(t *testing.T) {
+	handlerType := reflect.TypeOf(func(ctx context.Context, timezone string) error {
+		return nil
+	})
+	msg := &taskq.Message{
+		TaskName: UpdateStats,
+		Args:     []interface{}{"UTC"},
+	}
+	b, err := msg.MarshalArgs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	args, err := decodeArgs(handlerType, &taskq.Message{ArgsBin: b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 1 || args[0] != "UTC" {
+		t.Errorf("expected [UTC], got %v", args)
+	}
+}
@@ -0,0 +1,173 @@
+package queue
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+	"github.com/tribalwarshelp/shared/tw/twurlbuilder"
+	"github.com/vmihailenco/taskq/v3"
+)
+
+// TriggerTarget selects the subjects of a manually triggered task, exactly one field must be set
+// unless the task doesn't take any args (e.g. vacuum).
+type TriggerTarget struct {
+	ServerKey   string
+	VersionCode string
+	// All selects all versions (loadServersAndUpdateData), all timezones (updateHistory, updateStats)
+	// or all open servers (the server tasks)
+	All bool
+}
+
+func (target TriggerTarget) count() int {
+	n := 0
+	if target.ServerKey != "" {
+		n++
+	}
+	if target.VersionCode != "" {
+		n++
+	}
+	if target.All {
+		n++
+	}
+	return n
+}
+
+// NewMessages builds the messages of the given task for the target, the args are built the same way
+// as by the tasks that normally add them (e.g. the url of a server via twurlbuilder.BuildServerURL).
+func (q *Queue) NewMessages(ctx context.Context, taskName string, target TriggerTarget) ([]*taskq.Message, error) {
+	task := GetTask(taskName)
+	if !isKnownTask(taskName) || task == nil {
+		return nil, errors.Errorf("unknown task '%s'", taskName)
+	}
+
+	switch taskName {
+	case LoadVersionsAndUpdateServerData, Vacuum, UpdateEnnoblements, DeleteNonExistentVillages:
+		if target.ServerKey != "" || target.VersionCode != "" {
+			return nil, errors.Errorf("the task '%s' runs for all servers, it doesn't take a server or a version", taskName)
+		}
+		return []*taskq.Message{task.WithArgs(ctx)}, nil
+	}
+
+	if target.count() != 1 {
+		return nil, errors.Errorf("the task '%s' requires exactly one of: a server, a version or all", taskName)
+	}
+
+	switch taskName {
+	case LoadServersAndUpdateData:
+		if target.ServerKey != "" {
+			return nil, errors.Errorf("the task '%s' runs for a version, use '%s' to update a single server", taskName, UpdateServerData)
+		}
+		versions, err := q.loadTriggerVersions(ctx, target)
+		if err != nil {
+			return nil, err
+		}
+		msgs := make([]*taskq.Message, 0, len(versions))
+		for _, version := range versions {
+			msgs = append(msgs, task.WithArgs(ctx, version))
+		}
+		return msgs, nil
+	case UpdateHistory, UpdateStats:
+		if target.ServerKey != "" {
+			return nil, errors.Errorf("the task '%s' runs for a timezone, use the server task instead", taskName)
+		}
+		versions, err := q.loadTriggerVersions(ctx, target)
+		if err != nil {
+			return nil, err
+		}
+		var msgs []*taskq.Message
+		seen := make(map[string]bool)
+		for _, version := range versions {
+			if seen[version.Timezone] {
+				continue
+			}
+			seen[version.Timezone] = true
+			msgs = append(msgs, task.WithArgs(ctx, version.Timezone))
+		}
+		return msgs, nil
+	}
+
+	servers, err := q.loadTriggerServers(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]*taskq.Message, 0, len(servers))
+	for _, server := range servers {
+		switch taskName {
+		case UpdateServerData, UpdateServerEnnoblements, ServerDeleteNonExistentVillages:
+			msgs = append(msgs, task.WithArgs(ctx, twurlbuilder.BuildServerURL(server.Key, server.Version.Host), server))
+		case UpdateServerHistory, UpdateServerStats:
+			msgs = append(msgs, task.WithArgs(ctx, server.Version.Timezone, server))
+		case VacuumServerData:
+			msgs = append(msgs, task.WithArgs(ctx, server))
+		default:
+			return nil, errors.Errorf("the task '%s' can't be triggered manually", taskName)
+		}
+	}
+	return msgs, nil
+}
+
+func (q *Queue) loadTriggerVersions(ctx context.Context, target TriggerTarget) ([]*twmodel.Version, error) {
+	var versions []*twmodel.Version
+	query := q.db.WithContext(ctx).Model(&versions).Relation("SpecialServers").Order("code ASC")
+	if target.VersionCode != "" {
+		query = query.Where("code = ?", target.VersionCode)
+	}
+	if err := query.Select(); err != nil {
+		return nil, errors.Wrap(err, "couldn't load the versions")
+	}
+	if len(versions) == 0 && target.VersionCode != "" {
+		return nil, errors.Errorf("version '%s' not found", target.VersionCode)
+	}
+	return versions, nil
+}
+
+// loadTriggerServers loads the open servers of the target, a server selected by its key is loaded whatever its status is.
+func (q *Queue) loadTriggerServers(ctx context.Context, target TriggerTarget) ([]*twmodel.Server, error) {
+	var servers []*twmodel.Server
+	query := q.db.WithContext(ctx).Model(&servers).Relation("Version").Order("server.key ASC")
+	switch {
+	case target.ServerKey != "":
+		query = query.Where("server.key = ?", target.ServerKey)
+	case target.VersionCode != "":
+		query = query.Where("server.version_code = ? AND server.status = ?", target.VersionCode, twmodel.ServerStatusOpen)
+	default:
+		query = query.Where("server.status = ?", twmodel.ServerStatusOpen)
+	}
+	if err := query.Select(); err != nil {
+		return nil, errors.Wrap(err, "couldn't load the servers")
+	}
+	if len(servers) == 0 && target.ServerKey != "" {
+		return nil, errors.Errorf("server '%s' not found", target.ServerKey)
+	}
+	return servers, nil
+}
+
+// Run processes the message in the current process instead of adding it to the queue.
+// The message isn't deduplicated, retried or saved as a failed task, the error is returned instead.
+// The run is recorded in public.task_runs as usual.
+// The messages added by the task (e.g. updateServerData by loadServersAndUpdateData) go to the queue as usual.
+func (q *Queue) Run(msg *taskq.Message) error {
+	h, ok := q.handlers[msg.TaskName]
+	if !ok {
+		return errors.Errorf("unknown task '%s'", msg.TaskName)
+	}
+	run := newTaskRun(msg)
+	msg.Ctx = contextWithTaskRun(msg.Ctx, run)
+	span := startTaskSpan(msg)
+	err := h.HandleMessage(msg)
+	endSpan(span, err)
+	if isRejectedData(err) {
+		q.saveTaskRun(run, TaskRunOutcomeRejected, err)
+	} else if err != nil {
+		q.saveTaskRun(run, TaskRunOutcomeFailed, err)
+	} else {
+		q.saveTaskRun(run, TaskRunOutcomeSuccess, nil)
+	}
+	return err
+}
+
+// MessageSubject describes what the message is about, e.g. "server:pl170" or "timezone:Europe/Warsaw",
+// it's empty for the tasks without args.
+func MessageSubject(msg *taskq.Message) string {
+	return newMessageInfo(msg).key()
+}
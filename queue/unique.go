@@ -0,0 +1,104 @@
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/taskq/v3"
+)
+
+const (
+	uniqueKeyPrefix = "twhelp:queue:unique:"
+)
+
+// releaseUniqueKeyScript deletes the key only if it's still held by the message that has acquired it,
+// it may have expired and been acquired by a newer message in the meantime
+var releaseUniqueKeyScript = redis.NewScript(`
+	if redis.call("get", KEYS[1]) == ARGV[1] then
+		return redis.call("del", KEYS[1])
+	end
+	return 0
+`)
+
+// defaultUniqueFor defines how long a message blocks adding another message of the same task for the same subject
+// (server, version or timezone, see messageInfo.key).
+// The lock is released as soon as the message has been processed or has failed permanently,
+// the period is only an upper bound in case a worker dies.
+var defaultUniqueFor = map[string]time.Duration{
+	LoadServersAndUpdateData:        time.Hour,
+	UpdateServerData:                time.Hour,
+	UpdateServerEnnoblements:        10 * time.Minute,
+	UpdateServerHistory:             6 * time.Hour,
+	UpdateServerStats:               6 * time.Hour,
+	VacuumServerData:                6 * time.Hour,
+	ServerDeleteNonExistentVillages: 6 * time.Hour,
+}
+
+func (q *Queue) uniqueKey(msg *taskq.Message) string {
+	if q.uniqueFor[msg.TaskName] <= 0 {
+		return ""
+	}
+	return uniqueKeyPrefix + msg.TaskName + ":" + newMessageInfo(msg).key()
+}
+
+// acquireUniqueKey returns false if there is already a pending or running message of the same task for the same subject.
+// The key and a random token are stored in the metadata of the message (see messageMetadata),
+// so only this message releases the key, even if its args can't be decoded.
+func (q *Queue) acquireUniqueKey(msg *taskq.Message) (bool, error) {
+	key := q.uniqueKey(msg)
+	if key == "" {
+		return true, nil
+	}
+	token, err := newUniqueToken()
+	if err != nil {
+		return false, errors.Wrap(err, "couldn't generate the unique token")
+	}
+	if err := setMessageMetadata(msg, map[string]string{
+		metadataUniqueKey:   key,
+		metadataUniqueToken: token,
+	}); err != nil {
+		return false, errors.Wrap(err, "couldn't store the unique key in the message")
+	}
+	if q.memoryKeys != nil {
+		return q.memoryKeys.setNX(key, token, q.uniqueFor[msg.TaskName]), nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ok, err := q.redis.SetNX(ctx, key, token, q.uniqueFor[msg.TaskName]).Result()
+	if err != nil {
+		return false, errors.Wrap(err, "couldn't acquire the unique key")
+	}
+	return ok, nil
+}
+
+// releaseUniqueKey releases the key acquired by the message.
+func (q *Queue) releaseUniqueKey(msg *taskq.Message) {
+	md := messageMetadataOf(msg)
+	key, token := md[metadataUniqueKey], md[metadataUniqueToken]
+	if key == "" {
+		return
+	}
+	if q.memoryKeys != nil {
+		q.memoryKeys.delIfValue(key, token)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := releaseUniqueKeyScript.Run(ctx, q.redis, []string{key}, token).Err(); err != nil {
+		log.
+			WithField("key", key).
+			Warn(errors.Wrapf(err, "Queue.releaseUniqueKey: Couldn't release the unique key '%s'", key))
+	}
+}
+
+func newUniqueToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
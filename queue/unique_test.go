@@ -0,0 +1,79 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/vmihailenco/taskq/v3"
+)
+
+func TestUniqueKey(t *testing.T) {
+	newMessage := func() *taskq.Message {
+		msg := taskq.NewMessage(context.Background(), "https://pl170.plemiona.pl")
+		msg.TaskName = UpdateServerEnnoblements
+		return msg
+	}
+	backends := map[string]func(t *testing.T) (q *Queue, expire func(key string)){
+		"memory": func(t *testing.T) (*Queue, func(key string)) {
+			memory := newMemoryKeys()
+			return &Queue{memoryKeys: memory}, memory.del
+		},
+		"redis": func(t *testing.T) (*Queue, func(key string)) {
+			s, err := miniredis.Run()
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(s.Close)
+			client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+			t.Cleanup(func() { _ = client.Close() })
+			return &Queue{redis: client}, func(key string) { s.Del(key) }
+		},
+	}
+
+	for name, newQueue := range backends {
+		t.Run(name, func(t *testing.T) {
+			t.Run("expired key held by a newer message", func(t *testing.T) {
+				q, expire := newQueue(t)
+				q.uniqueFor = map[string]time.Duration{UpdateServerEnnoblements: time.Minute}
+
+				old := newMessage()
+				if ok, err := q.acquireUniqueKey(old); err != nil || !ok {
+					t.Fatalf("expected the key to be acquired, got %v, %v", ok, err)
+				}
+				expire(q.uniqueKey(old))
+				newer := newMessage()
+				if ok, err := q.acquireUniqueKey(newer); err != nil || !ok {
+					t.Fatalf("expected the expired key to be acquired, got %v, %v", ok, err)
+				}
+
+				q.releaseUniqueKey(old)
+				if ok, _ := q.acquireUniqueKey(newMessage()); ok {
+					t.Fatal("expected the key of the newer message to be kept")
+				}
+				q.releaseUniqueKey(newer)
+				if ok, _ := q.acquireUniqueKey(newMessage()); !ok {
+					t.Fatal("expected the key to be released by the message that has acquired it")
+				}
+			})
+
+			t.Run("args that can't be decoded", func(t *testing.T) {
+				q, _ := newQueue(t)
+				q.uniqueFor = map[string]time.Duration{UpdateServerEnnoblements: time.Minute}
+
+				msg := newMessage()
+				if ok, err := q.acquireUniqueKey(msg); err != nil || !ok {
+					t.Fatalf("expected the key to be acquired, got %v, %v", ok, err)
+				}
+				// as received by the worker
+				received := &taskq.Message{TaskName: msg.TaskName, ArgsBin: msg.ArgsBin}
+				q.releaseUniqueKey(received)
+				if ok, _ := q.acquireUniqueKey(newMessage()); !ok {
+					t.Fatal("expected the key to be released without decoding the args")
+				}
+			})
+		})
+	}
+}
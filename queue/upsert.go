@@ -0,0 +1,69 @@
+package queue
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"github.com/go-pg/pg/v10/types"
+)
+
+// upsert describes how the rows of an entity are inserted or updated:
+// INSERT ... ON CONFLICT <conflict> DO UPDATE SET <set> WHERE <the row has changed>.
+// The existing rows are updated only if one of the set columns has a different value,
+// so the unchanged rows don't fire the triggers and don't leave dead tuples.
+type upsert struct {
+	// conflict is the conflict target, e.g. (id) or ON CONSTRAINT daily_player_stats_player_id_create_date_key
+	conflict string
+	set      []setClause
+}
+
+type setClause struct {
+	column string
+	// value is an SQL expression, e.g. EXCLUDED.name or null
+	value string
+}
+
+// excluded sets the columns to the inserted values.
+func excluded(columns ...string) []setClause {
+	clauses := make([]setClause, len(columns))
+	for i, column := range columns {
+		clauses[i] = setClause{column: column, value: "EXCLUDED." + column}
+	}
+	return clauses
+}
+
+func (u upsert) setSQL() string {
+	clauses := make([]string, len(u.set))
+	for i, clause := range u.set {
+		clauses[i] = clause.column + " = " + clause.value
+	}
+	return strings.Join(clauses, ", ")
+}
+
+// changedSQL is the condition of DO UPDATE, alias is the alias of the table the rows are inserted into.
+func (u upsert) changedSQL(alias types.Safe) string {
+	columns := make([]string, len(u.set))
+	values := make([]string, len(u.set))
+	for i, clause := range u.set {
+		columns[i] = string(alias) + "." + clause.column
+		values[i] = clause.value
+	}
+	return "(" + strings.Join(columns, ", ") + ") IS DISTINCT FROM (" + strings.Join(values, ", ") + ")"
+}
+
+func (u upsert) apply(q *orm.Query) (*orm.Query, error) {
+	q = q.OnConflict(u.conflict + " DO UPDATE").Set(u.setSQL())
+	return q.Where(u.changedSQL(q.TableModel().Table().Alias)), nil
+}
+
+// execUpsert upserts the rows (a pointer to a slice of models) with a multi-row INSERT
+// or, if there are at least bulkThreshold of them, via COPY (see bulkUpsert). bulkThreshold <= 0 disables COPY.
+// The result contains only the inserted and changed rows.
+func execUpsert(tx *pg.Tx, u upsert, rows interface{}, bulkThreshold int) (orm.Result, error) {
+	if bulkThreshold > 0 && reflect.Indirect(reflect.ValueOf(rows)).Len() >= bulkThreshold {
+		return bulkUpsert(tx, u, rows)
+	}
+	return tx.Model(rows).Apply(u.apply).Returning("NULL").Insert()
+}